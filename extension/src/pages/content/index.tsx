@@ -12,7 +12,10 @@ chrome.runtime.onMessage.addListener(function(message, sender, sendResponse) {
 	if (code !== 'mfa_code')
 		return;
 
-	const { code: mfaCode } = payload.mfa_code;
+	const { code: mfaCode, top_level_domain, embedded_domain } = payload.mfa_code;
+
+	if (!isBoundToThisFrame(top_level_domain, embedded_domain))
+		return;
 
 	const input = findInput();
 
@@ -32,3 +35,26 @@ function findInput() {
 
 	return null;
 }
+
+// isBoundToThisFrame reports whether a code should be filled in this frame. Codes bound
+// to a site (https://wicg.github.io/sms-one-time-codes/) are only filled in on that site,
+// or in the embedded site's frame within it, and every other code only in the top frame.
+function isBoundToThisFrame(topLevelDomain?: string, embeddedDomain?: string) {
+	const isTopFrame = window === window.top;
+
+	if (!topLevelDomain)
+		return isTopFrame;
+
+	if (!embeddedDomain)
+		return isTopFrame && isSite(location.origin, topLevelDomain);
+
+	const topOrigin = location.ancestorOrigins[location.ancestorOrigins.length - 1];
+
+	return !isTopFrame && topOrigin !== undefined
+		&& isSite(topOrigin, topLevelDomain)
+		&& isSite(location.origin, embeddedDomain);
+}
+
+function isSite(origin: string, domain: string) {
+	return origin === `https://${domain}`;
+}
@@ -50,17 +50,21 @@ function handleMessage(eventData: any) {
 
 	switch (code) {
 		case 'mfa_code':
-			const { code: mfaCode } = payload.mfa_code;
-			
-			handleMfaCode(mfaCode);
+			handleMfaCode(payload.mfa_code);
 			break;
 		default:
 			console.error('Unknown message code', code);
 	}
 }
 
-async function handleMfaCode(code: string) {
-	console.log('handleMfaCode', code);
+interface MfaCode {
+	code: string;
+	top_level_domain?: string;
+	embedded_domain?: string;
+}
+
+async function handleMfaCode(mfaCode: MfaCode) {
+	console.log('handleMfaCode', mfaCode.code);
 
 	const [tab] = await chrome.tabs.query({ active: true, lastFocusedWindow: true });
 	
@@ -71,7 +75,9 @@ async function handleMfaCode(code: string) {
 			code: 'mfa_code',
 			payload: {
 				mfa_code: {
-					code,
+					code: mfaCode.code,
+					top_level_domain: mfaCode.top_level_domain,
+					embedded_domain: mfaCode.embedded_domain,
 				},
 			},
 		});
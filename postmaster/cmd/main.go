@@ -1,9 +1,17 @@
 package main
 
 import (
+	"context"
+	"log"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/0xdeafcafe/pillar-box/server/internal/app"
+	"github.com/0xdeafcafe/pillar-box/server/internal/libraries/messagemonitor"
 )
 
 func main() {
@@ -12,6 +20,82 @@ func main() {
 		debug = os.Args[1] == "--debug"
 	}
 
-	app := app.New(debug)
-	app.Run()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	opts := []app.Option{app.WithDebug(debug)}
+
+	// The broadcaster listens on broadcaster.DefaultAddress unless told otherwise.
+	if address := os.Getenv("PILLAR_BOX_ADDRESS"); address != "" {
+		opts = append(opts, app.WithBroadcasterAddress(address))
+	}
+
+	// Every browser extension can connect unless told otherwise, e.g. to only allow
+	// chrome-extension://<id of the Pillar Box extension>.
+	if origins := os.Getenv("PILLAR_BOX_ALLOWED_ORIGINS"); origins != "" {
+		opts = append(opts, app.WithAllowedOrigins(strings.Split(origins, ",")...))
+	}
+
+	// Messages that arrived while Pillar Box wasn't running are caught up on according to
+	// messagemonitor.DefaultCatchUpPolicy unless told otherwise, e.g. "skip" or "window".
+	if policy := os.Getenv("PILLAR_BOX_CATCH_UP_POLICY"); policy != "" {
+		opts = append(opts, app.WithCatchUpPolicy(messagemonitor.CatchUpPolicy(policy)))
+	}
+	if window, ok := durationEnv("PILLAR_BOX_CATCH_UP_WINDOW"); ok {
+		opts = append(opts, app.WithCatchUpWindow(window))
+	}
+	if age, ok := durationEnv("PILLAR_BOX_MAX_MESSAGE_AGE"); ok {
+		opts = append(opts, app.WithMaxMessageAge(age))
+	}
+
+	// Codes are taken from messages received on every line, over every service, unless
+	// told otherwise, e.g. to only use one SIM of a dual-SIM phone.
+	if lines := os.Getenv("PILLAR_BOX_RECEIVING_LINES"); lines != "" {
+		opts = append(opts, app.WithReceivingLines(strings.Split(lines, ",")...))
+	}
+	if services := os.Getenv("PILLAR_BOX_SERVICES"); services != "" {
+		opts = append(opts, app.WithServices(strings.Split(services, ",")...))
+	}
+	if include := os.Getenv("PILLAR_BOX_INCLUDE_OUTGOING"); include != "" {
+		includeOutgoing, err := strconv.ParseBool(include)
+		if err != nil {
+			log.Fatalf("invalid PILLAR_BOX_INCLUDE_OUTGOING: %v", err)
+		}
+
+		opts = append(opts, app.WithIncludeOutgoing(includeOutgoing))
+	}
+	if policy := os.Getenv("PILLAR_BOX_FILTERED_MESSAGE_POLICY"); policy != "" {
+		opts = append(opts, app.WithFilteredMessagePolicy(messagemonitor.FilteredMessagePolicy(policy)))
+	}
+	if ttl, ok := durationEnv("PILLAR_BOX_CODE_TTL"); ok {
+		opts = append(opts, app.WithDefaultCodeTTL(ttl))
+	}
+
+	a, err := app.New(opts...)
+	if err != nil {
+		log.Fatalf("failed to start: %v", err)
+	}
+
+	err = a.Run(ctx)
+	stop()
+
+	if err != nil {
+		log.Fatalf("failed to shut down cleanly: %v", err)
+	}
+}
+
+// durationEnv reads a duration, e.g. "5m", from the environment variable name. The second
+// return value is false if it isn't set.
+func durationEnv(name string) (time.Duration, bool) {
+	value := os.Getenv(name)
+	if value == "" {
+		return 0, false
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		log.Fatalf("invalid %s: %v", name, err)
+	}
+
+	return duration, true
 }
@@ -5,11 +5,13 @@ go 1.22.2
 require (
 	github.com/Masterminds/semver/v3 v3.3.1
 	github.com/caseymrm/menuet v1.0.3
+	github.com/fsnotify/fsnotify v1.7.0
 	github.com/google/go-github/v68 v68.0.0
 	github.com/google/uuid v1.6.0
 	github.com/gorilla/websocket v1.5.1
 	github.com/mattn/go-sqlite3 v1.14.22
 	github.com/stretchr/testify v1.9.0
+	go.uber.org/goleak v1.3.0
 	golang.design/x/clipboard v0.7.0
 	golang.org/x/exp v0.0.0-20190731235908-ec7cb31e5a56
 )
@@ -1,48 +1,199 @@
 package app
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"sync"
+	"time"
 
 	"github.com/0xdeafcafe/pillar-box/server/internal/libraries/broadcaster"
 	"github.com/0xdeafcafe/pillar-box/server/internal/libraries/messagemonitor"
 	"github.com/0xdeafcafe/pillar-box/server/internal/libraries/os"
 )
 
+// clientStatsInterval is how often the stats of each websocket client are logged.
+const clientStatsInterval = 5 * time.Minute
+
 type App struct {
 	Broadcaster *broadcaster.Broadcaster
 	Monitor     *messagemonitor.MessageMonitor
 	OS          os.OS
+
+	logger         *log.Logger
+	senderRulesErr error
 }
 
-func New(debug bool) *App {
-	monitor, err := messagemonitor.New()
-	if err != nil {
-		panic(errors.Join(errors.New("failed to create monitor"), err))
+// New creates a new App, reading messages from the Messages database and broadcasting
+// codes to websocket clients, unless configured otherwise with opts.
+func New(opts ...Option) (*App, error) {
+	o := &options{
+		broadcasterAddress: broadcaster.DefaultAddress,
+		allowedOrigins:     broadcaster.DefaultAllowedOrigins,
+		logger:             log.Default(),
+		now:                time.Now,
+		catchUpPolicy:      messagemonitor.DefaultCatchUpPolicy,
+		catchUpWindow:      messagemonitor.DefaultCatchUpWindow,
+		maxMessageAge:      messagemonitor.DefaultMaxMessageAge,
+		services:           messagemonitor.AllServices,
+		filteredPolicy:     messagemonitor.DefaultFilteredMessagePolicy,
+		defaultCodeTTL:     messagemonitor.DefaultCodeTTL,
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	if o.configDir == "" {
+		configDir, err := messagemonitor.DefaultConfigDir()
+		if err != nil {
+			return nil, errors.Join(errors.New("failed to find config directory"), err)
+		}
+
+		o.configDir = configDir
+	}
+
+	source := o.source
+	if source == nil {
+		stateFile := messagemonitor.NewStateFile(filepath.Join(o.configDir, messagemonitor.StateFileName))
+
+		chatDBSource, err := messagemonitor.NewChatDBSource(stateFile)
+		if err != nil {
+			return nil, errors.Join(errors.New("failed to create message source"), err)
+		}
+
+		chatDBSource.SetLogger(o.logger)
+		chatDBSource.SetClock(o.now)
+		chatDBSource.SetCatchUpPolicy(o.catchUpPolicy)
+		chatDBSource.SetCatchUpWindow(o.catchUpWindow)
+		source = chatDBSource
 	}
 
-	broadcaster := broadcaster.New()
+	monitor := messagemonitor.New(source)
+	monitor.SetLogger(o.logger)
+	monitor.SetClock(o.now)
+	monitor.SetMaxMessageAge(o.maxMessageAge)
+	monitor.SetReceivingLines(o.receivingLines...)
+	monitor.SetServices(o.services...)
+	monitor.SetIncludeOutgoing(o.includeOutgoing)
+	monitor.SetFilteredMessagePolicy(o.filteredPolicy)
+	monitor.SetDefaultCodeTTL(o.defaultCodeTTL)
+
+	// Allowing every sender when the rules file is broken would ignore any the user had
+	// denied, so deny them all until it's fixed, and tell the user once running.
+	senderRulesPath := filepath.Join(o.configDir, messagemonitor.SenderRulesFileName)
+	senderRules, senderRulesErr := messagemonitor.LoadSenderRules(senderRulesPath)
+	if senderRulesErr != nil {
+		o.logger.Printf("failed to load sender rules, denying every sender: %v path:%s", senderRulesErr, senderRulesPath)
 
-	os, err := os.New(monitor, debug)
-	if err != nil {
-		panic(errors.Join(errors.New("failed to create OS"), err))
+		senderRulesErr = fmt.Errorf("%s: %w", senderRulesPath, senderRulesErr)
+		senderRules = messagemonitor.DenyAllSenderRules("sender rules failed to load")
+	}
+	monitor.SetSenderRules(senderRules)
+
+	b := broadcaster.New()
+	b.SetAddress(o.broadcasterAddress)
+	b.SetAllowedOrigins(o.allowedOrigins...)
+	b.SetLogger(o.logger)
+
+	frontend := o.os
+	if frontend == nil {
+		var err error
+
+		frontend, err = os.New(monitor, o.logger, o.debug)
+		if err != nil {
+			return nil, errors.Join(errors.New("failed to create OS"), err)
+		}
 	}
 
 	return &App{
-		Broadcaster: broadcaster,
+		Broadcaster: b,
 		Monitor:     monitor,
-		OS:          os,
-	}
+		OS:          frontend,
+
+		logger:         o.logger,
+		senderRulesErr: senderRulesErr,
+	}, nil
 }
 
-func (a *App) Run() {
+// Run runs the app until ctx is done or the user quits. The monitor and broadcaster are
+// then stopped, which closes the Messages database and every websocket connection.
+func (a *App) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
 	// Setup detection handlers
 	a.Monitor.RegisterDetectionHandler(a.Broadcaster.BroadcastMFACode)
 	a.Monitor.RegisterDetectionHandler(a.OS.HandleMFACode)
 	a.Monitor.RegisterNoAccessHandler(a.OS.HandleNoAccess)
 
 	// Run server and monitor in go routines
-	go a.Broadcaster.ListenAndBroadcast()
-	go a.Monitor.ListenAndHandle()
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	var errs []error
 
-	a.OS.Run()
+	run := func(name string, fn func(ctx context.Context) error, handleErr func(err error)) {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			if err := fn(ctx); err != nil {
+				a.logger.Printf("%s stopped: %v", name, err)
+
+				// Stopping on shutdown isn't worth telling the user about.
+				if handleErr != nil && ctx.Err() == nil {
+					handleErr(err)
+				}
+
+				mutex.Lock()
+				errs = append(errs, fmt.Errorf("%s: %w", name, err))
+				mutex.Unlock()
+			}
+		}()
+	}
+
+	if a.senderRulesErr != nil {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			a.OS.HandleSenderRulesError(a.senderRulesErr)
+		}()
+	}
+
+	run("broadcaster", a.Broadcaster.ListenAndBroadcast, a.OS.HandleBroadcasterError)
+	run("monitor", a.Monitor.ListenAndHandle, nil)
+	run("client stats", a.logClientStats, nil)
+
+	return a.OS.Run(ctx, func() error {
+		cancel()
+		wg.Wait()
+
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		return errors.Join(errs...)
+	})
+}
+
+// logClientStats logs the stats of every websocket client every clientStatsInterval,
+// until ctx is done, so clients that keep dropping codes can be spotted.
+func (a *App) logClientStats(ctx context.Context) error {
+	ticker := time.NewTicker(clientStatsInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			for _, stats := range a.Broadcaster.Stats() {
+				a.logger.Printf("client stats connection_identifier:%s connected_at:%s last_pong_at:%s delivered:%d dropped:%d",
+					stats.ConnectionIdentifier, stats.ConnectedAt.Format(time.RFC3339), stats.LastPongAt.Format(time.RFC3339), stats.Delivered, stats.Dropped)
+			}
+		}
+	}
 }
@@ -0,0 +1,327 @@
+package app
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	stdos "os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/goleak"
+
+	"github.com/0xdeafcafe/pillar-box/server/internal/libraries/broadcaster"
+	"github.com/0xdeafcafe/pillar-box/server/internal/libraries/messagemonitor"
+	"github.com/0xdeafcafe/pillar-box/server/internal/libraries/os"
+)
+
+// fakeOS is a headless OS that hands detected codes to the test.
+type fakeOS struct {
+	*os.Headless
+
+	detections      chan *messagemonitor.Detection
+	broadcasterErrs chan error
+	senderRulesErrs chan error
+}
+
+func newFakeOS(logger *log.Logger) *fakeOS {
+	return &fakeOS{
+		Headless:        os.NewHeadless(logger),
+		detections:      make(chan *messagemonitor.Detection, 1),
+		broadcasterErrs: make(chan error, 1),
+		senderRulesErrs: make(chan error, 1),
+	}
+}
+
+func (f *fakeOS) HandleMFACode(detection *messagemonitor.Detection) {
+	f.detections <- detection
+}
+
+func (f *fakeOS) HandleBroadcasterError(err error) {
+	f.broadcasterErrs <- err
+}
+
+func (f *fakeOS) HandleSenderRulesError(err error) {
+	f.senderRulesErrs <- err
+}
+
+func TestApp(t *testing.T) {
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+	logger := log.New(io.Discard, "", 0)
+	now := time.Date(2024, time.May, 1, 12, 0, 0, 0, time.UTC)
+
+	configDir := t.TempDir()
+	rules := `{"rules":[{"action":"deny","match":"exact","value":"+31611111111"}]}`
+	if err := stdos.WriteFile(filepath.Join(configDir, messagemonitor.SenderRulesFileName), []byte(rules), 0o600); err != nil {
+		t.Fatalf("writing sender rules: %v", err)
+	}
+
+	source := messagemonitor.NewMemorySource()
+	frontend := newFakeOS(logger)
+
+	a, err := New(
+		WithSource(source),
+		WithBroadcasterAddress("127.0.0.1:0"),
+		WithOS(frontend),
+		WithLogger(logger),
+		WithClock(func() time.Time { return now }),
+		WithConfigDir(configDir),
+	)
+	if err != nil {
+		t.Fatalf("creating app: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	done := make(chan error)
+	go func() {
+		done <- a.Run(ctx)
+	}()
+
+	source.Push(
+		&messagemonitor.Message{ID: "denied", Sender: "+31611111111", Service: messagemonitor.ServiceSMS, ReceivedAt: now, Text: "Your code is 1111"},
+		&messagemonitor.Message{ID: "allowed", Sender: "4664", Service: messagemonitor.ServiceSMS, ReceivedAt: now.Add(-time.Minute), Text: "Your code is 4821"},
+	)
+
+	select {
+	case detection := <-frontend.detections:
+		assert.Equal(t, "4821", detection.Code)
+		assert.Equal(t, now, detection.DetectedAt)
+		assert.Equal(t, now.Add(-time.Minute).Add(messagemonitor.DefaultCodeTTL), detection.ExpiresAt)
+	case <-time.After(2 * time.Second):
+		t.Fatal("code was not handled")
+	}
+
+	cancel()
+
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("app did not stop after the context was cancelled")
+	}
+}
+
+func TestAppWithMaxMessageAge(t *testing.T) {
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+	logger := log.New(io.Discard, "", 0)
+	now := time.Date(2024, time.May, 1, 12, 0, 0, 0, time.UTC)
+
+	source := messagemonitor.NewMemorySource()
+	frontend := newFakeOS(logger)
+
+	a, err := New(
+		WithSource(source),
+		WithBroadcasterAddress("127.0.0.1:0"),
+		WithOS(frontend),
+		WithLogger(logger),
+		WithClock(func() time.Time { return now }),
+		WithConfigDir(t.TempDir()),
+		WithMaxMessageAge(time.Minute),
+	)
+	if err != nil {
+		t.Fatalf("creating app: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	done := make(chan error)
+	go func() {
+		done <- a.Run(ctx)
+	}()
+
+	// The first code would still be valid, but the message is older than allowed.
+	source.Push(
+		&messagemonitor.Message{ID: "old", Sender: "4664", Service: messagemonitor.ServiceSMS, ReceivedAt: now.Add(-2 * time.Minute), Text: "Your code is 1111"},
+		&messagemonitor.Message{ID: "new", Sender: "4664", Service: messagemonitor.ServiceSMS, ReceivedAt: now, Text: "Your code is 4821"},
+	)
+
+	select {
+	case detection := <-frontend.detections:
+		assert.Equal(t, "4821", detection.Code)
+	case <-time.After(2 * time.Second):
+		t.Fatal("code was not handled")
+	}
+
+	cancel()
+
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("app did not stop after the context was cancelled")
+	}
+}
+
+func TestAppWithMessageOptions(t *testing.T) {
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+	logger := log.New(io.Discard, "", 0)
+	now := time.Date(2024, time.May, 1, 12, 0, 0, 0, time.UTC)
+
+	source := messagemonitor.NewMemorySource()
+	frontend := newFakeOS(logger)
+
+	a, err := New(
+		WithSource(source),
+		WithBroadcasterAddress("127.0.0.1:0"),
+		WithOS(frontend),
+		WithLogger(logger),
+		WithClock(func() time.Time { return now }),
+		WithConfigDir(t.TempDir()),
+		WithReceivingLines("+31600000001"),
+		WithServices(messagemonitor.ServiceSMS),
+		WithIncludeOutgoing(true),
+		WithFilteredMessagePolicy(messagemonitor.FilteredMessagePolicyAllow),
+		WithDefaultCodeTTL(time.Minute),
+	)
+	if err != nil {
+		t.Fatalf("creating app: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	done := make(chan error)
+	go func() {
+		done <- a.Run(ctx)
+	}()
+
+	// Only the last message is on the chosen line, over the chosen service.
+	source.Push(
+		&messagemonitor.Message{ID: "other-line", Sender: "4664", Service: messagemonitor.ServiceSMS, ReceivedBy: "+31600000002", ReceivedAt: now, Text: "Your code is 1111"},
+		&messagemonitor.Message{ID: "other-service", Sender: "a@example.com", Service: messagemonitor.ServiceIMessage, ReceivedBy: "+31600000001", ReceivedAt: now, Text: "Your code is 2222"},
+		&messagemonitor.Message{ID: "allowed", Sender: "4664", Service: messagemonitor.ServiceSMS, ReceivedBy: "+31600000001", ReceivedAt: now, FromMe: true, Filter: messagemonitor.MessageFilterJunk, Text: "Your code is 4821"},
+	)
+
+	select {
+	case detection := <-frontend.detections:
+		assert.Equal(t, "4821", detection.Code)
+		assert.Equal(t, now.Add(time.Minute), detection.ExpiresAt)
+	case <-time.After(2 * time.Second):
+		t.Fatal("code was not handled")
+	}
+
+	cancel()
+
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("app did not stop after the context was cancelled")
+	}
+}
+
+func TestAppAddressInUse(t *testing.T) {
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening: %v", err)
+	}
+	defer listener.Close()
+
+	logger := log.New(io.Discard, "", 0)
+	frontend := newFakeOS(logger)
+
+	a, err := New(
+		WithSource(messagemonitor.NewMemorySource()),
+		WithBroadcasterAddress(listener.Addr().String()),
+		WithOS(frontend),
+		WithLogger(logger),
+		WithConfigDir(t.TempDir()),
+	)
+	if err != nil {
+		t.Fatalf("creating app: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	done := make(chan error)
+	go func() {
+		done <- a.Run(ctx)
+	}()
+
+	// The monitor carries on without the broadcaster, but the user is told.
+	select {
+	case err := <-frontend.broadcasterErrs:
+		assert.ErrorIs(t, err, broadcaster.ErrAddressInUse)
+	case <-time.After(2 * time.Second):
+		t.Fatal("broadcaster error was not handled")
+	}
+
+	cancel()
+
+	select {
+	case err := <-done:
+		assert.ErrorIs(t, err, broadcaster.ErrAddressInUse)
+	case <-time.After(5 * time.Second):
+		t.Fatal("app did not stop after the context was cancelled")
+	}
+}
+
+func TestAppWithBrokenSenderRules(t *testing.T) {
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+	configDir := t.TempDir()
+	if err := stdos.WriteFile(filepath.Join(configDir, messagemonitor.SenderRulesFileName), []byte("{"), 0o600); err != nil {
+		t.Fatalf("writing sender rules: %v", err)
+	}
+
+	logger := log.New(io.Discard, "", 0)
+	source := messagemonitor.NewMemorySource()
+	frontend := newFakeOS(logger)
+
+	// A broken rules file doesn't stop the app from starting.
+	a, err := New(
+		WithSource(source),
+		WithBroadcasterAddress("127.0.0.1:0"),
+		WithOS(frontend),
+		WithLogger(logger),
+		WithConfigDir(configDir),
+	)
+	if err != nil {
+		t.Fatalf("creating app: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	done := make(chan error)
+	go func() {
+		done <- a.Run(ctx)
+	}()
+
+	select {
+	case err := <-frontend.senderRulesErrs:
+		assert.ErrorContains(t, err, messagemonitor.SenderRulesFileName)
+	case <-time.After(2 * time.Second):
+		t.Fatal("sender rules error was not handled")
+	}
+
+	// But every sender is denied until it's fixed, rather than allowed.
+	source.Push(&messagemonitor.Message{ID: "1", Sender: "4664", Service: messagemonitor.ServiceSMS, ReceivedAt: time.Now(), Text: "Your code is 4821"})
+
+	select {
+	case detection := <-frontend.detections:
+		t.Fatalf("code was handled: %s", detection.Code)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	cancel()
+
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("app did not stop after the context was cancelled")
+	}
+}
@@ -0,0 +1,165 @@
+package app
+
+import (
+	"log"
+	"time"
+
+	"github.com/0xdeafcafe/pillar-box/server/internal/libraries/messagemonitor"
+	"github.com/0xdeafcafe/pillar-box/server/internal/libraries/os"
+)
+
+// Option configures an App created by New.
+type Option func(*options)
+
+type options struct {
+	debug              bool
+	source             messagemonitor.MessageSource
+	broadcasterAddress string
+	allowedOrigins     []string
+	os                 os.OS
+	logger             *log.Logger
+	now                func() time.Time
+	configDir          string
+	catchUpPolicy      messagemonitor.CatchUpPolicy
+	catchUpWindow      time.Duration
+	maxMessageAge      time.Duration
+	receivingLines     []string
+	services           []string
+	includeOutgoing    bool
+	filteredPolicy     messagemonitor.FilteredMessagePolicy
+	defaultCodeTTL     time.Duration
+}
+
+// WithDebug turns on debug features, like the menu item to dispatch a mock code.
+func WithDebug(debug bool) Option {
+	return func(o *options) {
+		o.debug = debug
+	}
+}
+
+// WithSource sets where messages are read from. It defaults to the Messages database of
+// the current user, with its cursor kept in the config directory.
+func WithSource(source messagemonitor.MessageSource) Option {
+	return func(o *options) {
+		o.source = source
+	}
+}
+
+// WithBroadcasterAddress sets the host and port websocket clients connect to, see
+// broadcaster.SetAddress. It defaults to broadcaster.DefaultAddress, which only accepts
+// connections from this machine.
+func WithBroadcasterAddress(address string) Option {
+	return func(o *options) {
+		o.broadcasterAddress = address
+	}
+}
+
+// WithAllowedOrigins sets the browser origins websocket clients can connect from, e.g.
+// the origin of the Pillar Box extension, see broadcaster.SetAllowedOrigins. It defaults
+// to broadcaster.DefaultAllowedOrigins.
+func WithAllowedOrigins(origins ...string) Option {
+	return func(o *options) {
+		o.allowedOrigins = origins
+	}
+}
+
+// WithOS sets the OS frontend, e.g. os.NewHeadless to run without a user interface. It
+// defaults to the frontend for the current OS.
+func WithOS(frontend os.OS) Option {
+	return func(o *options) {
+		o.os = frontend
+	}
+}
+
+// WithLogger sets the logger every component logs to. It defaults to the standard
+// logger.
+func WithLogger(logger *log.Logger) Option {
+	return func(o *options) {
+		o.logger = logger
+	}
+}
+
+// WithClock sets the function used to tell the time, which decides when codes expire
+// and which messages are too old to handle. It defaults to time.Now.
+func WithClock(now func() time.Time) Option {
+	return func(o *options) {
+		o.now = now
+	}
+}
+
+// WithConfigDir sets the directory state and sender rules are kept in. It defaults to
+// messagemonitor.DefaultConfigDir.
+func WithConfigDir(dir string) Option {
+	return func(o *options) {
+		o.configDir = dir
+	}
+}
+
+// WithCatchUpPolicy sets which of the messages that arrived while the app wasn't running
+// are handled when it starts, see messagemonitor.CatchUpPolicy. It only applies to the
+// default source, and defaults to messagemonitor.DefaultCatchUpPolicy.
+func WithCatchUpPolicy(policy messagemonitor.CatchUpPolicy) Option {
+	return func(o *options) {
+		o.catchUpPolicy = policy
+	}
+}
+
+// WithCatchUpWindow sets how far back messagemonitor.CatchUpWindow looks for messages
+// when the app starts. It only applies to the default source, and defaults to
+// messagemonitor.DefaultCatchUpWindow.
+func WithCatchUpWindow(window time.Duration) Option {
+	return func(o *options) {
+		o.catchUpWindow = window
+	}
+}
+
+// WithMaxMessageAge sets how long ago a message can have been received before its code
+// is ignored, see messagemonitor.SetMaxMessageAge. An age of 0 turns the check off. It
+// defaults to messagemonitor.DefaultMaxMessageAge.
+func WithMaxMessageAge(age time.Duration) Option {
+	return func(o *options) {
+		o.maxMessageAge = age
+	}
+}
+
+// WithReceivingLines limits the app to codes from messages received on the given lines,
+// e.g. one SIM of a dual-SIM phone, see messagemonitor.SetReceivingLines. It defaults to
+// every line.
+func WithReceivingLines(lines ...string) Option {
+	return func(o *options) {
+		o.receivingLines = lines
+	}
+}
+
+// WithServices sets which services, e.g. messagemonitor.ServiceSMS, codes are taken from.
+// It defaults to messagemonitor.AllServices.
+func WithServices(services ...string) Option {
+	return func(o *options) {
+		o.services = services
+	}
+}
+
+// WithIncludeOutgoing sets whether codes are taken from messages the user sent, as well
+// as those they received. It defaults to false.
+func WithIncludeOutgoing(include bool) Option {
+	return func(o *options) {
+		o.includeOutgoing = include
+	}
+}
+
+// WithFilteredMessagePolicy sets which messages Messages filtered as junk or from unknown
+// senders codes are still taken from. It defaults to
+// messagemonitor.DefaultFilteredMessagePolicy.
+func WithFilteredMessagePolicy(policy messagemonitor.FilteredMessagePolicy) Option {
+	return func(o *options) {
+		o.filteredPolicy = policy
+	}
+}
+
+// WithDefaultCodeTTL sets how long a code is valid for when its message doesn't say. It
+// defaults to messagemonitor.DefaultCodeTTL.
+func WithDefaultCodeTTL(ttl time.Duration) Option {
+	return func(o *options) {
+		o.defaultCodeTTL = ttl
+	}
+}
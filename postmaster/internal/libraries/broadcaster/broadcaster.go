@@ -1,15 +1,56 @@
 package broadcaster
 
 import (
+	"context"
 	"encoding/json"
-	"fmt"
+	"errors"
 	"log"
+	"net"
 	"net/http"
+	"sort"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
+
+	"github.com/0xdeafcafe/pillar-box/server/internal/libraries/messagemonitor"
+)
+
+const (
+	// DefaultAddress is where the broadcaster listens for websocket connections unless
+	// told otherwise. Only this machine can connect, see SetAddress.
+	DefaultAddress = "localhost:3500"
+
+	// localhost is the host that listens on every loopback address.
+	localhost = "localhost"
+
+	// shutdownTimeout is how long the server is given to finish with open requests once
+	// the broadcaster is stopping.
+	shutdownTimeout = 5 * time.Second
+
+	// DefaultPingInterval is how often clients are pinged to keep their connection open,
+	// and check they're still there.
+	DefaultPingInterval = 2 * time.Second
+
+	// DefaultPongTimeout is how long a client can go without answering a ping before its
+	// connection is closed.
+	DefaultPongTimeout = 10 * time.Second
+
+	// maxDroppedMessages is how many messages can be dropped for a client, because its
+	// send queue was full, before it is evicted. A brief stall doesn't cost a client its
+	// connection, but one that has stopped taking messages doesn't linger.
+	maxDroppedMessages = 3
+)
+
+var (
+	ErrAddressInUse = errors.New("address is already in use")
+
+	// DefaultAllowedOrigins lets every browser extension connect, but no web page, see
+	// SetAllowedOrigins.
+	DefaultAllowedOrigins = []string{"chrome-extension://*", "moz-extension://*", "safari-web-extension://*"}
 )
 
 type PayloadCode string
@@ -19,9 +60,22 @@ const (
 )
 
 type Broadcaster struct {
-	mutex           sync.Mutex
-	openConnections map[string]*websocket.Conn
-	running         bool
+	address        string
+	allowedOrigins []string
+	logger         *log.Logger
+
+	pingInterval time.Duration
+	pongTimeout  time.Duration
+
+	// mutex guards clients and closing. Nothing is written to a connection while it is
+	// held, as each client has its own goroutine doing the writing.
+	mutex   sync.Mutex
+	clients map[string]*client
+	closing bool
+
+	// connections tracks the goroutines serving each client, so shutdown can wait for
+	// them.
+	connections sync.WaitGroup
 }
 
 type WebsocketMessage struct {
@@ -33,98 +87,366 @@ type WebsocketMessagePayload struct {
 	MFACode *WebsocketMessagePayloadMFACode `json:"mfa_code"`
 }
 
+// WebsocketMessagePayloadMFACode is a detected code as sent to clients. The sender and
+// text of the message are deliberately left out, as clients only need enough to fill in
+// and label the code. Codes with a TopLevelDomain must only be filled in on that site,
+// see messagemonitor.Detection.
 type WebsocketMessagePayloadMFACode struct {
-	Code string `json:"code"`
+	Code           string    `json:"code"`
+	Issuer         string    `json:"issuer,omitempty"`
+	TopLevelDomain string    `json:"top_level_domain,omitempty"`
+	EmbeddedDomain string    `json:"embedded_domain,omitempty"`
+	ExpiresAt      time.Time `json:"expires_at"`
+	ReceivedAt     time.Time `json:"received_at"`
+	Service        string    `json:"service"`
 }
 
 // New creates a new Broadcaster instance. The Broadcaster is responsible for managing
 // websocket connections and broadcasting messages to connected clients.
 func New() *Broadcaster {
 	return &Broadcaster{
-		mutex:           sync.Mutex{},
-		openConnections: make(map[string]*websocket.Conn),
-		running:         false,
+		address:        DefaultAddress,
+		allowedOrigins: DefaultAllowedOrigins,
+		logger:         log.Default(),
+		pingInterval:   DefaultPingInterval,
+		pongTimeout:    DefaultPongTimeout,
+		clients:        make(map[string]*client),
 	}
 }
 
-func (b *Broadcaster) BroadcastMFACode(code string) {
+// SetAddress sets the host and port the broadcaster listens on, e.g. "localhost:4000".
+// It defaults to DefaultAddress.
+//
+// The host "localhost" listens on both 127.0.0.1 and ::1, so only this machine can
+// connect however localhost resolves in the browser. Any other host is listened on as
+// is, and one that isn't a loopback address lets other devices on the network receive
+// codes.
+func (b *Broadcaster) SetAddress(address string) {
+	b.address = address
+}
+
+// SetAllowedOrigins sets the origins browsers can connect from, e.g.
+// "chrome-extension://abcdefghijklmnopabcdefghijklmnop". An origin of the form
+// "scheme://*" allows any origin with that scheme. It defaults to DefaultAllowedOrigins.
+//
+// Listening on loopback keeps other devices out, but not the web pages open in the
+// user's browser, which could otherwise connect and read every code. Clients that
+// aren't browsers don't send an origin, and are always allowed.
+func (b *Broadcaster) SetAllowedOrigins(origins ...string) {
+	b.allowedOrigins = origins
+}
+
+// SetPingInterval sets how often clients are pinged. It defaults to DefaultPingInterval,
+// and only affects clients that connect after it is set.
+func (b *Broadcaster) SetPingInterval(interval time.Duration) {
+	b.pingInterval = interval
+}
+
+// SetPongTimeout sets how long a client can go without answering a ping before its
+// connection is closed. It should be a few times the ping interval, so a single slow
+// pong isn't fatal. It defaults to DefaultPongTimeout, and only affects clients that
+// connect after it is set.
+func (b *Broadcaster) SetPongTimeout(timeout time.Duration) {
+	b.pongTimeout = timeout
+}
+
+// SetLogger sets the logger the broadcaster logs to. It defaults to the standard logger.
+func (b *Broadcaster) SetLogger(logger *log.Logger) {
+	b.logger = logger
+}
+
+func (b *Broadcaster) BroadcastMFACode(detection *messagemonitor.Detection) {
+	code := detection.Code
 	message := &WebsocketMessage{
 		Code: string(PayloadCodeMFACode),
 		Payload: &WebsocketMessagePayload{
 			MFACode: &WebsocketMessagePayloadMFACode{
-				Code: code,
+				Code:           code,
+				Issuer:         detection.Issuer,
+				TopLevelDomain: detection.TopLevelDomain,
+				EmbeddedDomain: detection.EmbeddedDomain,
+				ExpiresAt:      detection.ExpiresAt,
+				ReceivedAt:     detection.ReceivedAt,
+				Service:        detection.Service,
 			},
 		},
 	}
 
 	buf, err := json.Marshal(message)
 	if err != nil {
-		log.Printf("broadcaster: failed to marshal message: %v", err)
+		b.logger.Printf("broadcaster: failed to marshal message: %v", err)
 		return
 	}
 
 	b.mutex.Lock()
 	defer b.mutex.Unlock()
 
-	for connIdent, conn := range b.openConnections {
-		if conn == nil {
+	// Queueing never blocks, so a slow client can't hold up the others, or the monitor.
+	// A client whose queue keeps overflowing is evicted, so it can reconnect and start
+	// afresh.
+	for id, client := range b.clients {
+		if client.queue(buf) {
+			b.logger.Printf("broadcaster: queued code code_length:%d connection_identifier:%s", len(code), id)
+			continue
+		}
+
+		stats := client.stats()
+		if stats.Dropped < maxDroppedMessages {
+			b.logger.Printf("broadcaster: send queue full, dropped code connection_identifier:%s dropped:%d", id, stats.Dropped)
+			continue
+		}
+
+		b.logger.Printf("broadcaster: send queue full, evicting client connection_identifier:%s dropped:%d", id, stats.Dropped)
+
+		delete(b.clients, id)
+		client.close(websocket.CloseTryAgainLater, "send queue full")
+	}
+}
+
+// ClientStats describes a connected client.
+type ClientStats struct {
+	ConnectionIdentifier string
+
+	// ConnectedAt is when the client connected, and LastPongAt when it last answered a
+	// ping, or the zero time if it hasn't yet.
+	ConnectedAt time.Time
+	LastPongAt  time.Time
+
+	// Delivered is how many messages have been written to the client, and Dropped how
+	// many couldn't be queued for it.
+	Delivered uint64
+	Dropped   uint64
+}
+
+// Stats returns the stats of every connected client, longest connected first.
+func (b *Broadcaster) Stats() []ClientStats {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	stats := make([]ClientStats, 0, len(b.clients))
+	for _, client := range b.clients {
+		stats = append(stats, client.stats())
+	}
+
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].ConnectedAt.Before(stats[j].ConnectedAt)
+	})
+
+	return stats
+}
+
+// ListenAndBroadcast listens for websocket connections on the broadcaster's address
+// until ctx is done, then shuts down, see Serve. If the address is already in use the
+// error returned is ErrAddressInUse.
+func (b *Broadcaster) ListenAndBroadcast(ctx context.Context) error {
+	listeners, err := b.listen()
+	if err != nil {
+		return err
+	}
+
+	return b.Serve(ctx, listeners...)
+}
+
+// listen listens on the broadcaster's address, which for localhost means a listener for
+// each loopback address.
+func (b *Broadcaster) listen() ([]net.Listener, error) {
+	host, port, err := net.SplitHostPort(b.address)
+	if err != nil {
+		return nil, err
+	}
+
+	hosts := []string{host}
+	if host == localhost {
+		hosts = []string{"127.0.0.1", "::1"}
+	} else if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		b.logger.Printf("broadcaster: address isn't loopback only, other devices on the network can receive codes address:%s", b.address)
+	}
+
+	listeners := make([]net.Listener, 0, len(hosts))
+	for i, host := range hosts {
+		address := net.JoinHostPort(host, port)
+
+		listener, err := net.Listen("tcp", address)
+		if err == nil {
+			// A port of 0 picks any free port, which has to be the same on every address.
+			_, port, _ = net.SplitHostPort(listener.Addr().String())
+			listeners = append(listeners, listener)
+			continue
+		}
+
+		// IPv6 may be turned off, in which case IPv4 will do.
+		if i > 0 && host == "::1" && !errors.Is(err, syscall.EADDRINUSE) {
+			b.logger.Printf("broadcaster: failed to listen on ipv6 loopback, carrying on with ipv4: %v", err)
 			continue
 		}
 
-		log.Printf("broadcaster: failed to marshal message: %v code_length:%d code:%s connection_identifier:%s", err, len(code), code, connIdent)
+		for _, listener := range listeners {
+			listener.Close()
+		}
+
+		if errors.Is(err, syscall.EADDRINUSE) {
+			return nil, errors.Join(ErrAddressInUse, err)
+		}
+
+		return nil, err
+	}
+
+	return listeners, nil
+}
+
+// Serve accepts websocket connections on listeners until ctx is done, or serving one of
+// them fails. It then sends every connected client a close frame, closes their
+// connections and shuts the server down, returning once that's done.
+func (b *Broadcaster) Serve(ctx context.Context, listeners ...net.Listener) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", b.handleWebsocket)
+
+	server := &http.Server{Handler: mux}
+
+	serveErrs := make(chan error, len(listeners))
+	for _, listener := range listeners {
+		b.logger.Printf("broadcaster: listening address:%s", listener.Addr())
+
+		go func(listener net.Listener) {
+			serveErrs <- server.Serve(listener)
+		}(listener)
+	}
+
+	var errs []error
+	served := 0
+	select {
+	case err := <-serveErrs:
+		errs = append(errs, err)
+		served++
+	case <-ctx.Done():
+	}
+
+	b.logger.Printf("broadcaster: shutting down")
+
+	// Websocket connections have been hijacked from the server, so Shutdown doesn't wait
+	// for them and they have to be closed separately.
+	b.closeConnections()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		errs = append(errs, err)
+	}
+
+	for ; served < len(listeners); served++ {
+		if err := <-serveErrs; !errors.Is(err, http.ErrServerClosed) {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// checkOrigin reports whether a websocket connection is from an allowed origin, see
+// SetAllowedOrigins.
+func (b *Broadcaster) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	for _, allowed := range b.allowedOrigins {
+		if scheme, ok := strings.CutSuffix(allowed, "://*"); ok {
+			if strings.HasPrefix(origin, scheme+"://") {
+				return true
+			}
+
+			continue
+		}
 
-		if err := conn.WriteMessage(websocket.TextMessage, []byte(buf)); err != nil {
-			log.Printf("broadcaster: failed to write message: %v", err)
+		if origin == allowed {
+			return true
 		}
 	}
+
+	b.logger.Printf("broadcaster: rejecting connection from disallowed origin origin:%s", origin)
+
+	return false
 }
 
-func (b *Broadcaster) ListenAndBroadcast() {
+func (b *Broadcaster) handleWebsocket(w http.ResponseWriter, r *http.Request) {
 	wsUpgrader := websocket.Upgrader{
 		ReadBufferSize:  1024,
 		WriteBufferSize: 1024,
-		CheckOrigin: func(r *http.Request) bool {
-			return true
-		},
+		CheckOrigin:     b.checkOrigin,
 	}
 
-	http.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
-		conn, err := wsUpgrader.Upgrade(w, r, nil)
-		if err != nil {
-			panic(fmt.Sprintf("broadcaster: failed to upgrade connection: %v", err))
-		}
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader has already responded with an error.
+		b.logger.Printf("broadcaster: failed to upgrade connection: %v", err)
+		return
+	}
 
-		connectionIdentifier := uuid.New().String()
+	client := newClient(uuid.New().String(), conn, b.logger, b.pingInterval, b.pongTimeout)
 
-		log.Printf("broadcaster: new connection connection_identifier:%s", connectionIdentifier)
+	b.mutex.Lock()
+	if b.closing {
+		b.mutex.Unlock()
 
-		b.mutex.Lock()
-		defer b.mutex.Unlock()
+		client.close(websocket.CloseGoingAway, "server shutting down")
+		client.writeLoop()
 
-		b.openConnections[connectionIdentifier] = conn
-		b.mutex.Unlock()
+		return
+	}
 
-		for {
-			time.Sleep(time.Second * 2)
+	b.logger.Printf("broadcaster: new connection connection_identifier:%s", client.id)
 
-			if err := conn.WriteMessage(websocket.PingMessage, []byte("keepalive")); err == nil {
-				continue
-			}
+	b.clients[client.id] = client
+	b.connections.Add(1)
+	b.mutex.Unlock()
 
-			log.Printf("broadcaster: closing connection: %v connection_identifier:%s", err, connectionIdentifier)
+	defer b.connections.Done()
 
-			if err := conn.Close(); err != nil {
-				log.Printf("broadcaster: failed to close connection: %v connection_identifier:%s", err, connectionIdentifier)
-			}
+	writerDone := make(chan struct{})
+	go func() {
+		defer close(writerDone)
+		client.writeLoop()
+	}()
 
-			b.mutex.Lock()
-			defer b.mutex.Unlock()
-			b.openConnections[connectionIdentifier] = nil
-		}
-	})
+	// The read loop runs until the connection is closed, by the client or by the writer
+	// giving up on it. Either way the client is done with.
+	client.readLoop()
+	client.close(0, "")
+	<-writerDone
+
+	b.removeClient(client)
+
+	// The client's stats go with it, so log them while they're still around.
+	stats := client.stats()
+	b.logger.Printf("broadcaster: connection closed connection_identifier:%s connected_for:%s delivered:%d dropped:%d", client.id, time.Since(stats.ConnectedAt).Round(time.Second), stats.Delivered, stats.Dropped)
+}
+
+// removeClient forgets a client, so nothing more is queued for it.
+func (b *Broadcaster) removeClient(client *client) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
 
-	// TODO(afr): make this configurable
-	go http.ListenAndServe(":3500", nil)
+	if b.clients[client.id] == client {
+		delete(b.clients, client.id)
+	}
+}
+
+// closeConnections stops accepting connections, sends every client a close frame and
+// closes its connection, then waits for the goroutines serving them to finish.
+func (b *Broadcaster) closeConnections() {
+	b.mutex.Lock()
+	b.closing = true
+	clients := make([]*client, 0, len(b.clients))
+	for _, client := range b.clients {
+		clients = append(clients, client)
+	}
+	b.mutex.Unlock()
+
+	for _, client := range clients {
+		client.close(websocket.CloseGoingAway, "server shutting down")
+	}
 
-	b.running = true
+	b.connections.Wait()
 }
@@ -0,0 +1,530 @@
+package broadcaster
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/goleak"
+
+	"github.com/0xdeafcafe/pillar-box/server/internal/libraries/messagemonitor"
+)
+
+// newTestBroadcaster creates a Broadcaster served by an httptest server, returning the
+// URL clients connect to.
+func newTestBroadcaster(t *testing.T) (*Broadcaster, string) {
+	t.Helper()
+
+	b := New()
+	b.SetLogger(log.New(io.Discard, "", 0))
+
+	server := httptest.NewServer(http.HandlerFunc(b.handleWebsocket))
+	t.Cleanup(func() {
+		b.closeConnections()
+		server.Close()
+	})
+
+	return b, "ws" + strings.TrimPrefix(server.URL, "http") + "/ws"
+}
+
+// connect connects a client to url, and waits for the broadcaster to register it.
+func connect(t *testing.T, b *Broadcaster, url string) *websocket.Conn {
+	t.Helper()
+
+	b.mutex.Lock()
+	connected := len(b.clients)
+	b.mutex.Unlock()
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("connecting: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	waitForClients(t, b, connected+1)
+
+	return conn
+}
+
+func waitForClients(t *testing.T, b *Broadcaster, n int) {
+	t.Helper()
+
+	assert.Eventually(t, func() bool {
+		b.mutex.Lock()
+		defer b.mutex.Unlock()
+
+		return len(b.clients) == n
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+func readCode(t *testing.T, conn *websocket.Conn) string {
+	t.Helper()
+
+	payload := readMFACode(t, conn)
+	if payload == nil {
+		return ""
+	}
+
+	return payload.Code
+}
+
+// readMFACode reads the next code sent to conn, or returns nil if there isn't one.
+func readMFACode(t *testing.T, conn *websocket.Conn) *WebsocketMessagePayloadMFACode {
+	t.Helper()
+
+	assert.NoError(t, conn.SetReadDeadline(time.Now().Add(2*time.Second)))
+
+	_, buf, err := conn.ReadMessage()
+	if !assert.NoError(t, err) {
+		return nil
+	}
+
+	message := &WebsocketMessage{}
+	if !assert.NoError(t, json.Unmarshal(buf, message)) {
+		return nil
+	}
+
+	return message.Payload.MFACode
+}
+
+func TestBroadcastMFACode(t *testing.T) {
+	b, url := newTestBroadcaster(t)
+
+	first := connect(t, b, url)
+	second := connect(t, b, url)
+
+	b.BroadcastMFACode(&messagemonitor.Detection{Code: "482913", Service: messagemonitor.ServiceSMS})
+
+	assert.Equal(t, "482913", readCode(t, first))
+	assert.Equal(t, "482913", readCode(t, second))
+}
+
+func TestBroadcastOriginBoundCode(t *testing.T) {
+	b, url := newTestBroadcaster(t)
+	conn := connect(t, b, url)
+
+	receivedAt := time.Now().Truncate(time.Second).UTC()
+	source := messagemonitor.NewMemorySource(
+		&messagemonitor.Message{ID: "1", Service: messagemonitor.ServiceSMS, ReceivedAt: receivedAt, Text: "Your code is 123456.\n\n@shop.example #123456 @pay.example"},
+		&messagemonitor.Message{ID: "2", Service: messagemonitor.ServiceSMS, ReceivedAt: receivedAt, Text: "Your code is 4821"},
+	)
+	source.Close()
+
+	m := messagemonitor.New(source)
+	m.SetLogger(log.New(io.Discard, "", 0))
+	m.RegisterDetectionHandler(b.BroadcastMFACode)
+	m.ListenAndHandle(context.Background())
+
+	// The domains a code is bound to reach clients, so they only fill it in there.
+	assert.Equal(t, &WebsocketMessagePayloadMFACode{
+		Code:           "123456",
+		TopLevelDomain: "shop.example",
+		EmbeddedDomain: "pay.example",
+		ExpiresAt:      receivedAt.Add(messagemonitor.DefaultCodeTTL),
+		ReceivedAt:     receivedAt,
+		Service:        messagemonitor.ServiceSMS,
+	}, readMFACode(t, conn))
+
+	assert.Equal(t, &WebsocketMessagePayloadMFACode{
+		Code:       "4821",
+		ExpiresAt:  receivedAt.Add(messagemonitor.DefaultCodeTTL),
+		ReceivedAt: receivedAt,
+		Service:    messagemonitor.ServiceSMS,
+	}, readMFACode(t, conn))
+}
+
+func TestBroadcastMFACodeConcurrently(t *testing.T) {
+	b, url := newTestBroadcaster(t)
+	// Ping constantly, so pings are written alongside the codes.
+	b.SetPingInterval(time.Millisecond)
+
+	conns := []*websocket.Conn{connect(t, b, url), connect(t, b, url)}
+
+	const broadcasts = sendQueueSize
+	var wg sync.WaitGroup
+	for i := 0; i < broadcasts; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			b.BroadcastMFACode(&messagemonitor.Detection{Code: fmt.Sprint(i)})
+		}(i)
+	}
+	wg.Wait()
+
+	for _, conn := range conns {
+		codes := make(map[string]bool)
+		for i := 0; i < broadcasts; i++ {
+			codes[readCode(t, conn)] = true
+		}
+
+		assert.Len(t, codes, broadcasts)
+	}
+}
+
+func TestClientDisconnect(t *testing.T) {
+	b, url := newTestBroadcaster(t)
+
+	staying := connect(t, b, url)
+	leaving := connect(t, b, url)
+
+	// A client that closes its connection properly is removed.
+	message := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	assert.NoError(t, leaving.WriteControl(websocket.CloseMessage, message, time.Now().Add(time.Second)))
+	waitForClients(t, b, 1)
+
+	// So is one that just goes away.
+	vanishing := connect(t, b, url)
+	vanishing.Close()
+	waitForClients(t, b, 1)
+
+	b.BroadcastMFACode(&messagemonitor.Detection{Code: "482913"})
+	assert.Equal(t, "482913", readCode(t, staying))
+}
+
+func TestBroadcastMFACodeEvictsSlowClient(t *testing.T) {
+	b := New()
+	b.SetLogger(log.New(io.Discard, "", 0))
+
+	// A client whose writer has stalled, so nothing is taken off its queue.
+	stalled := newClient("stalled", nil, b.logger, b.pingInterval, b.pongTimeout)
+	b.clients[stalled.id] = stalled
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		for i := 0; i < sendQueueSize*2; i++ {
+			b.BroadcastMFACode(&messagemonitor.Detection{Code: fmt.Sprint(i)})
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("broadcasting blocked on a stalled client")
+	}
+
+	// The client is evicted once its queue has overflowed a few times, with a close frame
+	// saying so.
+	assert.Empty(t, b.Stats())
+	assert.Len(t, stalled.send, sendQueueSize)
+	assert.Equal(t, uint64(maxDroppedMessages), stalled.stats().Dropped)
+	assert.Equal(t, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "send queue full"), stalled.closeMessage)
+
+	select {
+	case <-stalled.done:
+	default:
+		t.Fatal("stalled client was not closed")
+	}
+}
+
+func TestBroadcastMFACodeKeepsBrieflyStalledClient(t *testing.T) {
+	b := New()
+	b.SetLogger(log.New(io.Discard, "", 0))
+
+	stalled := newClient("stalled", nil, b.logger, b.pingInterval, b.pongTimeout)
+	b.clients[stalled.id] = stalled
+
+	for i := 0; i < sendQueueSize+maxDroppedMessages-1; i++ {
+		b.BroadcastMFACode(&messagemonitor.Detection{Code: fmt.Sprint(i)})
+	}
+
+	// The codes that didn't fit are dropped, but the client stays connected.
+	stats := b.Stats()
+	if assert.Len(t, stats, 1) {
+		assert.Equal(t, uint64(maxDroppedMessages-1), stats[0].Dropped)
+	}
+
+	select {
+	case <-stalled.done:
+		t.Fatal("briefly stalled client was closed")
+	default:
+	}
+}
+
+func TestPongTimeout(t *testing.T) {
+	b, url := newTestBroadcaster(t)
+	b.SetPingInterval(10 * time.Millisecond)
+	b.SetPongTimeout(100 * time.Millisecond)
+
+	// Gorilla only answers pings while reading, so a client that reads stays connected,
+	// and one that doesn't stops answering pings.
+	reading := connect(t, b, url)
+	go func() {
+		for {
+			if _, _, err := reading.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	connect(t, b, url)
+
+	waitForClients(t, b, 1)
+
+	assert.Eventually(t, func() bool {
+		stats := b.Stats()
+		return len(stats) == 1 && !stats[0].LastPongAt.IsZero()
+	}, 2*time.Second, 10*time.Millisecond)
+
+	// And stays connected well past the pong timeout.
+	time.Sleep(300 * time.Millisecond)
+	assert.Len(t, b.Stats(), 1)
+}
+
+func TestStats(t *testing.T) {
+	b, url := newTestBroadcaster(t)
+
+	before := time.Now()
+	first := connect(t, b, url)
+	second := connect(t, b, url)
+
+	b.BroadcastMFACode(&messagemonitor.Detection{Code: "482913"})
+	assert.Equal(t, "482913", readCode(t, first))
+	assert.Equal(t, "482913", readCode(t, second))
+
+	b.BroadcastMFACode(&messagemonitor.Detection{Code: "913170"})
+	assert.Equal(t, "913170", readCode(t, first))
+
+	// Delivered is counted once the write has finished, which can be just after the
+	// client has read it.
+	assert.Eventually(t, func() bool {
+		stats := b.Stats()
+		return len(stats) == 2 && stats[0].Delivered == 2 && stats[1].Delivered == 2
+	}, 2*time.Second, 10*time.Millisecond)
+
+	stats := b.Stats()
+	assert.NotEqual(t, stats[0].ConnectionIdentifier, stats[1].ConnectionIdentifier)
+	for _, s := range stats {
+		assert.WithinDuration(t, before, s.ConnectedAt, time.Second)
+		assert.Zero(t, s.Dropped)
+	}
+	assert.False(t, stats[0].ConnectedAt.After(stats[1].ConnectedAt))
+}
+
+func TestServeShutdown(t *testing.T) {
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening: %v", err)
+	}
+
+	b := New()
+	b.SetLogger(log.New(io.Discard, "", 0))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	done := make(chan error)
+	go func() {
+		done <- b.Serve(ctx, listener)
+	}()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws://"+listener.Addr().String()+"/ws", nil)
+	if err != nil {
+		t.Fatalf("connecting: %v", err)
+	}
+	defer conn.Close()
+
+	waitForClients(t, b, 1)
+
+	b.BroadcastMFACode(&messagemonitor.Detection{Code: "482913", Service: messagemonitor.ServiceSMS})
+	assert.Equal(t, "482913", readCode(t, conn))
+
+	cancel()
+
+	// Clients are told the server is going away before it stops.
+	_, _, err = conn.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseGoingAway), "unexpected error: %v", err)
+
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("broadcaster did not stop after the context was cancelled")
+	}
+
+	b.mutex.Lock()
+	assert.Empty(t, b.clients)
+	b.mutex.Unlock()
+}
+
+func TestServeListenerClosed(t *testing.T) {
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening: %v", err)
+	}
+	listener.Close()
+
+	open, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening: %v", err)
+	}
+
+	// Serving stops on every listener when one of them fails.
+	b := New()
+	b.SetLogger(log.New(io.Discard, "", 0))
+	assert.Error(t, b.Serve(context.Background(), listener, open))
+}
+
+func TestCheckOrigin(t *testing.T) {
+	tests := []struct {
+		name           string
+		allowedOrigins []string
+		origin         string
+		want           bool
+	}{
+		{
+			name: "No origin",
+			want: true,
+		},
+		{
+			name:   "Chrome extension",
+			origin: "chrome-extension://abcdefghijklmnopabcdefghijklmnop",
+			want:   true,
+		},
+		{
+			name:   "Firefox extension",
+			origin: "moz-extension://0b1d2c3e-4f5a-6b7c-8d9e-0f1a2b3c4d5e",
+			want:   true,
+		},
+		{
+			name:   "Web page",
+			origin: "https://evil.example",
+			want:   false,
+		},
+		{
+			name:   "Localhost web page",
+			origin: "http://localhost:8080",
+			want:   false,
+		},
+		{
+			name:           "Allowed extension",
+			allowedOrigins: []string{"chrome-extension://abcdefghijklmnopabcdefghijklmnop"},
+			origin:         "chrome-extension://abcdefghijklmnopabcdefghijklmnop",
+			want:           true,
+		},
+		{
+			name:           "Other extension",
+			allowedOrigins: []string{"chrome-extension://abcdefghijklmnopabcdefghijklmnop"},
+			origin:         "chrome-extension://ponmlkjihgfedcbaponmlkjihgfedcba",
+			want:           false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := New()
+			b.SetLogger(log.New(io.Discard, "", 0))
+			if tt.allowedOrigins != nil {
+				b.SetAllowedOrigins(tt.allowedOrigins...)
+			}
+
+			r := httptest.NewRequest(http.MethodGet, "/ws", nil)
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+
+			assert.Equal(t, tt.want, b.checkOrigin(r))
+		})
+	}
+}
+
+func TestHandleWebsocketRejectsWebPages(t *testing.T) {
+	b, url := newTestBroadcaster(t)
+
+	_, resp, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": []string{"https://evil.example"}})
+	assert.ErrorIs(t, err, websocket.ErrBadHandshake)
+	if assert.NotNil(t, resp) {
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	}
+
+	waitForClients(t, b, 0)
+}
+
+func TestListen(t *testing.T) {
+	b := New()
+	b.SetLogger(log.New(io.Discard, "", 0))
+	b.SetAddress("localhost:0")
+
+	listeners, err := b.listen()
+	if err != nil {
+		t.Fatalf("listening: %v", err)
+	}
+	defer func() {
+		for _, listener := range listeners {
+			listener.Close()
+		}
+	}()
+
+	// Only loopback addresses are listened on, all on the same port.
+	ports := map[int]bool{}
+	for _, listener := range listeners {
+		addr := listener.Addr().(*net.TCPAddr)
+		assert.True(t, addr.IP.IsLoopback(), "listening on %s", addr)
+		ports[addr.Port] = true
+	}
+	assert.NotEmpty(t, listeners)
+	assert.Len(t, ports, 1)
+}
+
+func TestListenErrors(t *testing.T) {
+	inUse, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening: %v", err)
+	}
+	defer inUse.Close()
+
+	_, port, _ := net.SplitHostPort(inUse.Addr().String())
+
+	tests := []struct {
+		name        string
+		address     string
+		expectedErr error
+	}{
+		{
+			name:        "address in use",
+			address:     inUse.Addr().String(),
+			expectedErr: ErrAddressInUse,
+		},
+		{
+			name:        "localhost in use",
+			address:     net.JoinHostPort("localhost", port),
+			expectedErr: ErrAddressInUse,
+		},
+		{
+			name:    "missing port",
+			address: "localhost",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := New()
+			b.SetLogger(log.New(io.Discard, "", 0))
+			b.SetAddress(tt.address)
+
+			listeners, err := b.listen()
+			assert.Error(t, err)
+			assert.Empty(t, listeners)
+
+			if tt.expectedErr != nil {
+				assert.ErrorIs(t, err, tt.expectedErr)
+			}
+		})
+	}
+}
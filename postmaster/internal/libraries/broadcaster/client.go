@@ -0,0 +1,172 @@
+package broadcaster
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// sendQueueSize is how many messages can be waiting to be written to a client before
+	// more are dropped.
+	sendQueueSize = 16
+
+	// writeTimeout is how long a single write to a client can take before the client is
+	// given up on.
+	writeTimeout = 10 * time.Second
+
+	// maxMessageSize is the largest message read from a client. Clients have nothing to
+	// say, so anything bigger isn't a client we know.
+	maxMessageSize = 4096
+)
+
+// client is a websocket connection to a single client. Gorilla connections support one
+// concurrent writer, so everything is written by writeLoop, and one concurrent reader,
+// readLoop.
+type client struct {
+	id     string
+	conn   *websocket.Conn
+	logger *log.Logger
+
+	pingInterval time.Duration
+	pongTimeout  time.Duration
+
+	connectedAt time.Time
+	lastPongAt  atomic.Int64
+	delivered   atomic.Uint64
+	dropped     atomic.Uint64
+
+	// send queues messages for writeLoop to write.
+	send chan []byte
+
+	// done is closed when the client should be disconnected, with closeMessage the close
+	// frame to send first, if any.
+	done         chan struct{}
+	closeOnce    sync.Once
+	closeMessage []byte
+}
+
+func newClient(id string, conn *websocket.Conn, logger *log.Logger, pingInterval, pongTimeout time.Duration) *client {
+	return &client{
+		id:           id,
+		conn:         conn,
+		logger:       logger,
+		pingInterval: pingInterval,
+		pongTimeout:  pongTimeout,
+		connectedAt:  time.Now(),
+		send:         make(chan []byte, sendQueueSize),
+		done:         make(chan struct{}),
+	}
+}
+
+// queue queues a message to be written to the client, without blocking. It returns false
+// if the queue is full and the message was dropped.
+func (c *client) queue(message []byte) bool {
+	select {
+	case c.send <- message:
+		return true
+	default:
+		c.dropped.Add(1)
+		return false
+	}
+}
+
+func (c *client) stats() ClientStats {
+	stats := ClientStats{
+		ConnectionIdentifier: c.id,
+		ConnectedAt:          c.connectedAt,
+		Delivered:            c.delivered.Load(),
+		Dropped:              c.dropped.Load(),
+	}
+
+	if lastPongAt := c.lastPongAt.Load(); lastPongAt != 0 {
+		stats.LastPongAt = time.Unix(0, lastPongAt)
+	}
+
+	return stats
+}
+
+// close tells writeLoop to send the client a close frame with code and text, then close
+// the connection. A code of 0 closes the connection without a close frame, e.g. when the
+// client has already sent one. Only the first call has any effect.
+func (c *client) close(code int, text string) {
+	c.closeOnce.Do(func() {
+		if code != 0 {
+			c.closeMessage = websocket.FormatCloseMessage(code, text)
+		}
+
+		close(c.done)
+	})
+}
+
+// writeLoop writes queued messages and keepalive pings to the client until it is closed,
+// or a write fails. It closes the connection when it returns, which stops readLoop.
+func (c *client) writeLoop() {
+	keepalive := time.NewTicker(c.pingInterval)
+	defer keepalive.Stop()
+
+	defer func() {
+		if err := c.conn.Close(); err != nil {
+			c.logger.Printf("broadcaster: failed to close connection: %v connection_identifier:%s", err, c.id)
+		}
+	}()
+
+	for {
+		select {
+		case <-c.done:
+			if c.closeMessage != nil {
+				if err := c.conn.WriteControl(websocket.CloseMessage, c.closeMessage, time.Now().Add(writeTimeout)); err != nil {
+					c.logger.Printf("broadcaster: failed to send close message: %v connection_identifier:%s", err, c.id)
+				}
+			}
+
+			return
+		case message := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+
+			if err := c.conn.WriteMessage(websocket.TextMessage, message); err != nil {
+				c.logger.Printf("broadcaster: failed to write message: %v connection_identifier:%s", err, c.id)
+				return
+			}
+
+			c.delivered.Add(1)
+		case <-keepalive.C:
+			if err := c.conn.WriteControl(websocket.PingMessage, []byte("keepalive"), time.Now().Add(writeTimeout)); err != nil {
+				c.logger.Printf("broadcaster: closing connection: %v connection_identifier:%s", err, c.id)
+				return
+			}
+		}
+	}
+}
+
+// readLoop reads from the client until the connection is closed. Clients don't send
+// anything but control frames, which gorilla only handles while reading: pongs keep the
+// connection alive, and close frames are answered before the read fails.
+//
+// A client that doesn't answer pings within the pong timeout hits the read deadline, and
+// is disconnected.
+func (c *client) readLoop() {
+	c.conn.SetReadLimit(maxMessageSize)
+	c.conn.SetReadDeadline(time.Now().Add(c.pongTimeout))
+	c.conn.SetPongHandler(func(string) error {
+		now := time.Now()
+		c.lastPongAt.Store(now.UnixNano())
+
+		return c.conn.SetReadDeadline(now.Add(c.pongTimeout))
+	})
+
+	for {
+		if _, _, err := c.conn.NextReader(); err != nil {
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				c.logger.Printf("broadcaster: client closed connection connection_identifier:%s", c.id)
+			} else {
+				c.logger.Printf("broadcaster: closing connection: %v connection_identifier:%s", err, c.id)
+			}
+
+			return
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package messagemonitor
+
+import "time"
+
+// CatchUpPolicy decides which of the messages that arrived before the monitor started a
+// source hands to it, e.g. those that arrived overnight while the Mac was off.
+//
+// Whatever the policy, messages older than the monitor's maximum message age are still
+// ignored, see SetMaxMessageAge.
+type CatchUpPolicy string
+
+const (
+	// CatchUpResume hands over every message that arrived since the last one handled
+	// before the monitor stopped. The first time the monitor starts nothing is handed
+	// over. It is the default.
+	CatchUpResume CatchUpPolicy = "resume"
+
+	// CatchUpSkip skips every message that arrived before the monitor started.
+	CatchUpSkip CatchUpPolicy = "skip"
+
+	// CatchUpWindow hands over the messages that arrived within the catch-up window
+	// before the monitor started.
+	CatchUpWindow CatchUpPolicy = "window"
+
+	// CatchUpLatest hands over only the newest message.
+	CatchUpLatest CatchUpPolicy = "latest"
+)
+
+const (
+	// DefaultCatchUpPolicy is the catch-up policy sources use unless told otherwise.
+	DefaultCatchUpPolicy = CatchUpResume
+
+	// DefaultCatchUpWindow is how far back CatchUpWindow looks unless told otherwise.
+	DefaultCatchUpWindow = 5 * time.Minute
+)
@@ -0,0 +1,393 @@
+package messagemonitor
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// appleEpoch is the reference date Messages stores dates relative to.
+var appleEpoch = time.Date(2001, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// maxAppleDateSeconds is the largest date that is taken to be in seconds rather than
+// nanoseconds. In seconds it is over 3000 years after the Apple epoch, and in
+// nanoseconds under 2 minutes after it, so the two can't be confused.
+const maxAppleDateSeconds = 100_000_000_000
+
+// chatDBMessagesQuery reads the messages after a ROWID. The sender is the handle the
+// message came from, or for messages without one the identifier of the chat it's in.
+// Filtering is recorded against the chat, so a message is as filtered as its chat.
+//
+// The line a message was received on is its destination caller ID, or for messages
+// without one the account it was received by.
+const chatDBMessagesQuery = `
+SELECT
+	message.ROWID,
+	message.guid,
+	COALESCE(handle.id, chat.chat_identifier),
+	message.service,
+	COALESCE(NULLIF(message.destination_caller_id, ''), message.account),
+	message.attributedBody,
+	message.text,
+	message.date,
+	message.is_from_me,
+	MAX(COALESCE(chat.is_filtered, 0))
+FROM message
+LEFT JOIN handle ON message.handle_id = handle.ROWID
+LEFT JOIN chat_message_join ON chat_message_join.message_id = message.ROWID
+LEFT JOIN chat ON chat.ROWID = chat_message_join.chat_id
+WHERE message.ROWID > ?
+GROUP BY message.ROWID
+ORDER BY message.ROWID ASC;`
+
+// ChatDBSource reads messages from the Messages database on macOS.
+//
+// Messages are read in ROWID order, which unlike the date of a message only ever goes
+// up, even when messages are synced late from another device. The ROWID of the last
+// message handled is kept in a StateFile, so after a restart the source picks up exactly
+// where it left off.
+//
+// The database and its -wal and -shm files are watched, so the monitor is woken as soon
+// as a message arrives rather than having to poll.
+type ChatDBSource struct {
+	db        *sql.DB
+	dbPath    string
+	stateFile *StateFile
+	watcher   *fileWatcher
+	logger    *log.Logger
+	now       func() time.Time
+
+	catchUpPolicy CatchUpPolicy
+	catchUpWindow time.Duration
+
+	// readRowID is the ROWID of the last message returned by Next, and handledRowID the
+	// ROWID of the last message acknowledged by Ack. Both are -1 until the cursor has
+	// been loaded.
+	readRowID    int64
+	handledRowID int64
+}
+
+type ScannedRow struct {
+	RowID          int64
+	GUID           string
+	Sender         sql.NullString
+	Service        sql.NullString
+	ReceivedBy     sql.NullString
+	AttributedBody []byte
+	Text           sql.NullString
+	Date           int64
+	IsFromMe       bool
+	IsFiltered     int64
+}
+
+// NewChatDBSource creates a MessageSource that reads from the Messages database of the
+// current user, at ~/Library/Messages/chat.db. The cursor is persisted to stateFile,
+// which can be nil to start from the newest message every time.
+func NewChatDBSource(stateFile *StateFile) (*ChatDBSource, error) {
+	dirname, err := os.UserHomeDir()
+	if err != nil {
+		return nil, err
+	}
+
+	return NewChatDBSourceAtPath(path.Join(dirname, "Library/Messages/chat.db"), stateFile)
+}
+
+// NewChatDBSourceAtPath creates a MessageSource that reads from the Messages database at
+// dbPath. The cursor is persisted to stateFile, which can be nil to start from the
+// newest message every time.
+func NewChatDBSourceAtPath(dbPath string, stateFile *StateFile) (*ChatDBSource, error) {
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ChatDBSource{
+		db:            db,
+		dbPath:        dbPath,
+		stateFile:     stateFile,
+		logger:        log.Default(),
+		now:           time.Now,
+		catchUpPolicy: DefaultCatchUpPolicy,
+		catchUpWindow: DefaultCatchUpWindow,
+		readRowID:     -1,
+		handledRowID:  -1,
+	}, nil
+}
+
+// SetLogger sets the logger the source logs to. It defaults to the standard logger.
+func (s *ChatDBSource) SetLogger(logger *log.Logger) {
+	s.logger = logger
+}
+
+// SetClock sets the function the source uses to tell the time, which decides which
+// messages are within the catch-up window. It defaults to time.Now.
+func (s *ChatDBSource) SetClock(now func() time.Time) {
+	s.now = now
+}
+
+// SetCatchUpPolicy sets which of the messages that arrived before the source was opened
+// it returns. It defaults to DefaultCatchUpPolicy, and must be set before the source is
+// opened.
+func (s *ChatDBSource) SetCatchUpPolicy(policy CatchUpPolicy) {
+	s.catchUpPolicy = policy
+}
+
+// SetCatchUpWindow sets how far back CatchUpWindow looks for messages. It defaults to
+// DefaultCatchUpWindow, and must be set before the source is opened.
+func (s *ChatDBSource) SetCatchUpWindow(window time.Duration) {
+	s.catchUpWindow = window
+}
+
+func (s *ChatDBSource) Open() error {
+	if err := s.db.Ping(); err != nil {
+		return err
+	}
+
+	if err := s.loadCursor(); err != nil {
+		return err
+	}
+
+	s.startWatcher()
+
+	return nil
+}
+
+func (s *ChatDBSource) Next() ([]*Message, error) {
+	// Open may have failed if we didn't have access to the database yet, so make sure we
+	// know where to start before reading anything.
+	if s.readRowID == -1 {
+		if err := s.loadCursor(); err != nil {
+			return nil, err
+		}
+
+		s.startWatcher()
+	}
+
+	rows, err := s.db.Query(chatDBMessagesQuery, s.readRowID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages := make([]*Message, 0)
+
+	for rows.Next() {
+		scannedRow := &ScannedRow{}
+
+		if err := rows.Scan(&scannedRow.RowID, &scannedRow.GUID, &scannedRow.Sender, &scannedRow.Service, &scannedRow.ReceivedBy, &scannedRow.AttributedBody, &scannedRow.Text, &scannedRow.Date, &scannedRow.IsFromMe, &scannedRow.IsFiltered); err != nil {
+			return nil, err
+		}
+
+		messages = append(messages, scannedRow.message())
+		s.readRowID = scannedRow.RowID
+	}
+
+	return messages, rows.Err()
+}
+
+// Ack records that message has been handled, so it won't be read again after a restart.
+func (s *ChatDBSource) Ack(message *Message) error {
+	if message.cursor <= s.handledRowID {
+		return nil
+	}
+
+	s.handledRowID = message.cursor
+
+	return s.saveCursor()
+}
+
+// Changes returns a channel that is signalled when the database changes, or nil if it
+// isn't being watched.
+func (s *ChatDBSource) Changes() <-chan struct{} {
+	if s.watcher == nil {
+		return nil
+	}
+
+	return s.watcher.Changes()
+}
+
+// Close stops watching the database, saves the cursor one last time and closes the
+// database.
+func (s *ChatDBSource) Close() error {
+	if s.watcher != nil {
+		if err := s.watcher.Close(); err != nil {
+			s.logger.Printf("failed to close database watcher: %v", err)
+		}
+
+		s.watcher = nil
+	}
+
+	var errs []error
+	if s.handledRowID != -1 {
+		if err := s.saveCursor(); err != nil {
+			errs = append(errs, fmt.Errorf("failed to save cursor: %w", err))
+		}
+	}
+	if err := s.db.Close(); err != nil {
+		errs = append(errs, err)
+	}
+
+	return errors.Join(errs...)
+}
+
+// startWatcher starts watching the database for changes. If that fails the monitor just
+// polls instead, so the error is only logged.
+func (s *ChatDBSource) startWatcher() {
+	if s.watcher != nil {
+		return
+	}
+
+	watcher, err := newFileWatcher(s.logger, DefaultDebounceInterval, s.dbPath, s.dbPath+"-wal", s.dbPath+"-shm")
+	if err != nil {
+		s.logger.Printf("failed to watch database, falling back to polling: %v", err)
+		return
+	}
+
+	s.watcher = watcher
+}
+
+// loadCursor works out where to start reading from, which depends on the catch-up
+// policy. Messages at or before the last one handled before a restart are never read
+// again, whatever the policy.
+func (s *ChatDBSource) loadCursor() error {
+	if s.readRowID != -1 {
+		return nil
+	}
+
+	var maxRowID sql.NullInt64
+	if err := s.db.QueryRow("SELECT MAX(ROWID) FROM message;").Scan(&maxRowID); err != nil {
+		return err
+	}
+
+	state := &State{}
+	if s.stateFile != nil {
+		loaded, err := s.stateFile.Load()
+		if err != nil {
+			return err
+		}
+
+		state = loaded
+	}
+
+	savedRowID := state.ChatDBRowID
+	if savedRowID > maxRowID.Int64 {
+		// The database has been replaced, e.g. after setting up a new Mac, so the cursor
+		// no longer means anything.
+		s.logger.Printf("saved cursor is past the newest message, ignoring it saved_row_id:%d row_id:%d", savedRowID, maxRowID.Int64)
+		savedRowID = 0
+	}
+
+	rowID := maxRowID.Int64
+	switch s.catchUpPolicy {
+	case CatchUpSkip:
+	case CatchUpLatest:
+		rowID = max(maxRowID.Int64-1, 0)
+	case CatchUpWindow:
+		windowRowID, err := s.catchUpWindowRowID(maxRowID.Int64)
+		if err != nil {
+			return err
+		}
+
+		rowID = windowRowID
+	default:
+		if savedRowID != 0 {
+			rowID = savedRowID
+		}
+	}
+	rowID = max(rowID, savedRowID)
+
+	s.logger.Printf("starting from cursor policy:%s saved_row_id:%d row_id:%d newest_row_id:%d", s.catchUpPolicy, savedRowID, rowID, maxRowID.Int64)
+
+	s.readRowID = rowID
+	s.handledRowID = rowID
+
+	return s.saveCursor()
+}
+
+// catchUpWindowRowID returns the cursor to start from to read the messages that arrived
+// within the catch-up window, or maxRowID if none did. Only dates in nanoseconds are
+// compared, as messages old enough to have dates in seconds are never in the window.
+func (s *ChatDBSource) catchUpWindowRowID(maxRowID int64) (int64, error) {
+	since := s.now().Add(-s.catchUpWindow)
+
+	var firstRowID sql.NullInt64
+	if err := s.db.QueryRow("SELECT MIN(ROWID) FROM message WHERE date >= ?;", since.Sub(appleEpoch).Nanoseconds()).Scan(&firstRowID); err != nil {
+		return 0, err
+	}
+
+	if !firstRowID.Valid {
+		return maxRowID, nil
+	}
+
+	return firstRowID.Int64 - 1, nil
+}
+
+func (s *ChatDBSource) saveCursor() error {
+	if s.stateFile == nil {
+		return nil
+	}
+
+	return s.stateFile.Save(&State{ChatDBRowID: s.handledRowID})
+}
+
+func (r *ScannedRow) message() *Message {
+	return &Message{
+		ID:             r.GUID,
+		Sender:         r.Sender.String,
+		Service:        r.Service.String,
+		ReceivedBy:     receivingLine(r.ReceivedBy.String),
+		ReceivedAt:     appleDate(r.Date),
+		AttributedBody: r.AttributedBody,
+		Text:           r.Text.String,
+		FromMe:         r.IsFromMe,
+		Filter:         chatFilter(r.IsFiltered),
+		cursor:         r.RowID,
+	}
+}
+
+// appleDate converts a date stored by Messages to a time. Since macOS 10.13 dates are
+// nanoseconds since the Apple epoch, but older messages, and databases migrated from
+// older versions, have dates in seconds. A date of 0 means the date isn't known, and is
+// returned as the zero time.
+func appleDate(date int64) time.Time {
+	switch {
+	case date == 0:
+		return time.Time{}
+	case date > -maxAppleDateSeconds && date < maxAppleDateSeconds:
+		return appleEpoch.Add(time.Duration(date) * time.Second)
+	default:
+		return appleEpoch.Add(time.Duration(date))
+	}
+}
+
+// receivingLine strips the type prefix Messages puts on accounts, e.g. "P:" in
+// "P:+31600000000" or "E:" in "E:someone@example.com", leaving just the handle.
+func receivingLine(account string) string {
+	if len(account) > 2 && account[1] == ':' {
+		switch account[0] {
+		case 'p', 'P', 'e', 'E':
+			return account[2:]
+		}
+	}
+
+	return account
+}
+
+// chatFilter converts the is_filtered column of a chat to a MessageFilter. Chats
+// filtered as from unknown senders are 1, and anything higher has been marked as junk.
+func chatFilter(isFiltered int64) MessageFilter {
+	switch {
+	case isFiltered <= 0:
+		return MessageFilterNone
+	case isFiltered == 1:
+		return MessageFilterUnknownSender
+	default:
+		return MessageFilterJunk
+	}
+}
@@ -0,0 +1,409 @@
+package messagemonitor
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// chatDBSchema is the part of the chat.db schema ChatDBSource reads.
+const chatDBSchema = `
+CREATE TABLE handle (ROWID INTEGER PRIMARY KEY AUTOINCREMENT, id TEXT NOT NULL);
+CREATE TABLE message (
+	ROWID INTEGER PRIMARY KEY AUTOINCREMENT,
+	guid TEXT UNIQUE NOT NULL,
+	text TEXT,
+	handle_id INTEGER DEFAULT 0,
+	service TEXT,
+	date INTEGER,
+	attributedBody BLOB,
+	is_from_me INTEGER DEFAULT 0,
+	account TEXT,
+	destination_caller_id TEXT
+);
+CREATE TABLE chat (ROWID INTEGER PRIMARY KEY AUTOINCREMENT, chat_identifier TEXT, is_filtered INTEGER DEFAULT 0);
+CREATE TABLE chat_message_join (chat_id INTEGER, message_id INTEGER, PRIMARY KEY (chat_id, message_id));
+`
+
+func newTestChatDB(t *testing.T) (*sql.DB, string) {
+	t.Helper()
+
+	dbPath := filepath.Join(t.TempDir(), "chat.db")
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatalf("opening database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	if _, err := db.Exec(chatDBSchema); err != nil {
+		t.Fatalf("creating schema: %v", err)
+	}
+	if _, err := db.Exec(`INSERT INTO handle (id) VALUES ('+31600000000')`); err != nil {
+		t.Fatalf("inserting handle: %v", err)
+	}
+
+	return db, dbPath
+}
+
+func insertTestMessage(t *testing.T, db *sql.DB, guid, service, text string, date int64) {
+	t.Helper()
+
+	if _, err := db.Exec(`INSERT INTO message (guid, text, handle_id, service, date) VALUES (?, ?, 1, ?, ?)`, guid, text, service, date); err != nil {
+		t.Fatalf("inserting message: %v", err)
+	}
+}
+
+func TestChatDBSource(t *testing.T) {
+	db, dbPath := newTestChatDB(t)
+
+	// 2024-05-01T12:00:00Z, in nanoseconds since the Apple epoch.
+	date := time.Date(2024, time.May, 1, 12, 0, 0, 0, time.UTC).Sub(appleEpoch).Nanoseconds()
+
+	insertTestMessage(t, db, "old", ServiceSMS, "Your code is 1111", date-2)
+	insertTestMessage(t, db, "latest", ServiceSMS, "Your code is 2222", date-1)
+
+	source, err := NewChatDBSourceAtPath(dbPath, nil)
+	if err != nil {
+		t.Fatalf("creating source: %v", err)
+	}
+	defer source.Close()
+
+	assert.NoError(t, source.Open())
+
+	// Messages that arrived before the first start are never read.
+	messages, err := source.Next()
+	assert.NoError(t, err)
+	assert.Empty(t, messages)
+
+	insertTestMessage(t, db, "new", ServiceSMS, "Your code is 3333", date)
+
+	messages, err = source.Next()
+	if assert.NoError(t, err) && assert.Len(t, messages, 1) {
+		assert.Equal(t, &Message{
+			ID:         "new",
+			Sender:     "+31600000000",
+			Service:    ServiceSMS,
+			ReceivedAt: time.Date(2024, time.May, 1, 12, 0, 0, 0, time.UTC),
+			Text:       "Your code is 3333",
+			cursor:     3,
+		}, messages[0])
+	}
+
+	// Every service is read, it's up to the monitor to ignore the ones it doesn't want.
+	// Messages are read in the order they were inserted, even when synced late with an
+	// older date.
+	insertTestMessage(t, db, "imessage", ServiceIMessage, "Your code is 4444", date+1)
+	insertTestMessage(t, db, "rcs", ServiceRCS, "Your code is 5555", date-100)
+
+	messages, err = source.Next()
+	if assert.NoError(t, err) && assert.Len(t, messages, 2) {
+		assert.Equal(t, "imessage", messages[0].ID)
+		assert.Equal(t, ServiceIMessage, messages[0].Service)
+		assert.Equal(t, "rcs", messages[1].ID)
+		assert.Equal(t, ServiceRCS, messages[1].Service)
+	}
+
+	messages, err = source.Next()
+	assert.NoError(t, err)
+	assert.Empty(t, messages)
+}
+
+func TestChatDBSourceResumesAfterRestart(t *testing.T) {
+	db, dbPath := newTestChatDB(t)
+	stateFile := NewStateFile(filepath.Join(t.TempDir(), "state", "state.json"))
+
+	insertTestMessage(t, db, "before", ServiceSMS, "Your code is 1111", 1)
+
+	source, err := NewChatDBSourceAtPath(dbPath, stateFile)
+	if err != nil {
+		t.Fatalf("creating source: %v", err)
+	}
+	assert.NoError(t, source.Open())
+
+	insertTestMessage(t, db, "handled", ServiceSMS, "Your code is 2222", 2)
+	insertTestMessage(t, db, "unhandled", ServiceSMS, "Your code is 3333", 3)
+
+	messages, err := source.Next()
+	if assert.NoError(t, err) && assert.Len(t, messages, 2) {
+		// Only the first message is handled before the restart.
+		assert.NoError(t, source.Ack(messages[0]))
+	}
+	source.Close()
+
+	state, err := stateFile.Load()
+	assert.NoError(t, err)
+	assert.Equal(t, &State{ChatDBRowID: 2}, state)
+
+	insertTestMessage(t, db, "while stopped", ServiceSMS, "Your code is 4444", 4)
+
+	restarted, err := NewChatDBSourceAtPath(dbPath, stateFile)
+	if err != nil {
+		t.Fatalf("creating source: %v", err)
+	}
+	defer restarted.Close()
+	assert.NoError(t, restarted.Open())
+
+	messages, err = restarted.Next()
+	if assert.NoError(t, err) && assert.Len(t, messages, 2) {
+		assert.Equal(t, "unhandled", messages[0].ID)
+		assert.Equal(t, "while stopped", messages[1].ID)
+	}
+}
+
+func TestChatDBSourceResetsCursorPastNewestMessage(t *testing.T) {
+	db, dbPath := newTestChatDB(t)
+	stateFile := NewStateFile(filepath.Join(t.TempDir(), "state.json"))
+	assert.NoError(t, stateFile.Save(&State{ChatDBRowID: 100}))
+
+	insertTestMessage(t, db, "existing", ServiceSMS, "Your code is 1111", 1)
+
+	source, err := NewChatDBSourceAtPath(dbPath, stateFile)
+	if err != nil {
+		t.Fatalf("creating source: %v", err)
+	}
+	defer source.Close()
+	assert.NoError(t, source.Open())
+
+	insertTestMessage(t, db, "new", ServiceSMS, "Your code is 2222", 2)
+
+	messages, err := source.Next()
+	if assert.NoError(t, err) && assert.Len(t, messages, 1) {
+		assert.Equal(t, "new", messages[0].ID)
+	}
+}
+
+func TestChatDBSourceWithoutAccess(t *testing.T) {
+	source, err := NewChatDBSourceAtPath(filepath.Join(t.TempDir(), "missing", "chat.db"), nil)
+	if err != nil {
+		t.Fatalf("creating source: %v", err)
+	}
+	defer source.Close()
+
+	assert.Error(t, source.Open())
+
+	_, err = source.Next()
+	assert.Error(t, err)
+}
+
+func TestChatDBSourceSenderFromChat(t *testing.T) {
+	db, dbPath := newTestChatDB(t)
+
+	source, err := NewChatDBSourceAtPath(dbPath, nil)
+	if err != nil {
+		t.Fatalf("creating source: %v", err)
+	}
+	defer source.Close()
+	assert.NoError(t, source.Open())
+
+	// Messages without a handle take their sender from the chat they're in.
+	statements := []string{
+		`INSERT INTO chat (chat_identifier) VALUES ('Rabobank')`,
+		`INSERT INTO message (guid, text, handle_id, service, date) VALUES ('no-handle', 'Your code is 1234', 0, 'SMS', 1)`,
+		`INSERT INTO chat_message_join (chat_id, message_id) VALUES (1, 1)`,
+	}
+	for _, statement := range statements {
+		if _, err := db.Exec(statement); err != nil {
+			t.Fatalf("inserting message: %v", err)
+		}
+	}
+
+	messages, err := source.Next()
+	if assert.NoError(t, err) && assert.Len(t, messages, 1) {
+		assert.Equal(t, "Rabobank", messages[0].Sender)
+	}
+}
+
+func TestChatDBSourceOutgoingAndFiltered(t *testing.T) {
+	db, dbPath := newTestChatDB(t)
+
+	source, err := NewChatDBSourceAtPath(dbPath, nil)
+	if err != nil {
+		t.Fatalf("creating source: %v", err)
+	}
+	defer source.Close()
+	assert.NoError(t, source.Open())
+
+	statements := []string{
+		`INSERT INTO chat (chat_identifier, is_filtered) VALUES ('+31600000000', 0), ('4664', 1), ('+15550100', 2)`,
+		`INSERT INTO message (guid, text, handle_id, service, date, is_from_me) VALUES ('sent', 'My code is 1234', 1, 'SMS', 1, 1)`,
+		`INSERT INTO message (guid, text, handle_id, service, date) VALUES ('unknown', 'Your code is 2345', 0, 'SMS', 2)`,
+		`INSERT INTO message (guid, text, handle_id, service, date) VALUES ('junk', 'You won 3456 dollars', 0, 'SMS', 3)`,
+		`INSERT INTO chat_message_join (chat_id, message_id) VALUES (1, 1), (2, 2), (3, 3)`,
+	}
+	for _, statement := range statements {
+		if _, err := db.Exec(statement); err != nil {
+			t.Fatalf("inserting message: %v", err)
+		}
+	}
+
+	// Every message is read, it's up to the monitor to ignore the ones it doesn't want.
+	messages, err := source.Next()
+	if assert.NoError(t, err) && assert.Len(t, messages, 3) {
+		assert.True(t, messages[0].FromMe)
+		assert.Equal(t, MessageFilterNone, messages[0].Filter)
+
+		assert.False(t, messages[1].FromMe)
+		assert.Equal(t, "4664", messages[1].Sender)
+		assert.Equal(t, MessageFilterUnknownSender, messages[1].Filter)
+
+		assert.Equal(t, MessageFilterJunk, messages[2].Filter)
+	}
+}
+
+func TestChatDBSourceReceivingLine(t *testing.T) {
+	db, dbPath := newTestChatDB(t)
+
+	source, err := NewChatDBSourceAtPath(dbPath, nil)
+	if err != nil {
+		t.Fatalf("creating source: %v", err)
+	}
+	defer source.Close()
+	assert.NoError(t, source.Open())
+
+	statements := []string{
+		`INSERT INTO message (guid, text, handle_id, service, date, account, destination_caller_id) VALUES ('caller-id', 'Your code is 1234', 1, 'SMS', 1, 'P:+31600000000', '+31611111111')`,
+		`INSERT INTO message (guid, text, handle_id, service, date, account, destination_caller_id) VALUES ('phone-account', 'Your code is 2345', 1, 'SMS', 2, 'P:+31600000000', '')`,
+		`INSERT INTO message (guid, text, handle_id, service, date, account) VALUES ('email-account', 'Your code is 3456', 1, 'iMessage', 3, 'E:someone@example.com')`,
+		`INSERT INTO message (guid, text, handle_id, service, date) VALUES ('unknown', 'Your code is 4567', 1, 'SMS', 4)`,
+	}
+	for _, statement := range statements {
+		if _, err := db.Exec(statement); err != nil {
+			t.Fatalf("inserting message: %v", err)
+		}
+	}
+
+	messages, err := source.Next()
+	if assert.NoError(t, err) && assert.Len(t, messages, 4) {
+		assert.Equal(t, "+31611111111", messages[0].ReceivedBy)
+		assert.Equal(t, "+31600000000", messages[1].ReceivedBy)
+		assert.Equal(t, "someone@example.com", messages[2].ReceivedBy)
+		assert.Equal(t, "", messages[3].ReceivedBy)
+	}
+}
+
+func TestAppleDate(t *testing.T) {
+	tests := []struct {
+		name string
+		date int64
+		want time.Time
+	}{
+		{
+			name: "Unknown",
+			date: 0,
+			want: time.Time{},
+		},
+		{
+			name: "Nanoseconds",
+			date: 736257600000000000,
+			want: time.Date(2024, time.May, 1, 12, 0, 0, 0, time.UTC),
+		},
+		{
+			name: "Seconds",
+			date: 482414400,
+			want: time.Date(2016, time.April, 15, 12, 0, 0, 0, time.UTC),
+		},
+		{
+			name: "Before the epoch",
+			date: -31622400,
+			want: time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, appleDate(tt.date))
+		})
+	}
+}
+
+func TestChatDBSourceCatchUp(t *testing.T) {
+	now := time.Now()
+	ago := func(d time.Duration) int64 {
+		return now.Add(-d).Sub(appleEpoch).Nanoseconds()
+	}
+
+	tests := []struct {
+		name     string
+		policy   CatchUpPolicy
+		savedRow int64
+		want     []string
+	}{
+		{
+			name:   "Resume without a saved cursor",
+			policy: CatchUpResume,
+			want:   []string{},
+		},
+		{
+			name:     "Resume from a saved cursor",
+			policy:   CatchUpResume,
+			savedRow: 1,
+			want:     []string{"hour", "recent", "latest"},
+		},
+		{
+			name:     "Skip",
+			policy:   CatchUpSkip,
+			savedRow: 1,
+			want:     []string{},
+		},
+		{
+			name:   "Window",
+			policy: CatchUpWindow,
+			want:   []string{"recent", "latest"},
+		},
+		{
+			name:     "Window after a saved cursor",
+			policy:   CatchUpWindow,
+			savedRow: 3,
+			want:     []string{"latest"},
+		},
+		{
+			name:   "Latest",
+			policy: CatchUpLatest,
+			want:   []string{"latest"},
+		},
+		{
+			name:     "Latest already handled",
+			policy:   CatchUpLatest,
+			savedRow: 4,
+			want:     []string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, dbPath := newTestChatDB(t)
+			stateFile := NewStateFile(filepath.Join(t.TempDir(), "state.json"))
+			if tt.savedRow != 0 {
+				assert.NoError(t, stateFile.Save(&State{ChatDBRowID: tt.savedRow}))
+			}
+
+			insertTestMessage(t, db, "yesterday", ServiceSMS, "Your code is 1111", ago(24*time.Hour))
+			insertTestMessage(t, db, "hour", ServiceSMS, "Your code is 2222", ago(time.Hour))
+			insertTestMessage(t, db, "recent", ServiceSMS, "Your code is 3333", ago(2*time.Minute))
+			insertTestMessage(t, db, "latest", ServiceSMS, "Your code is 4444", ago(time.Minute))
+
+			source, err := NewChatDBSourceAtPath(dbPath, stateFile)
+			if err != nil {
+				t.Fatalf("creating source: %v", err)
+			}
+			defer source.Close()
+
+			source.SetCatchUpPolicy(tt.policy)
+			source.SetCatchUpWindow(5 * time.Minute)
+			assert.NoError(t, source.Open())
+
+			messages, err := source.Next()
+			if assert.NoError(t, err) {
+				ids := make([]string, 0, len(messages))
+				for _, message := range messages {
+					ids = append(ids, message.ID)
+				}
+
+				assert.Equal(t, tt.want, ids)
+			}
+		})
+	}
+}
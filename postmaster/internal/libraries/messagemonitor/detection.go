@@ -0,0 +1,70 @@
+package messagemonitor
+
+import (
+	"time"
+
+	"github.com/0xdeafcafe/pillar-box/server/internal/utilities/codeextractor"
+)
+
+// Sources a detected code can come from, reported in Detection.CodeSource.
+const (
+	// CodeSourceMessages is used when the code was recognised by Messages itself.
+	CodeSourceMessages = "messages"
+
+	// CodeSourceScorer is used when the code was found by codeextractor's scorer.
+	CodeSourceScorer = "scorer"
+
+	// CodeSourceMock is used for codes made up by SendMockMessage.
+	CodeSourceMock = "mock"
+)
+
+// Detection is a code found in a message, along with everything we know about the
+// message it was found in. It is what the monitor hands to every detection handler.
+type Detection struct {
+	// Code is the code that was chosen from the message.
+	Code string
+
+	// Candidates are all the codes found in the message, best first, so Candidates[0]
+	// is the one Code came from.
+	Candidates []codeextractor.Candidate
+
+	// CodeSource says how the code was found, e.g. CodeSourceScorer.
+	CodeSource string
+
+	// Issuer is the service that sent the code, e.g. "Uber", or empty if unknown.
+	Issuer string
+
+	// TopLevelDomain is set when the message bound the code to a website, and is the
+	// domain of the site the code may only be used on. EmbeddedDomain is also set when
+	// the code is for a site embedded within it in an iframe, and is that site's domain.
+	TopLevelDomain string
+	EmbeddedDomain string
+
+	// ExpiresAt is when the code stops being valid, counted from when the message was
+	// received. The TTL comes from the message if it said, otherwise the monitor's default
+	// code TTL is used, and ExpiryStated is false.
+	ExpiresAt    time.Time
+	ExpiryStated bool
+
+	// DetectedAt is when the monitor found the code.
+	DetectedAt time.Time
+
+	// MessageID is the ID of the message within its source, e.g. the GUID in chat.db.
+	MessageID string
+
+	// Sender is who the message came from, or empty if unknown.
+	Sender string
+
+	// Service is the service the message was received over, e.g. ServiceSMS.
+	Service string
+
+	// ReceivedBy is the phone number or email address of the line the message was
+	// received on, or empty if unknown.
+	ReceivedBy string
+
+	// ReceivedAt is when the message was received.
+	ReceivedAt time.Time
+
+	// Text is the full text of the message.
+	Text string
+}
@@ -0,0 +1,36 @@
+package messagemonitor
+
+// FilteredMessagePolicy decides which of the messages Messages filtered out of the main
+// list of conversations codes are still extracted from.
+type FilteredMessagePolicy string
+
+const (
+	// FilteredMessagePolicyAllow extracts codes from every message, however Messages
+	// filtered it.
+	FilteredMessagePolicyAllow FilteredMessagePolicy = "allow"
+
+	// FilteredMessagePolicyIgnoreJunk ignores messages Messages marked as junk, but still
+	// extracts codes from messages from unknown senders, which is where most codes come
+	// from. It is the default.
+	FilteredMessagePolicyIgnoreJunk FilteredMessagePolicy = "ignore_junk"
+
+	// FilteredMessagePolicyIgnoreFiltered ignores every message Messages filtered,
+	// including those from unknown senders, so only codes from contacts are extracted.
+	FilteredMessagePolicyIgnoreFiltered FilteredMessagePolicy = "ignore_filtered"
+)
+
+// DefaultFilteredMessagePolicy is the policy the monitor uses unless told otherwise.
+const DefaultFilteredMessagePolicy = FilteredMessagePolicyIgnoreJunk
+
+// allows reports whether codes should be extracted from a message Messages filtered with
+// filter. Unknown policies are treated as the default.
+func (p FilteredMessagePolicy) allows(filter MessageFilter) bool {
+	switch p {
+	case FilteredMessagePolicyAllow:
+		return true
+	case FilteredMessagePolicyIgnoreFiltered:
+		return filter == MessageFilterNone
+	default:
+		return filter != MessageFilterJunk
+	}
+}
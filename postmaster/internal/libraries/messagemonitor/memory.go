@@ -0,0 +1,80 @@
+package messagemonitor
+
+import (
+	"io"
+	"sync"
+)
+
+// MemorySource is a MessageSource that yields messages pushed to it, for tests and for
+// driving the monitor from other code.
+type MemorySource struct {
+	mutex    sync.Mutex
+	messages []*Message
+	closed   bool
+	changes  chan struct{}
+}
+
+// NewMemorySource creates a MemorySource that will first yield messages.
+func NewMemorySource(messages ...*Message) *MemorySource {
+	return &MemorySource{
+		messages: append(make([]*Message, 0, len(messages)), messages...),
+		changes:  make(chan struct{}, 1),
+	}
+}
+
+// Push queues messages to be returned by the next call to Next.
+func (s *MemorySource) Push(messages ...*Message) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.messages = append(s.messages, messages...)
+	s.notify()
+}
+
+func (s *MemorySource) Open() error {
+	return nil
+}
+
+func (s *MemorySource) Next() ([]*Message, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if len(s.messages) == 0 && s.closed {
+		return nil, io.EOF
+	}
+
+	messages := s.messages
+	s.messages = make([]*Message, 0)
+
+	return messages, nil
+}
+
+// Ack does nothing, as a MemorySource doesn't remember its position.
+func (s *MemorySource) Ack(message *Message) error {
+	return nil
+}
+
+// Close stops the source. Messages already pushed are still returned, after which Next
+// returns io.EOF.
+func (s *MemorySource) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.closed = true
+	s.notify()
+
+	return nil
+}
+
+// Changes returns a channel that is signalled whenever messages are pushed, or the
+// source is closed.
+func (s *MemorySource) Changes() <-chan struct{} {
+	return s.changes
+}
+
+func (s *MemorySource) notify() {
+	select {
+	case s.changes <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,34 @@
+package messagemonitor
+
+import (
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemorySource(t *testing.T) {
+	first := &Message{ID: "1", Text: "Your code is 1234"}
+	second := &Message{ID: "2", Text: "Your code is 5678"}
+
+	source := NewMemorySource(first)
+	assert.NoError(t, source.Open())
+
+	messages, err := source.Next()
+	assert.NoError(t, err)
+	assert.Equal(t, []*Message{first}, messages)
+
+	messages, err = source.Next()
+	assert.NoError(t, err)
+	assert.Empty(t, messages)
+
+	source.Push(second)
+	assert.NoError(t, source.Close())
+
+	messages, err = source.Next()
+	assert.NoError(t, err)
+	assert.Equal(t, []*Message{second}, messages)
+
+	_, err = source.Next()
+	assert.ErrorIs(t, err, io.EOF)
+}
@@ -1,58 +1,80 @@
 package messagemonitor
 
 import (
-	"database/sql"
+	"context"
+	"errors"
+	"io"
 	"log"
-	"os"
-	"path"
+	"sort"
 	"time"
 
-	_ "github.com/mattn/go-sqlite3"
 	"golang.org/x/exp/rand"
 
 	"github.com/0xdeafcafe/pillar-box/server/internal/utilities/codeextractor"
 	"github.com/0xdeafcafe/pillar-box/server/internal/utilities/streamtyped"
 )
 
+const (
+	// DefaultCodeTTL is how long a code is considered valid for when the message it came
+	// in doesn't say.
+	DefaultCodeTTL = 10 * time.Minute
+
+	// DefaultMaxMessageAge is how old a message can be before the monitor ignores it. A
+	// message older than the default code TTL almost certainly has an expired code.
+	DefaultMaxMessageAge = DefaultCodeTTL
+
+	// DefaultPollInterval is how long the monitor waits before asking its source for new
+	// messages again, after the source had none.
+	DefaultPollInterval = 1 * time.Second
+)
+
 type MessageMonitor struct {
-	db *sql.DB
+	source MessageSource
+	logger *log.Logger
+	now    func() time.Time
+
+	defaultCodeTTL     time.Duration
+	maxMessageAge      time.Duration
+	pollInterval       time.Duration
+	safetyPollInterval time.Duration
+	services           map[string]bool
+	senderRules        *SenderRules
+	receivingLines     map[string]bool
+	includeOutgoing    bool
+	filteredPolicy     FilteredMessagePolicy
+
+	metrics metrics
 
 	registeredDetectionHandlers []DetectionHandlerFunc
 	registeredNoAccessHandler   NoAccessHandlerFunc
-
-	latestKnownRecordTimestamp int
 }
 
-type DetectionHandlerFunc func(mfaCode string)
+type DetectionHandlerFunc func(detection *Detection)
 type NoAccessHandlerFunc func()
 
-type ScannedRow struct {
-	GUID           string
-	AttributedBody []byte
-	Date           int
-}
+var (
+	ErrNoMessageBody = errors.New("message has no readable body")
+)
 
 // New creates a new MessageMonitor instance. The MessageMonitor is responsible for
-// monitoring the iMessage database for new messages and extracting MFA codes from them.
-// When a new MFA code is detected, the MessageMonitor will call the provided
-// HandleMessageDetectionFunc with the detected MFA code.
-func New() (*MessageMonitor, error) {
-	dirname, err := os.UserHomeDir()
-	if err != nil {
-		return nil, err
-	}
-
-	dbPath := path.Join(dirname, "Library/Messages/chat.db")
-	db, err := sql.Open("sqlite3", dbPath)
-	if err != nil {
-		return nil, err
+// monitoring a MessageSource, usually the iMessage database, for new messages and
+// extracting MFA codes from them. When a new MFA code is detected, the MessageMonitor will
+// call the provided HandleMessageDetectionFunc with the detected MFA code.
+func New(source MessageSource) *MessageMonitor {
+	m := &MessageMonitor{
+		source:                      source,
+		logger:                      log.Default(),
+		now:                         time.Now,
+		defaultCodeTTL:              DefaultCodeTTL,
+		maxMessageAge:               DefaultMaxMessageAge,
+		pollInterval:                DefaultPollInterval,
+		safetyPollInterval:          DefaultSafetyPollInterval,
+		filteredPolicy:              DefaultFilteredMessagePolicy,
+		registeredDetectionHandlers: make([]DetectionHandlerFunc, 0),
 	}
+	m.SetServices(AllServices...)
 
-	return &MessageMonitor{
-		db:                          db,
-		latestKnownRecordTimestamp:  0,
-		registeredDetectionHandlers: make([]DetectionHandlerFunc, 0),
-	}, nil
+	return m
 }
 
 func (m *MessageMonitor) RegisterDetectionHandler(handleMessageDetection DetectionHandlerFunc) {
@@ -63,93 +85,390 @@ func (m *MessageMonitor) RegisterNoAccessHandler(handleNoAccess NoAccessHandlerF
 	m.registeredNoAccessHandler = handleNoAccess
 }
 
+// SetLogger sets the logger the monitor logs to. It defaults to the standard logger.
+func (m *MessageMonitor) SetLogger(logger *log.Logger) {
+	m.logger = logger
+}
+
+// SetClock sets the function the monitor uses to tell the time, which decides when codes
+// expire and how old messages are. It defaults to time.Now.
+func (m *MessageMonitor) SetClock(now func() time.Time) {
+	m.now = now
+}
+
+// SetDefaultCodeTTL sets how long a code is considered valid for when the message it
+// came in doesn't state an expiry. It defaults to DefaultCodeTTL.
+func (m *MessageMonitor) SetDefaultCodeTTL(ttl time.Duration) {
+	m.defaultCodeTTL = ttl
+}
+
+// SetMaxMessageAge sets how long ago a message can have been received before the monitor
+// ignores it, so codes from messages that arrived while it wasn't running, or that were
+// synced late from another device, aren't dispatched long after they were useful. An age
+// of 0 turns the check off. It defaults to DefaultMaxMessageAge.
+func (m *MessageMonitor) SetMaxMessageAge(age time.Duration) {
+	m.maxMessageAge = age
+}
+
 func (m *MessageMonitor) SendMockMessage() {
-	m.dispatchMFACode(generateMockMFACode())
+	code := generateMockMFACode()
+	now := m.now()
+
+	m.dispatch(&Detection{
+		Code:       code,
+		Candidates: []codeextractor.Candidate{{Code: code, Raw: code, Confidence: 1}},
+		CodeSource: CodeSourceMock,
+		ExpiresAt:  now.Add(m.defaultCodeTTL),
+		DetectedAt: now,
+		MessageID:  "mock",
+		Service:    ServiceSMS,
+		ReceivedAt: now,
+		Text:       code,
+	})
+}
+
+// SetServices sets which services, e.g. ServiceSMS, messages are monitored from. Messages
+// received over any other service are ignored. It defaults to AllServices.
+func (m *MessageMonitor) SetServices(services ...string) {
+	m.services = make(map[string]bool, len(services))
+	for _, service := range services {
+		m.services[normaliseService(service)] = true
+	}
 }
 
-func (m *MessageMonitor) ListenAndHandle() {
-	if err := m.ensureDatabaseAccess(); err != nil {
-		log.Printf("failed to access database: %v", err)
+// SetSenderRules sets the rules deciding which senders codes are extracted from. Messages
+// from senders the rules filter out are ignored. By default every sender is allowed.
+func (m *MessageMonitor) SetSenderRules(rules *SenderRules) {
+	m.senderRules = rules
+}
+
+// SetReceivingLines limits the monitor to messages received on the given lines, the phone
+// numbers or email addresses messages are sent to, e.g. one SIM of a dual-SIM phone.
+// Messages received on any other line, or on a line the source doesn't know, are
+// ignored. Calling it with no lines monitors every line, which is the default.
+func (m *MessageMonitor) SetReceivingLines(lines ...string) {
+	if len(lines) == 0 {
+		m.receivingLines = nil
+		return
+	}
+
+	m.receivingLines = make(map[string]bool, len(lines))
+	for _, line := range lines {
+		m.receivingLines[normaliseHandle(line)] = true
+	}
+}
+
+// SetIncludeOutgoing sets whether codes are extracted from messages the user sent, as
+// well as those they received. Outgoing messages are ignored by default, so codes the
+// user types or forwards to someone else aren't picked up.
+func (m *MessageMonitor) SetIncludeOutgoing(include bool) {
+	m.includeOutgoing = include
+}
+
+// SetFilteredMessagePolicy sets which messages Messages filtered as junk or from unknown
+// senders codes are still extracted from. It defaults to DefaultFilteredMessagePolicy.
+func (m *MessageMonitor) SetFilteredMessagePolicy(policy FilteredMessagePolicy) {
+	m.filteredPolicy = policy
+}
+
+// SetPollInterval sets how long the monitor waits before asking its source for new
+// messages again, after the source had none. It defaults to DefaultPollInterval.
+//
+// Sources that say when they have new messages, see NotifyingSource, are only polled
+// every safety poll interval instead.
+func (m *MessageMonitor) SetPollInterval(interval time.Duration) {
+	m.pollInterval = interval
+}
+
+// SetSafetyPollInterval sets how often a NotifyingSource is asked for new messages even
+// though it hasn't said there are any, in case a change was missed. It defaults to
+// DefaultSafetyPollInterval.
+func (m *MessageMonitor) SetSafetyPollInterval(interval time.Duration) {
+	m.safetyPollInterval = interval
+}
+
+// ListenAndHandle opens the source, reads messages from it and dispatches any codes
+// found in them, until ctx is done or the source runs out of messages. The source is
+// closed before it returns, and the error closing it returned.
+//
+// Messages read but not yet handled when ctx is done aren't acknowledged, so sources
+// that remember their position read them again next time.
+func (m *MessageMonitor) ListenAndHandle(ctx context.Context) error {
+	if err := m.source.Open(); err != nil {
+		m.logger.Printf("failed to access message source: %v", err)
 
 		if m.registeredNoAccessHandler != nil {
 			m.registeredNoAccessHandler()
 		}
 
-		time.Sleep(5 * time.Second)
+		sleepContext(ctx, 5*time.Second)
 	}
 
-	for {
-		var rows *sql.Rows
-		var err error
-
-		if m.latestKnownRecordTimestamp != 0 {
-			rows, err = m.db.Query("SELECT guid, attributedBody, date FROM message WHERE service = 'SMS' AND date > ? ORDER BY date ASC;", m.latestKnownRecordTimestamp)
-		} else {
-			rows, err = m.db.Query("SELECT guid, attributedBody, date FROM message WHERE service = 'SMS' ORDER BY date DESC LIMIT 1;")
+	for ctx.Err() == nil {
+		messages, err := m.source.Next()
+		if err == io.EOF {
+			m.logger.Printf("message source has no more messages")
+			break
 		}
-
 		if err != nil {
-			log.Printf("failed to query database: %v", err)
-			time.Sleep(5 * time.Second)
+			m.logger.Printf("failed to read messages from source: %v", err)
+			sleepContext(ctx, 5*time.Second)
 
 			continue
 		}
 
-		scannedRows := make([]*ScannedRow, 0)
+		for _, message := range messages {
+			if ctx.Err() != nil {
+				break
+			}
 
-		for rows.Next() {
-			scannedRow := &ScannedRow{}
+			m.handleMessage(message)
 
-			if err := rows.Scan(&scannedRow.GUID, &scannedRow.AttributedBody, &scannedRow.Date); err != nil {
-				log.Printf("failed to scan row: %v", err)
-				time.Sleep(5 * time.Second)
-				continue
+			if err := m.source.Ack(message); err != nil {
+				m.logger.Printf("failed to record message as handled: %v id:%s", err, message.ID)
 			}
+		}
 
-			scannedRows = append(scannedRows, scannedRow)
+		if len(messages) == 0 {
+			m.waitForMessages(ctx)
 		}
+	}
 
-		for _, row := range scannedRows {
-			message, err := streamtyped.ExtractMessageFromStreamTypedBuffer(row.AttributedBody)
-			if err != nil {
-				log.Printf("failed to extract message from streamtyped buffer: %v", err)
-				continue
-			}
+	m.logger.Printf("closing message source")
 
-			codes, err := codeextractor.ExtractCodes(*message)
-			if err != nil {
-				m.latestKnownRecordTimestamp = row.Date
-				if err == codeextractor.ErrNoCodesFound {
-					log.Printf("no codes found in message: %v", err)
-				} else {
-					log.Printf("failed to extract mfa code from message: %v message: %s", err, *message)
-				}
+	return m.source.Close()
+}
 
-				continue
-			}
+// waitForMessages waits until the source may have new messages, or ctx is done. Sources
+// that say when they have changed are waited on, with a slow safety poll in case a change
+// was missed, and everything else is polled.
+func (m *MessageMonitor) waitForMessages(ctx context.Context) {
+	var changes <-chan struct{}
+	if notifier, ok := m.source.(NotifyingSource); ok {
+		changes = notifier.Changes()
+	}
+
+	if changes == nil {
+		sleepContext(ctx, m.pollInterval)
+		return
+	}
+
+	safetyPoll := time.NewTimer(m.safetyPollInterval)
+	defer safetyPoll.Stop()
 
-			log.Printf("discovered mfa codes: %v", codes)
+	select {
+	case <-ctx.Done():
+	case <-changes:
+	case <-safetyPoll.C:
+	}
+}
 
-			m.latestKnownRecordTimestamp = row.Date
-			m.dispatchMFACode(codes[0])
+// sleepContext sleeps for d, or until ctx is done if that's sooner.
+func sleepContext(ctx context.Context, d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+}
+
+// handleMessage extracts the code from a message, if it has one, and dispatches it.
+func (m *MessageMonitor) handleMessage(message *Message) {
+	if message.FromMe && !m.includeOutgoing {
+		m.logger.Printf("ignoring outgoing message id:%s", message.ID)
+		return
+	}
+
+	service := normaliseService(message.Service)
+	if !m.services[service] {
+		m.logger.Printf("ignoring message from unmonitored service id:%s service:%s", message.ID, message.Service)
+		return
+	}
+
+	// Messages whose date isn't known are given the benefit of the doubt.
+	if age := m.now().Sub(message.ReceivedAt); m.maxMessageAge > 0 && !message.ReceivedAt.IsZero() && age > m.maxMessageAge {
+		m.logger.Printf("ignoring old message id:%s received_at:%s age:%s", message.ID, message.ReceivedAt.Format(time.RFC3339), age.Round(time.Second))
+		return
+	}
+
+	if m.receivingLines != nil && !m.receivingLines[normaliseHandle(message.ReceivedBy)] {
+		m.logger.Printf("ignoring message received on unmonitored line id:%s line:%s", message.ID, message.ReceivedBy)
+		return
+	}
+
+	if !m.filteredPolicy.allows(message.Filter) {
+		m.logger.Printf("ignoring message filtered by messages id:%s filter:%s policy:%s", message.ID, message.Filter, m.filteredPolicy)
+		return
+	}
+
+	if allowed, reason := m.senderRules.Allows(message.Sender); !allowed {
+		m.logger.Printf("ignoring message from filtered sender id:%s sender:%s reason:%s", message.ID, message.Sender, reason)
+		return
+	}
+
+	body, err := m.messageBody(message)
+	if err != nil {
+		m.logger.Printf("failed to read message body: %v id:%s", err, message.ID)
+		return
+	}
+
+	candidates, codeSource, err := candidatesForMessage(body)
+	if err != nil {
+		if err == codeextractor.ErrNoCodesFound {
+			m.logger.Printf("no codes found in message: %v", err)
+		} else {
+			m.logger.Printf("failed to extract mfa code from message: %v message: %s", err, body.Text)
 		}
 
-		time.Sleep(1 * time.Second)
+		return
+	}
+
+	best := candidates[0]
+	ttl := best.Expiry
+	if ttl == 0 {
+		ttl = m.defaultCodeTTL
+	}
+
+	// A code is valid from when its message arrived, not from when it was read, so one
+	// read late, e.g. while catching up, isn't given longer than it has.
+	now := m.now()
+	issuedAt := message.ReceivedAt
+	if issuedAt.IsZero() {
+		issuedAt = now
+	}
+
+	expiresAt := issuedAt.Add(ttl)
+	if !expiresAt.After(now) {
+		m.logger.Printf("ignoring expired code id:%s received_at:%s expired_at:%s", message.ID, message.ReceivedAt.Format(time.RFC3339), expiresAt.Format(time.RFC3339))
+		return
 	}
+
+	detection := &Detection{
+		Code:         best.Code,
+		Candidates:   candidates,
+		CodeSource:   codeSource,
+		Issuer:       best.Issuer,
+		ExpiresAt:    expiresAt,
+		ExpiryStated: best.Expiry != 0,
+		DetectedAt:   now,
+		MessageID:    message.ID,
+		Sender:       message.Sender,
+		Service:      service,
+		ReceivedBy:   message.ReceivedBy,
+		ReceivedAt:   message.ReceivedAt,
+		Text:         body.Text,
+	}
+	if best.Origin != nil {
+		detection.TopLevelDomain = best.Origin.TopLevelDomain
+		detection.EmbeddedDomain = best.Origin.EmbeddedDomain
+	}
+
+	m.logger.Printf("discovered mfa codes: %v service:%s line:%s source:%s chosen:%s origin:%s issuer:%q confidence:%.2f ttl:%s indicators:%v penalties:%v links:%v", candidateCodes(candidates), service, message.ReceivedBy, codeSource, best.Code, detection.TopLevelDomain, best.Issuer, best.Confidence, ttl, best.Indicators, best.Penalties, linkURLs(body.Links()))
+
+	m.dispatch(detection)
 }
 
-func (m *MessageMonitor) ensureDatabaseAccess() error {
-	if err := m.db.Ping(); err != nil {
-		return err
+// messageBody reads the body of a message. The attributed body is preferred, as it
+// carries the attributes Messages added, with the plain text as a fallback for messages
+// where it is missing or can't be decoded.
+func (m *MessageMonitor) messageBody(message *Message) (*streamtyped.AttributedString, error) {
+	if len(message.AttributedBody) > 0 {
+		body, err := streamtyped.DecodeAttributedString(message.AttributedBody)
+		if err == nil {
+			m.metrics.attributedBody.Add(1)
+			return body, nil
+		}
+
+		m.logger.Printf("failed to extract message from streamtyped buffer, falling back to text: %v id:%s", err, message.ID)
+		m.metrics.attributedBodyFailures.Add(1)
 	}
 
-	return nil
+	if message.Text != "" {
+		m.metrics.text.Add(1)
+		return &streamtyped.AttributedString{Text: message.Text}, nil
+	}
+
+	m.metrics.unreadable.Add(1)
+	return nil, ErrNoMessageBody
 }
 
-func (m *MessageMonitor) dispatchMFACode(mfaCode string) {
+func (m *MessageMonitor) dispatch(detection *Detection) {
 	for _, handler := range m.registeredDetectionHandlers {
-		handler(mfaCode)
+		handler(detection)
+	}
+}
+
+// candidatesForMessage returns the candidate codes in a message, best first, and where
+// they came from. Codes Messages recognised itself are preferred, with our own scorer
+// as the fallback when it didn't recognise any. Either way an origin-bound code comes
+// first, as the sender has said that's the code to use.
+func candidatesForMessage(message *streamtyped.AttributedString) ([]codeextractor.Candidate, string, error) {
+	oneTimeCodes := message.OneTimeCodes()
+	if len(oneTimeCodes) == 0 {
+		candidates, err := codeextractor.ExtractCandidates(message.Text)
+		if err != nil {
+			return nil, CodeSourceScorer, err
+		}
+
+		return originBoundFirst(candidates), CodeSourceScorer, nil
+	}
+
+	issuer, _ := codeextractor.ExtractIssuer(message.Text)
+	expiry, _ := codeextractor.ExtractExpiry(message.Text)
+	origin, _ := codeextractor.ParseOriginBoundCode(message.Text)
+
+	candidates := make([]codeextractor.Candidate, 0, len(oneTimeCodes))
+	for _, oneTimeCode := range oneTimeCodes {
+		// Messages marks the code in the origin-bound line too, which keeps its binding.
+		var candidateOrigin *codeextractor.OriginBoundCode
+		if origin != nil && origin.Code == oneTimeCode.Code {
+			candidateOrigin = origin
+		}
+
+		candidates = append(candidates, codeextractor.Candidate{
+			Code:       oneTimeCode.Code,
+			Raw:        message.Text[oneTimeCode.Start:oneTimeCode.End],
+			Start:      oneTimeCode.Start,
+			End:        oneTimeCode.End,
+			Confidence: 1,
+			Indicators: []string{streamtyped.OneTimeCodeAttributeName},
+			Issuer:     issuer,
+			Expiry:     expiry,
+			Origin:     candidateOrigin,
+		})
+	}
+
+	return originBoundFirst(candidates), CodeSourceMessages, nil
+}
+
+// originBoundFirst moves the origin-bound candidate, if there is one, to the front,
+// keeping the order of the others.
+func originBoundFirst(candidates []codeextractor.Candidate) []codeextractor.Candidate {
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].Origin != nil && candidates[j].Origin == nil
+	})
+
+	return candidates
+}
+
+func candidateCodes(candidates []codeextractor.Candidate) []string {
+	codes := make([]string, 0, len(candidates))
+	for _, c := range candidates {
+		codes = append(codes, c.Code)
 	}
+
+	return codes
+}
+
+func linkURLs(links []streamtyped.Link) []string {
+	urls := make([]string, 0, len(links))
+	for _, l := range links {
+		urls = append(urls, l.URL)
+	}
+
+	return urls
 }
 
 func generateMockMFACode() string {
@@ -0,0 +1,649 @@
+package messagemonitor
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/goleak"
+
+	"github.com/0xdeafcafe/pillar-box/server/internal/utilities/streamtyped"
+)
+
+func TestMessageBody(t *testing.T) {
+	attributedBody, err := os.ReadFile("../../utilities/streamtyped/testdata/text_only.bin")
+	if err != nil {
+		t.Fatalf("reading fixture: %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		message     *Message
+		want        string
+		wantErr     error
+		wantMetrics Metrics
+	}{
+		{
+			name: "Attributed body",
+			message: &Message{
+				AttributedBody: attributedBody,
+				Text:           "ignored",
+			},
+			want:        "Your Uber code is 1808. Never share this code. Reply STOP ending in 5910 to unsubscribe.",
+			wantMetrics: Metrics{AttributedBody: 1},
+		},
+		{
+			name: "Missing attributed body",
+			message: &Message{
+				Text: "Your code is 1234",
+			},
+			want:        "Your code is 1234",
+			wantMetrics: Metrics{Text: 1},
+		},
+		{
+			name: "Corrupt attributed body",
+			message: &Message{
+				AttributedBody: attributedBody[:20],
+				Text:           "Your code is 1234",
+			},
+			want:        "Your code is 1234",
+			wantMetrics: Metrics{AttributedBodyFailures: 1, Text: 1},
+		},
+		{
+			name:        "No body",
+			message:     &Message{},
+			wantErr:     ErrNoMessageBody,
+			wantMetrics: Metrics{Unreadable: 1},
+		},
+		{
+			name: "Corrupt attributed body and no text",
+			message: &Message{
+				AttributedBody: attributedBody[:20],
+			},
+			wantErr:     ErrNoMessageBody,
+			wantMetrics: Metrics{AttributedBodyFailures: 1, Unreadable: 1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := New(nil)
+
+			got, err := m.messageBody(tt.message)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+			} else if assert.NoError(t, err) {
+				assert.Equal(t, tt.want, got.Text)
+			}
+
+			assert.Equal(t, tt.wantMetrics, m.Metrics())
+		})
+	}
+}
+
+func TestListenAndHandle(t *testing.T) {
+	source, err := NewFileReplaySource("testdata/replay.jsonl")
+	if err != nil {
+		t.Fatalf("opening replay: %v", err)
+	}
+	defer source.Close()
+
+	m := New(source)
+	m.SetPollInterval(0)
+
+	// Replay the messages as if they had just been received.
+	m.SetClock(func() time.Time { return time.Date(2024, time.May, 1, 12, 3, 0, 0, time.UTC) })
+
+	codes := make([]string, 0)
+	m.RegisterDetectionHandler(func(detection *Detection) {
+		codes = append(codes, detection.Code)
+	})
+
+	// ListenAndHandle returns once the replay runs out of messages.
+	m.ListenAndHandle(context.Background())
+
+	assert.Equal(t, []string{"1808", "482913", "913170"}, codes)
+	assert.Equal(t, Metrics{AttributedBody: 1, Text: 3}, m.Metrics())
+}
+
+func TestListenAndHandleMemorySource(t *testing.T) {
+	receivedAt := time.Now().Add(-time.Minute)
+	source := NewMemorySource(&Message{
+		ID:         "1",
+		Sender:     "Uber",
+		Service:    ServiceSMS,
+		ReceivedBy: "+31600000000",
+		ReceivedAt: receivedAt,
+		Text:       "Your Uber code is 4821. It expires in 5 minutes.",
+	})
+	source.Close()
+
+	m := New(source)
+	m.SetPollInterval(0)
+
+	detections := make([]*Detection, 0)
+	m.RegisterDetectionHandler(func(detection *Detection) {
+		detections = append(detections, detection)
+	})
+
+	start := time.Now()
+	m.ListenAndHandle(context.Background())
+
+	if !assert.Len(t, detections, 1) {
+		return
+	}
+
+	detection := detections[0]
+	assert.Equal(t, "4821", detection.Code)
+	assert.Equal(t, CodeSourceScorer, detection.CodeSource)
+	assert.Equal(t, "Uber", detection.Issuer)
+	assert.True(t, detection.ExpiryStated)
+	assert.Equal(t, receivedAt.Add(5*time.Minute), detection.ExpiresAt)
+	assert.WithinDuration(t, start, detection.DetectedAt, time.Second)
+	assert.Equal(t, "1", detection.MessageID)
+	assert.Equal(t, "Uber", detection.Sender)
+	assert.Equal(t, ServiceSMS, detection.Service)
+	assert.Equal(t, "+31600000000", detection.ReceivedBy)
+	assert.Equal(t, receivedAt, detection.ReceivedAt)
+	assert.Equal(t, "Your Uber code is 4821. It expires in 5 minutes.", detection.Text)
+	if assert.NotEmpty(t, detection.Candidates) {
+		assert.Equal(t, "4821", detection.Candidates[0].Code)
+	}
+}
+
+func TestListenAndHandleDefaultExpiry(t *testing.T) {
+	source := NewMemorySource(&Message{ID: "1", Service: ServiceSMS, Text: "Your code is 4821"})
+	source.Close()
+
+	m := New(source)
+	m.SetDefaultCodeTTL(2 * time.Minute)
+
+	var got *Detection
+	m.RegisterDetectionHandler(func(detection *Detection) {
+		got = detection
+	})
+
+	start := time.Now()
+	m.ListenAndHandle(context.Background())
+
+	if assert.NotNil(t, got) {
+		assert.False(t, got.ExpiryStated)
+		assert.WithinDuration(t, start.Add(2*time.Minute), got.ExpiresAt, time.Second)
+	}
+}
+
+func TestListenAndHandlePrefersMessagesCode(t *testing.T) {
+	attributedBody, err := os.ReadFile("../../utilities/streamtyped/testdata/one_time_code.bin")
+	if err != nil {
+		t.Fatalf("reading fixture: %v", err)
+	}
+
+	source := NewMemorySource(&Message{ID: "1", Service: ServiceIMessage, AttributedBody: attributedBody})
+	source.Close()
+
+	m := New(source)
+
+	var got *Detection
+	m.RegisterDetectionHandler(func(detection *Detection) {
+		got = detection
+	})
+
+	m.ListenAndHandle(context.Background())
+
+	if assert.NotNil(t, got) {
+		assert.Equal(t, "482913", got.Code)
+		assert.Equal(t, CodeSourceMessages, got.CodeSource)
+		assert.Equal(t, "Apple", got.Issuer)
+	}
+}
+
+func TestCandidatesForMessageOriginBound(t *testing.T) {
+	text := "Your code is 123456.\n\n@shop.example #123456 @pay.example"
+	start := strings.LastIndex(text, "123456")
+
+	// Messages marks the code in the origin-bound line, which keeps its binding.
+	candidates, codeSource, err := candidatesForMessage(&streamtyped.AttributedString{
+		Text: text,
+		Runs: []streamtyped.AttributeRun{
+			{Start: 0, End: start},
+			{Start: start, End: start + 6, Attributes: map[string]any{streamtyped.OneTimeCodeAttributeName: nil}},
+			{Start: start + 6, End: len(text)},
+		},
+	})
+	if !assert.NoError(t, err) || !assert.Len(t, candidates, 1) {
+		return
+	}
+
+	assert.Equal(t, CodeSourceMessages, codeSource)
+	if assert.NotNil(t, candidates[0].Origin) {
+		assert.Equal(t, "shop.example", candidates[0].Origin.TopLevelDomain)
+		assert.Equal(t, "pay.example", candidates[0].Origin.EmbeddedDomain)
+	}
+}
+
+func TestCandidatesForMessageOriginBoundFirst(t *testing.T) {
+	// A different code comes before the origin-bound line.
+	text := "Your code is 654321.\n\n@shop.example #123456"
+	first := strings.Index(text, "654321")
+	second := strings.Index(text, "123456")
+
+	tests := []struct {
+		name           string
+		runs           []streamtyped.AttributeRun
+		wantCodeSource string
+	}{
+		{
+			name: "Messages recognised both codes",
+			runs: []streamtyped.AttributeRun{
+				{Start: 0, End: first},
+				{Start: first, End: first + 6, Attributes: map[string]any{streamtyped.OneTimeCodeAttributeName: nil}},
+				{Start: first + 6, End: second},
+				{Start: second, End: second + 6, Attributes: map[string]any{streamtyped.OneTimeCodeAttributeName: nil}},
+			},
+			wantCodeSource: CodeSourceMessages,
+		},
+		{
+			name:           "Scorer",
+			runs:           []streamtyped.AttributeRun{{Start: 0, End: len(text)}},
+			wantCodeSource: CodeSourceScorer,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			candidates, codeSource, err := candidatesForMessage(&streamtyped.AttributedString{Text: text, Runs: tt.runs})
+			if !assert.NoError(t, err) || !assert.NotEmpty(t, candidates) {
+				return
+			}
+
+			assert.Equal(t, tt.wantCodeSource, codeSource)
+			assert.Equal(t, "123456", candidates[0].Code)
+			assert.NotNil(t, candidates[0].Origin)
+		})
+	}
+}
+
+func TestSendMockMessage(t *testing.T) {
+	m := New(NewMemorySource())
+
+	var got *Detection
+	m.RegisterDetectionHandler(func(detection *Detection) {
+		got = detection
+	})
+
+	m.SendMockMessage()
+
+	if assert.NotNil(t, got) {
+		assert.Len(t, got.Code, 6)
+		assert.Equal(t, CodeSourceMock, got.CodeSource)
+	}
+}
+
+func TestListenAndHandleServices(t *testing.T) {
+	messages := []*Message{
+		{ID: "1", Service: ServiceSMS, Text: "Your code is 1111"},
+		{ID: "2", Service: ServiceRCS, Text: "Your code is 2222"},
+		{ID: "3", Service: ServiceIMessage, Text: "Your code is 3333"},
+		{ID: "4", Service: "sms", Text: "Your code is 4444"},
+	}
+
+	tests := []struct {
+		name     string
+		services []string
+		want     []string
+	}{
+		{
+			name:     "Default",
+			services: nil,
+			want:     []string{"1111/SMS", "2222/RCS", "3333/iMessage", "4444/SMS"},
+		},
+		{
+			name:     "SMS only",
+			services: []string{ServiceSMS},
+			want:     []string{"1111/SMS", "4444/SMS"},
+		},
+		{
+			name:     "RCS and iMessage",
+			services: []string{"rcs", "imessage"},
+			want:     []string{"2222/RCS", "3333/iMessage"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			source := NewMemorySource(messages...)
+			source.Close()
+
+			m := New(source)
+			m.SetPollInterval(0)
+			if tt.services != nil {
+				m.SetServices(tt.services...)
+			}
+
+			got := make([]string, 0)
+			m.RegisterDetectionHandler(func(detection *Detection) {
+				got = append(got, detection.Code+"/"+detection.Service)
+			})
+
+			m.ListenAndHandle(context.Background())
+
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestListenAndHandleSenderRules(t *testing.T) {
+	source := NewMemorySource(
+		&Message{ID: "1", Sender: "4664", Service: ServiceSMS, Text: "Your code is 1111"},
+		&Message{ID: "2", Sender: "+31612345678", Service: ServiceSMS, Text: "Your code is 2222"},
+		&Message{ID: "3", Sender: "7070", Service: ServiceSMS, Text: "Order 333333 confirmed, your code is 3333"},
+	)
+	source.Close()
+
+	rules, err := NewSenderRules(
+		SenderRule{Action: SenderRuleAllow, Match: SenderRuleMatchPattern, Value: `^\d{4,6}$`},
+		SenderRule{Action: SenderRuleDeny, Match: SenderRuleMatchExact, Value: "7070"},
+	)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	m := New(source)
+	m.SetSenderRules(rules)
+
+	codes := make([]string, 0)
+	m.RegisterDetectionHandler(func(detection *Detection) {
+		codes = append(codes, detection.Code)
+	})
+
+	m.ListenAndHandle(context.Background())
+
+	assert.Equal(t, []string{"1111"}, codes)
+}
+
+func TestListenAndHandleOutgoingAndFiltered(t *testing.T) {
+	messages := func() []*Message {
+		return []*Message{
+			{ID: "1", Service: ServiceSMS, Text: "Your code is 1111"},
+			{ID: "2", Service: ServiceSMS, Text: "Your code is 2222", FromMe: true},
+			{ID: "3", Service: ServiceSMS, Text: "Your code is 3333", Filter: MessageFilterUnknownSender},
+			{ID: "4", Service: ServiceSMS, Text: "Your code is 4444", Filter: MessageFilterJunk},
+		}
+	}
+
+	tests := []struct {
+		name            string
+		includeOutgoing bool
+		policy          FilteredMessagePolicy
+		want            []string
+	}{
+		{
+			name: "Defaults",
+			want: []string{"1111", "3333"},
+		},
+		{
+			name:            "Including outgoing",
+			includeOutgoing: true,
+			want:            []string{"1111", "2222", "3333"},
+		},
+		{
+			name:   "Allowing filtered",
+			policy: FilteredMessagePolicyAllow,
+			want:   []string{"1111", "3333", "4444"},
+		},
+		{
+			name:   "Ignoring filtered",
+			policy: FilteredMessagePolicyIgnoreFiltered,
+			want:   []string{"1111"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			source := NewMemorySource(messages()...)
+			source.Close()
+
+			m := New(source)
+			m.SetIncludeOutgoing(tt.includeOutgoing)
+			if tt.policy != "" {
+				m.SetFilteredMessagePolicy(tt.policy)
+			}
+
+			codes := make([]string, 0)
+			m.RegisterDetectionHandler(func(detection *Detection) {
+				codes = append(codes, detection.Code)
+			})
+
+			m.ListenAndHandle(context.Background())
+
+			assert.Equal(t, tt.want, codes)
+		})
+	}
+}
+
+func TestListenAndHandleReceivingLines(t *testing.T) {
+	messages := func() []*Message {
+		return []*Message{
+			{ID: "1", Service: ServiceSMS, ReceivedBy: "+31600000000", Text: "Your code is 1111"},
+			{ID: "2", Service: ServiceSMS, ReceivedBy: "+31611111111", Text: "Your code is 2222"},
+			{ID: "3", Service: ServiceIMessage, ReceivedBy: "Work@Example.com", Text: "Your code is 3333"},
+			{ID: "4", Service: ServiceSMS, Text: "Your code is 4444"},
+		}
+	}
+
+	tests := []struct {
+		name  string
+		lines []string
+		want  []string
+	}{
+		{
+			name: "Every line",
+			want: []string{"1111", "2222", "3333", "4444"},
+		},
+		{
+			name:  "One SIM",
+			lines: []string{"+31 6 0000 0000"},
+			want:  []string{"1111"},
+		},
+		{
+			name:  "Work number and email",
+			lines: []string{"+31611111111", "work@example.com"},
+			want:  []string{"2222", "3333"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			source := NewMemorySource(messages()...)
+			source.Close()
+
+			m := New(source)
+			m.SetReceivingLines(tt.lines...)
+
+			codes := make([]string, 0)
+			m.RegisterDetectionHandler(func(detection *Detection) {
+				codes = append(codes, detection.Code)
+			})
+
+			m.ListenAndHandle(context.Background())
+
+			assert.Equal(t, tt.want, codes)
+		})
+	}
+}
+
+func TestListenAndHandleMaxMessageAge(t *testing.T) {
+	now := time.Now()
+	messages := func() []*Message {
+		return []*Message{
+			{ID: "1", Service: ServiceSMS, ReceivedAt: now.Add(-time.Minute), Text: "Your code is 1111"},
+			{ID: "2", Service: ServiceSMS, ReceivedAt: now.Add(-time.Hour), Text: "Your code is 2222"},
+			{ID: "3", Service: ServiceSMS, ReceivedAt: now.Add(-24 * time.Hour), Text: "Your code is 3333"},
+			{ID: "4", Service: ServiceSMS, Text: "Your code is 4444"},
+		}
+	}
+
+	tests := []struct {
+		name   string
+		maxAge time.Duration
+		want   []string
+	}{
+		{
+			name:   "Default",
+			maxAge: DefaultMaxMessageAge,
+			want:   []string{"1111", "4444"},
+		},
+		{
+			name:   "Two hours",
+			maxAge: 2 * time.Hour,
+			want:   []string{"1111", "2222", "4444"},
+		},
+		{
+			name:   "Off",
+			maxAge: 0,
+			want:   []string{"1111", "2222", "3333", "4444"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			source := NewMemorySource(messages()...)
+			source.Close()
+
+			m := New(source)
+			m.SetMaxMessageAge(tt.maxAge)
+
+			// Keep the codes valid, so only their age decides whether they're handled.
+			m.SetDefaultCodeTTL(48 * time.Hour)
+
+			codes := make([]string, 0)
+			m.RegisterDetectionHandler(func(detection *Detection) {
+				codes = append(codes, detection.Code)
+			})
+
+			m.ListenAndHandle(context.Background())
+
+			assert.Equal(t, tt.want, codes)
+		})
+	}
+}
+
+func TestListenAndHandleExpiry(t *testing.T) {
+	now := time.Date(2024, time.May, 1, 12, 0, 0, 0, time.UTC)
+
+	// Messages read late, e.g. replayed while catching up, keep the expiry they arrived
+	// with, and are dropped once it has passed.
+	source := NewMemorySource(
+		&Message{ID: "1", Service: ServiceSMS, ReceivedAt: now.Add(-6 * time.Minute), Text: "Your code is 1111. It expires in 5 minutes."},
+		&Message{ID: "2", Service: ServiceSMS, ReceivedAt: now.Add(-4 * time.Minute), Text: "Your code is 2222. It expires in 5 minutes."},
+		&Message{ID: "3", Service: ServiceSMS, ReceivedAt: now.Add(-3 * time.Minute), Text: "Your code is 3333"},
+		&Message{ID: "4", Service: ServiceSMS, Text: "Your code is 4444"},
+	)
+	source.Close()
+
+	m := New(source)
+	m.SetClock(func() time.Time { return now })
+	m.SetDefaultCodeTTL(2 * time.Minute)
+
+	expiresAt := map[string]time.Time{}
+	m.RegisterDetectionHandler(func(detection *Detection) {
+		expiresAt[detection.Code] = detection.ExpiresAt
+	})
+
+	m.ListenAndHandle(context.Background())
+
+	assert.Equal(t, map[string]time.Time{
+		"2222": now.Add(time.Minute),
+		"4444": now.Add(2 * time.Minute),
+	}, expiresAt)
+}
+
+func TestListenAndHandleShutdown(t *testing.T) {
+	// The test database is closed after the check, so must be opened before it.
+	db, dbPath := newTestChatDB(t)
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+	stateFile := NewStateFile(filepath.Join(t.TempDir(), "state.json"))
+	assert.NoError(t, stateFile.Save(&State{ChatDBRowID: 1}))
+
+	now := time.Now().Sub(appleEpoch).Nanoseconds()
+	insertTestMessage(t, db, "1", ServiceSMS, "Your code is 1111", now)
+	insertTestMessage(t, db, "2", ServiceSMS, "Your code is 4821", now)
+
+	source, err := NewChatDBSourceAtPath(dbPath, stateFile)
+	if err != nil {
+		t.Fatalf("creating source: %v", err)
+	}
+
+	m := New(source)
+	// Long enough that the test can only pass if waiting is cut short by the context.
+	m.SetPollInterval(time.Hour)
+	m.SetSafetyPollInterval(time.Hour)
+
+	codes := make(chan string, 1)
+	m.RegisterDetectionHandler(func(detection *Detection) {
+		codes <- detection.Code
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	done := make(chan error)
+	go func() {
+		done <- m.ListenAndHandle(ctx)
+	}()
+
+	select {
+	case code := <-codes:
+		assert.Equal(t, "4821", code)
+	case <-time.After(2 * time.Second):
+		t.Fatal("code was not dispatched")
+	}
+
+	cancel()
+
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("monitor did not stop after the context was cancelled")
+	}
+
+	// The source was closed, with the cursor saved.
+	_, err = source.Next()
+	assert.Error(t, err)
+
+	state, err := stateFile.Load()
+	assert.NoError(t, err)
+	assert.Equal(t, &State{ChatDBRowID: 2}, state)
+}
+
+func TestListenAndHandleShutdownWithoutAccess(t *testing.T) {
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+	source, err := NewChatDBSourceAtPath(filepath.Join(t.TempDir(), "missing", "chat.db"), nil)
+	if err != nil {
+		t.Fatalf("creating source: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	m := New(source)
+	m.RegisterNoAccessHandler(func() { cancel() })
+
+	done := make(chan error)
+	go func() {
+		done <- m.ListenAndHandle(ctx)
+	}()
+
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("monitor did not stop after the context was cancelled")
+	}
+}
@@ -0,0 +1,39 @@
+package messagemonitor
+
+import "sync/atomic"
+
+// Metrics counts how the bodies of the messages the monitor has read were obtained.
+type Metrics struct {
+	// AttributedBody is the number of messages read from the decoded attributedBody
+	// column.
+	AttributedBody uint64
+
+	// AttributedBodyFailures is the number of messages whose attributedBody was present
+	// but couldn't be decoded.
+	AttributedBodyFailures uint64
+
+	// Text is the number of messages read from the plain text column, because the
+	// attributedBody was missing or couldn't be decoded.
+	Text uint64
+
+	// Unreadable is the number of messages that had neither.
+	Unreadable uint64
+}
+
+// metrics holds the live counters behind Metrics.
+type metrics struct {
+	attributedBody         atomic.Uint64
+	attributedBodyFailures atomic.Uint64
+	text                   atomic.Uint64
+	unreadable             atomic.Uint64
+}
+
+// Metrics returns a snapshot of how message bodies have been read so far.
+func (m *MessageMonitor) Metrics() Metrics {
+	return Metrics{
+		AttributedBody:         m.metrics.attributedBody.Load(),
+		AttributedBodyFailures: m.metrics.attributedBodyFailures.Load(),
+		Text:                   m.metrics.text.Load(),
+		Unreadable:             m.metrics.unreadable.Load(),
+	}
+}
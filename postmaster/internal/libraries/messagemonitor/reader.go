@@ -0,0 +1,272 @@
+package messagemonitor
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxReaderLineSize is the longest line a ReaderSource will read, which comfortably fits
+// a recorded message with a base64 encoded attributedBody.
+const maxReaderLineSize = 1024 * 1024
+
+// ReaderSource is a MessageSource that reads messages from an io.Reader, one per line.
+// Each line is either a JSON encoded message, as written by a recording, or the plain
+// text of an SMS.
+//
+// A JSON encoded message looks like this, where every field is optional. It can also
+// have a received_by field, holding the line it was received on, an attributed_body
+// field, holding a base64 encoded attributedBody, a from_me field, and a filter field
+// holding a MessageFilter.
+//
+//	{"id":"A1","sender":"+31600000000","service":"SMS","received_at":"2024-05-01T12:00:00Z","text":"Your code is 1234"}
+//
+// The reader is read in the background, so Next never blocks waiting for a line, and the
+// monitor can stop while stdin is still open.
+type ReaderSource struct {
+	name   string
+	reader io.Reader
+	closer io.Closer
+
+	mutex   sync.Mutex
+	lines   []readerLine
+	err     error
+	done    bool
+	changes chan struct{}
+
+	openOnce  sync.Once
+	closeOnce sync.Once
+	closing   chan struct{}
+	reading   sync.WaitGroup
+}
+
+// readerLine is a line read by a ReaderSource, along with its line number.
+type readerLine struct {
+	number int
+	text   string
+}
+
+// recordedMessage is the JSON encoding of a Message read by a ReaderSource.
+type recordedMessage struct {
+	ID             string        `json:"id"`
+	Sender         string        `json:"sender"`
+	Service        string        `json:"service"`
+	ReceivedBy     string        `json:"received_by"`
+	ReceivedAt     time.Time     `json:"received_at"`
+	Text           string        `json:"text"`
+	AttributedBody []byte        `json:"attributed_body"`
+	FromMe         bool          `json:"from_me"`
+	Filter         MessageFilter `json:"filter"`
+}
+
+// NewReaderSource creates a MessageSource that reads messages from reader. The name is
+// used to give messages without an ID one.
+//
+// If reader is an io.Closer it is closed by Close, which stops a read that is waiting
+// for input. Close waits for the reader to return, so a reader that can block must be
+// one. The exception is an *os.File that can't be polled, such as stdin when it's a
+// terminal, where a read carries on until there's input even once the file is closed.
+// Close doesn't wait for those.
+func NewReaderSource(name string, reader io.Reader) *ReaderSource {
+	source := &ReaderSource{
+		name:    name,
+		reader:  reader,
+		changes: make(chan struct{}, 1),
+		closing: make(chan struct{}),
+	}
+	if closer, ok := reader.(io.Closer); ok {
+		source.closer = closer
+	}
+
+	return source
+}
+
+// NewFileReplaySource creates a MessageSource that replays the messages recorded in the
+// file at filePath.
+func NewFileReplaySource(filePath string) (*ReaderSource, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewReaderSource(filePath, file), nil
+}
+
+// NewStdinSource creates a MessageSource that reads messages from stdin, so messages can
+// be typed or piped in by hand. Closing it closes stdin.
+func NewStdinSource() *ReaderSource {
+	return NewReaderSource("stdin", os.Stdin)
+}
+
+// Open starts reading lines from the reader in the background.
+func (s *ReaderSource) Open() error {
+	s.openOnce.Do(func() {
+		s.reading.Add(1)
+		go s.read()
+	})
+
+	return nil
+}
+
+// read reads lines from the reader until it runs out, fails, or the source is closed.
+func (s *ReaderSource) read() {
+	defer s.reading.Done()
+
+	scanner := bufio.NewScanner(s.reader)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxReaderLineSize)
+
+	number := 0
+	for scanner.Scan() {
+		number++
+
+		s.mutex.Lock()
+		s.lines = append(s.lines, readerLine{number: number, text: scanner.Text()})
+		s.notify()
+		s.mutex.Unlock()
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// Reading fails once the reader is closed, which isn't worth reporting.
+	select {
+	case <-s.closing:
+	default:
+		s.err = scanner.Err()
+	}
+
+	s.done = true
+	s.notify()
+}
+
+// Next returns the messages read since it was last called. Once the reader has run out
+// and every message has been returned, it returns io.EOF.
+func (s *ReaderSource) Next() ([]*Message, error) {
+	if err := s.Open(); err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	messages := make([]*Message, 0, len(s.lines))
+	for len(s.lines) > 0 {
+		line := s.lines[0]
+
+		text := strings.TrimSpace(line.text)
+		if text == "" {
+			s.lines = s.lines[1:]
+			continue
+		}
+
+		message, err := s.parseLine(line.number, text)
+		if err != nil {
+			// Return the messages before the broken line first, so they aren't lost.
+			if len(messages) > 0 {
+				return messages, nil
+			}
+
+			s.lines = s.lines[1:]
+
+			return nil, fmt.Errorf("%s:%d: %w", s.name, line.number, err)
+		}
+
+		messages = append(messages, message)
+		s.lines = s.lines[1:]
+	}
+
+	if len(messages) > 0 || !s.done {
+		return messages, nil
+	}
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	return nil, io.EOF
+}
+
+// Ack does nothing, as a ReaderSource doesn't remember its position.
+func (s *ReaderSource) Ack(message *Message) error {
+	return nil
+}
+
+// Close closes the reader, if it can be closed, and waits for the source to stop
+// reading from it, unless the reader is a file whose reads can't be interrupted.
+func (s *ReaderSource) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.closing)
+
+		// Closing a file that can't be polled doesn't stop a read that is waiting for
+		// input, and setting a deadline fails for exactly those files.
+		interruptible := true
+		if file, ok := s.reader.(*os.File); ok {
+			interruptible = file.SetReadDeadline(time.Now()) == nil
+		}
+
+		if s.closer != nil {
+			err = s.closer.Close()
+		}
+
+		if interruptible {
+			s.reading.Wait()
+		}
+	})
+
+	return err
+}
+
+// Changes returns a channel that is signalled whenever lines are read, or the reader
+// runs out.
+func (s *ReaderSource) Changes() <-chan struct{} {
+	return s.changes
+}
+
+func (s *ReaderSource) notify() {
+	select {
+	case s.changes <- struct{}{}:
+	default:
+	}
+}
+
+func (s *ReaderSource) parseLine(number int, line string) (*Message, error) {
+	message := &Message{
+		ID:         fmt.Sprintf("%s:%d", s.name, number),
+		Service:    ServiceSMS,
+		ReceivedAt: time.Now(),
+		Text:       line,
+	}
+
+	if !strings.HasPrefix(line, "{") {
+		return message, nil
+	}
+
+	var recorded recordedMessage
+	if err := json.Unmarshal([]byte(line), &recorded); err != nil {
+		return nil, err
+	}
+
+	if recorded.ID != "" {
+		message.ID = recorded.ID
+	}
+	if recorded.Service != "" {
+		message.Service = recorded.Service
+	}
+	if !recorded.ReceivedAt.IsZero() {
+		message.ReceivedAt = recorded.ReceivedAt
+	}
+
+	message.Sender = recorded.Sender
+	message.ReceivedBy = recorded.ReceivedBy
+	message.Text = recorded.Text
+	message.AttributedBody = recorded.AttributedBody
+	message.FromMe = recorded.FromMe
+	message.Filter = recorded.Filter
+
+	return message, nil
+}
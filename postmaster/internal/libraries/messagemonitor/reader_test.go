@@ -0,0 +1,143 @@
+package messagemonitor
+
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/goleak"
+)
+
+// readAll reads messages from source until it returns an error, waiting for it to say
+// it has more in between.
+func readAll(t *testing.T, source *ReaderSource) ([]*Message, error) {
+	t.Helper()
+
+	messages := make([]*Message, 0)
+	for {
+		next, err := source.Next()
+		if err != nil {
+			return messages, err
+		}
+
+		messages = append(messages, next...)
+
+		if len(next) == 0 {
+			select {
+			case <-source.Changes():
+			case <-time.After(2 * time.Second):
+				t.Fatal("source did not say it had more messages")
+			}
+		}
+	}
+}
+
+func TestReaderSource(t *testing.T) {
+	input := strings.Join([]string{
+		`Your code is 1234`,
+		``,
+		`{"id":"A1","sender":"+31600000000","service":"iMessage","received_by":"+31611111111","received_at":"2024-05-01T12:00:00Z","text":"Your code is 5678"}`,
+		`{"text":"Your code is 9012","from_me":true,"filter":"junk"}`,
+	}, "\n")
+
+	source := NewReaderSource("test", strings.NewReader(input))
+	assert.NoError(t, source.Open())
+
+	messages, err := readAll(t, source)
+	assert.ErrorIs(t, err, io.EOF)
+	if !assert.Len(t, messages, 3) {
+		return
+	}
+
+	assert.Equal(t, "test:1", messages[0].ID)
+	assert.Equal(t, ServiceSMS, messages[0].Service)
+	assert.Equal(t, "Your code is 1234", messages[0].Text)
+
+	assert.Equal(t, &Message{
+		ID:         "A1",
+		Sender:     "+31600000000",
+		Service:    ServiceIMessage,
+		ReceivedBy: "+31611111111",
+		ReceivedAt: time.Date(2024, time.May, 1, 12, 0, 0, 0, time.UTC),
+		Text:       "Your code is 5678",
+	}, messages[1])
+
+	assert.Equal(t, "test:4", messages[2].ID)
+	assert.Equal(t, ServiceSMS, messages[2].Service)
+	assert.Equal(t, "Your code is 9012", messages[2].Text)
+	assert.True(t, messages[2].FromMe)
+	assert.Equal(t, MessageFilterJunk, messages[2].Filter)
+}
+
+func TestReaderSourceInvalidJSON(t *testing.T) {
+	source := NewReaderSource("test", strings.NewReader("Your code is 1234\n{\"text\": \nYour code is 5678"))
+
+	// Messages either side of the broken line are still read.
+	messages, err := readAll(t, source)
+	assert.ErrorContains(t, err, "test:2:")
+	assert.Len(t, messages, 1)
+
+	messages, err = readAll(t, source)
+	assert.ErrorIs(t, err, io.EOF)
+	if assert.Len(t, messages, 1) {
+		assert.Equal(t, "Your code is 5678", messages[0].Text)
+	}
+}
+
+func TestReaderSourceShutdown(t *testing.T) {
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+	// A pipe behaves like stdin, where reads block until there's input.
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("creating pipe: %v", err)
+	}
+	defer writer.Close()
+
+	m := New(NewReaderSource("stdin", reader))
+	m.SetLogger(log.New(io.Discard, "", 0))
+
+	detections := make(chan *Detection, 1)
+	m.RegisterDetectionHandler(func(detection *Detection) {
+		detections <- detection
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	done := make(chan error)
+	go func() {
+		done <- m.ListenAndHandle(ctx)
+	}()
+
+	if _, err := writer.WriteString("Your code is 4821\n"); err != nil {
+		t.Fatalf("writing to pipe: %v", err)
+	}
+
+	select {
+	case detection := <-detections:
+		assert.Equal(t, "4821", detection.Code)
+	case <-time.After(2 * time.Second):
+		t.Fatal("code was not handled")
+	}
+
+	// The monitor stops while the source is still waiting for its next line.
+	cancel()
+
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("monitor did not stop after the context was cancelled")
+	}
+}
+
+func TestNewFileReplaySourceMissingFile(t *testing.T) {
+	_, err := NewFileReplaySource("testdata/missing.jsonl")
+	assert.Error(t, err)
+}
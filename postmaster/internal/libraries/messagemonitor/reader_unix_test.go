@@ -0,0 +1,60 @@
+//go:build unix
+
+package messagemonitor
+
+import (
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/goleak"
+)
+
+func TestReaderSourceCloseBlockingFile(t *testing.T) {
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+	// Unlike os.Pipe, these are blocking file descriptors that can't be polled, like
+	// stdin is when it's a terminal.
+	fds := make([]int, 2)
+	if err := syscall.Pipe(fds); err != nil {
+		t.Fatalf("creating pipe: %v", err)
+	}
+	reader := os.NewFile(uintptr(fds[0]), "reader")
+	writer := os.NewFile(uintptr(fds[1]), "writer")
+
+	source := NewReaderSource("stdin", reader)
+	if err := source.Open(); err != nil {
+		t.Fatalf("opening source: %v", err)
+	}
+
+	// Wait for a line to be read, so the source is waiting for the next one.
+	if _, err := writer.WriteString("Your code is 4821\n"); err != nil {
+		t.Fatalf("writing to pipe: %v", err)
+	}
+
+	select {
+	case <-source.Changes():
+	case <-time.After(2 * time.Second):
+		t.Fatal("line was not read")
+	}
+
+	closed := make(chan error)
+	go func() {
+		closed <- source.Close()
+	}()
+
+	select {
+	case err := <-closed:
+		assert.NoError(t, err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("source did not close while waiting for input")
+	}
+
+	// The read only returns once there's something to read, after which the source
+	// stops reading.
+	if err := writer.Close(); err != nil {
+		t.Fatalf("closing pipe: %v", err)
+	}
+}
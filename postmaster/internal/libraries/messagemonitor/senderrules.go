@@ -0,0 +1,234 @@
+package messagemonitor
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// SenderRuleAction says what happens to messages from a sender matched by a rule.
+type SenderRuleAction string
+
+const (
+	// SenderRuleAllow lets messages from the sender through. Once there is any allow
+	// rule, only messages from allowed senders are let through.
+	SenderRuleAllow SenderRuleAction = "allow"
+
+	// SenderRuleDeny drops messages from the sender. Deny rules win over allow rules.
+	SenderRuleDeny SenderRuleAction = "deny"
+)
+
+// SenderRuleMatch says how a rule's value is compared to a sender.
+type SenderRuleMatch string
+
+const (
+	// SenderRuleMatchExact matches a sender that is the value, e.g. "+31612345678".
+	SenderRuleMatchExact SenderRuleMatch = "exact"
+
+	// SenderRuleMatchPrefix matches a sender that starts with the value, e.g. "+44".
+	SenderRuleMatchPrefix SenderRuleMatch = "prefix"
+
+	// SenderRuleMatchPattern matches a sender with the value as a regular expression, e.g.
+	// `^\d{4,6}$` for shortcodes.
+	SenderRuleMatchPattern SenderRuleMatch = "pattern"
+)
+
+var (
+	ErrSenderRuleInvalidAction = errors.New("sender rule action is invalid")
+	ErrSenderRuleInvalidMatch  = errors.New("sender rule match is invalid")
+	ErrSenderRuleEmptyValue    = errors.New("sender rule value is empty")
+)
+
+// SenderRule allows or denies messages from the senders it matches.
+type SenderRule struct {
+	Action SenderRuleAction `json:"action"`
+	Match  SenderRuleMatch  `json:"match"`
+	Value  string           `json:"value"`
+
+	pattern *regexp.Regexp
+}
+
+// SenderRules is a set of rules deciding which senders codes are extracted from.
+type SenderRules struct {
+	rules []SenderRule
+
+	// denyAllReason is set when every sender is denied, see DenyAllSenderRules.
+	denyAllReason string
+}
+
+// senderRulesFile is the JSON encoding of SenderRules.
+type senderRulesFile struct {
+	Rules []SenderRule `json:"rules"`
+}
+
+// SenderRulesFileName is the name of the sender rules file within the config directory.
+const SenderRulesFileName = "sender-rules.json"
+
+// DefaultSenderRulesPath returns where the sender rules are kept by default, next to the
+// monitor's state in the DefaultConfigDir.
+func DefaultSenderRulesPath() (string, error) {
+	dirname, err := DefaultConfigDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dirname, SenderRulesFileName), nil
+}
+
+// NewSenderRules validates rules and creates a SenderRules from them.
+func NewSenderRules(rules ...SenderRule) (*SenderRules, error) {
+	senderRules := &SenderRules{rules: make([]SenderRule, 0, len(rules))}
+
+	for i, rule := range rules {
+		switch rule.Action {
+		case SenderRuleAllow, SenderRuleDeny:
+		default:
+			return nil, fmt.Errorf("rule %d: %w: %q", i, ErrSenderRuleInvalidAction, rule.Action)
+		}
+
+		if rule.Value == "" {
+			return nil, fmt.Errorf("rule %d: %w", i, ErrSenderRuleEmptyValue)
+		}
+
+		switch rule.Match {
+		case SenderRuleMatchExact, SenderRuleMatchPrefix:
+		case SenderRuleMatchPattern:
+			pattern, err := regexp.Compile(rule.Value)
+			if err != nil {
+				return nil, fmt.Errorf("rule %d: %w", i, err)
+			}
+
+			rule.pattern = pattern
+		default:
+			return nil, fmt.Errorf("rule %d: %w: %q", i, ErrSenderRuleInvalidMatch, rule.Match)
+		}
+
+		senderRules.rules = append(senderRules.rules, rule)
+	}
+
+	return senderRules, nil
+}
+
+// DenyAllSenderRules creates a SenderRules that denies every sender, giving reason. It is
+// used when the user's rules can't be loaded, as allowing every sender instead would
+// ignore any they had denied.
+func DenyAllSenderRules(reason string) *SenderRules {
+	return &SenderRules{denyAllReason: reason}
+}
+
+// LoadSenderRules reads sender rules from the JSON file at path. If the file doesn't
+// exist, there are no rules and every sender is allowed.
+func LoadSenderRules(path string) (*SenderRules, error) {
+	buf, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return NewSenderRules()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var file senderRulesFile
+	if err := json.Unmarshal(buf, &file); err != nil {
+		return nil, err
+	}
+
+	return NewSenderRules(file.Rules...)
+}
+
+// Save writes the sender rules to the JSON file at path.
+func (r *SenderRules) Save(path string) error {
+	buf, err := json.MarshalIndent(&senderRulesFile{Rules: r.Rules()}, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomically(path, buf)
+}
+
+// Rules returns a copy of the rules.
+func (r *SenderRules) Rules() []SenderRule {
+	if r == nil {
+		return []SenderRule{}
+	}
+
+	return append(make([]SenderRule, 0, len(r.rules)), r.rules...)
+}
+
+// Allows reports whether messages from sender should have codes extracted from them. If
+// not, the reason says which rule filtered the sender out.
+func (r *SenderRules) Allows(sender string) (bool, string) {
+	if r == nil {
+		return true, ""
+	}
+	if r.denyAllReason != "" {
+		return false, r.denyAllReason
+	}
+	if len(r.rules) == 0 {
+		return true, ""
+	}
+
+	hasAllowRules := false
+	allowed := false
+
+	for _, rule := range r.rules {
+		if rule.Action == SenderRuleAllow {
+			hasAllowRules = true
+		}
+
+		if !rule.matches(sender) {
+			continue
+		}
+
+		if rule.Action == SenderRuleDeny {
+			return false, fmt.Sprintf("denied by %s rule %q", rule.Match, rule.Value)
+		}
+
+		allowed = true
+	}
+
+	if hasAllowRules && !allowed {
+		return false, "not matched by any allow rule"
+	}
+
+	return true, ""
+}
+
+func (rule *SenderRule) matches(sender string) bool {
+	if sender == "" {
+		return false
+	}
+
+	switch rule.Match {
+	case SenderRuleMatchExact:
+		return normaliseHandle(sender) == normaliseHandle(rule.Value)
+	case SenderRuleMatchPrefix:
+		return strings.HasPrefix(normaliseHandle(sender), normaliseHandle(rule.Value))
+	case SenderRuleMatchPattern:
+		return rule.pattern.MatchString(sender)
+	}
+
+	return false
+}
+
+// normaliseHandle makes handles comparable regardless of how they were written, so
+// "+31 6 1234-5678" matches "+31612345678" and email addresses match in any case.
+func normaliseHandle(handle string) string {
+	handle = strings.ToLower(strings.TrimSpace(handle))
+	if strings.Contains(handle, "@") {
+		return handle
+	}
+
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '-', '(', ')', '.':
+			return -1
+		}
+
+		return r
+	}, handle)
+}
@@ -0,0 +1,174 @@
+package messagemonitor
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSenderRulesAllows(t *testing.T) {
+	tests := []struct {
+		name       string
+		rules      []SenderRule
+		sender     string
+		want       bool
+		wantReason string
+	}{
+		{
+			name:   "No rules",
+			sender: "+31612345678",
+			want:   true,
+		},
+		{
+			name:       "Denied exactly",
+			rules:      []SenderRule{{Action: SenderRuleDeny, Match: SenderRuleMatchExact, Value: "+31 6 1234-5678"}},
+			sender:     "+31612345678",
+			want:       false,
+			wantReason: `denied by exact rule "+31 6 1234-5678"`,
+		},
+		{
+			name:   "Not denied",
+			rules:  []SenderRule{{Action: SenderRuleDeny, Match: SenderRuleMatchExact, Value: "+31612345678"}},
+			sender: "+31687654321",
+			want:   true,
+		},
+		{
+			name:       "Denied by prefix",
+			rules:      []SenderRule{{Action: SenderRuleDeny, Match: SenderRuleMatchPrefix, Value: "+44"}},
+			sender:     "+447700900123",
+			want:       false,
+			wantReason: `denied by prefix rule "+44"`,
+		},
+		{
+			name:   "Shortcodes only",
+			rules:  []SenderRule{{Action: SenderRuleAllow, Match: SenderRuleMatchPattern, Value: `^\d{4,6}$`}},
+			sender: "4664",
+			want:   true,
+		},
+		{
+			name:       "Shortcodes only, from a number",
+			rules:      []SenderRule{{Action: SenderRuleAllow, Match: SenderRuleMatchPattern, Value: `^\d{4,6}$`}},
+			sender:     "+31612345678",
+			want:       false,
+			wantReason: "not matched by any allow rule",
+		},
+		{
+			name: "Deny wins over allow",
+			rules: []SenderRule{
+				{Action: SenderRuleAllow, Match: SenderRuleMatchPattern, Value: `^\d{4,6}$`},
+				{Action: SenderRuleDeny, Match: SenderRuleMatchExact, Value: "4664"},
+			},
+			sender:     "4664",
+			want:       false,
+			wantReason: `denied by exact rule "4664"`,
+		},
+		{
+			name:   "Email in any case",
+			rules:  []SenderRule{{Action: SenderRuleAllow, Match: SenderRuleMatchExact, Value: "No-Reply@Example.com"}},
+			sender: "no-reply@example.com",
+			want:   true,
+		},
+		{
+			name:       "Unknown sender with an allow list",
+			rules:      []SenderRule{{Action: SenderRuleAllow, Match: SenderRuleMatchPrefix, Value: "+31"}},
+			sender:     "",
+			want:       false,
+			wantReason: "not matched by any allow rule",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules, err := NewSenderRules(tt.rules...)
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			got, reason := rules.Allows(tt.sender)
+			assert.Equal(t, tt.want, got)
+			assert.Equal(t, tt.wantReason, reason)
+		})
+	}
+}
+
+func TestNewSenderRulesErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    SenderRule
+		wantErr error
+	}{
+		{
+			name:    "Invalid action",
+			rule:    SenderRule{Action: "block", Match: SenderRuleMatchExact, Value: "4664"},
+			wantErr: ErrSenderRuleInvalidAction,
+		},
+		{
+			name:    "Invalid match",
+			rule:    SenderRule{Action: SenderRuleDeny, Match: "glob", Value: "4664"},
+			wantErr: ErrSenderRuleInvalidMatch,
+		},
+		{
+			name:    "Empty value",
+			rule:    SenderRule{Action: SenderRuleDeny, Match: SenderRuleMatchExact},
+			wantErr: ErrSenderRuleEmptyValue,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewSenderRules(tt.rule)
+			assert.ErrorIs(t, err, tt.wantErr)
+		})
+	}
+
+	_, err := NewSenderRules(SenderRule{Action: SenderRuleDeny, Match: SenderRuleMatchPattern, Value: "("})
+	assert.Error(t, err)
+}
+
+func TestSenderRulesSaveAndLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sender-rules.json")
+
+	rules, err := LoadSenderRules(path)
+	if assert.NoError(t, err) {
+		assert.Empty(t, rules.Rules())
+	}
+
+	rules, err = NewSenderRules(
+		SenderRule{Action: SenderRuleAllow, Match: SenderRuleMatchPattern, Value: `^\d{4,6}$`},
+		SenderRule{Action: SenderRuleDeny, Match: SenderRuleMatchExact, Value: "4664"},
+	)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, rules.Save(path))
+
+	loaded, err := LoadSenderRules(path)
+	if assert.NoError(t, err) {
+		assert.Equal(t, rules, loaded)
+
+		allowed, _ := loaded.Allows("1234")
+		assert.True(t, allowed)
+	}
+}
+
+func TestLoadSenderRulesInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sender-rules.json")
+	if err := os.WriteFile(path, []byte(`{"rules":[{"action":"allow","match":"exact"}]}`), 0o600); err != nil {
+		t.Fatalf("writing rules: %v", err)
+	}
+
+	_, err := LoadSenderRules(path)
+	assert.ErrorIs(t, err, ErrSenderRuleEmptyValue)
+}
+
+func TestDenyAllSenderRules(t *testing.T) {
+	rules := DenyAllSenderRules("sender rules failed to load")
+
+	for _, sender := range []string{"Uber", "+31612345678", ""} {
+		allowed, reason := rules.Allows(sender)
+		assert.False(t, allowed, "sender %q", sender)
+		assert.Equal(t, "sender rules failed to load", reason)
+	}
+}
@@ -0,0 +1,106 @@
+package messagemonitor
+
+import (
+	"strings"
+	"time"
+)
+
+// Services a message can be received over, as recorded in the service column of chat.db.
+const (
+	ServiceSMS      = "SMS"
+	ServiceRCS      = "RCS"
+	ServiceIMessage = "iMessage"
+)
+
+// AllServices are all the services the monitor knows how to read messages from, and the
+// services it monitors by default.
+var AllServices = []string{ServiceSMS, ServiceRCS, ServiceIMessage}
+
+// MessageFilter says whether Messages filtered a message out of the main list of
+// conversations, and why.
+type MessageFilter string
+
+const (
+	// MessageFilterNone is used for messages Messages didn't filter.
+	MessageFilterNone MessageFilter = ""
+
+	// MessageFilterUnknownSender is used for messages filtered because they came from
+	// someone who isn't a contact, when "Filter Unknown Senders" is turned on. Most codes
+	// come from senders like this.
+	MessageFilterUnknownSender MessageFilter = "unknown_sender"
+
+	// MessageFilterJunk is used for messages Messages marked as junk.
+	MessageFilterJunk MessageFilter = "junk"
+)
+
+// Message is a message read from a MessageSource, normalised so the monitor doesn't need
+// to know where it came from.
+type Message struct {
+	// ID uniquely identifies the message within its source, e.g. the GUID in chat.db.
+	ID string
+
+	// Sender is the phone number, email address or short code the message came from. It
+	// is empty if the source doesn't know.
+	Sender string
+
+	// Service is the service the message was received over, e.g. ServiceSMS.
+	Service string
+
+	// ReceivedBy is the phone number or email address of the line the message was
+	// received on, which tells apart the SIMs of a dual-SIM phone, or a work number
+	// forwarded alongside a personal one. It is empty if the source doesn't know.
+	ReceivedBy string
+
+	// ReceivedAt is when the message was received.
+	ReceivedAt time.Time
+
+	// AttributedBody is the body of the message as an archived NSAttributedString, like
+	// the attributedBody column of chat.db. It is preferred over Text when present, as it
+	// carries the attributes Messages added to the message.
+	AttributedBody []byte
+
+	// Text is the plain text body of the message.
+	Text string
+
+	// FromMe is true for messages sent by the user, rather than received.
+	FromMe bool
+
+	// Filter says whether Messages filtered the message, e.g. MessageFilterJunk.
+	Filter MessageFilter
+
+	// cursor is where the message is in its source, used by the source to track which
+	// messages have been handled.
+	cursor int64
+}
+
+// MessageSource is somewhere the monitor can read messages from, like the Messages
+// database on macOS, or a file of recorded messages.
+type MessageSource interface {
+	// Open prepares the source to be read. It returns an error if the source can't be
+	// read, e.g. because Full Disk Access hasn't been granted to read chat.db.
+	Open() error
+
+	// Next returns the messages that have arrived since it was last called, oldest
+	// first. It returns no messages and no error if nothing new has arrived, and io.EOF
+	// once the source will never have any more messages.
+	Next() ([]*Message, error)
+
+	// Ack records that a message returned by Next has been handled, so sources that
+	// remember their position can make sure it is never handled again.
+	Ack(message *Message) error
+
+	// Close releases anything the source holds open.
+	Close() error
+}
+
+// normaliseService returns the canonical name of a service, so "sms" and "SMS" are
+// treated the same. Unknown services are returned as they are.
+func normaliseService(service string) string {
+	for _, known := range AllServices {
+		if strings.EqualFold(service, known) {
+			return known
+		}
+	}
+
+	return service
+}
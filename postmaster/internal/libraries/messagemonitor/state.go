@@ -0,0 +1,121 @@
+package messagemonitor
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	// stateDirectoryName is the directory, within the user's config directory, the
+	// monitor keeps its state in.
+	stateDirectoryName = "com.0xdeafcafe.pillar-box-postmaster"
+
+	// StateFileName is the name of the state file within the config directory.
+	StateFileName = "state.json"
+)
+
+// State is what the monitor needs to remember across restarts.
+type State struct {
+	// ChatDBRowID is the ROWID of the last message in chat.db that was handled.
+	ChatDBRowID int64 `json:"chat_db_row_id"`
+}
+
+// StateFile persists State to a JSON file.
+type StateFile struct {
+	mutex sync.Mutex
+	path  string
+}
+
+// DefaultConfigDir returns the directory the monitor keeps its state and configuration
+// in by default, which on macOS is
+// ~/Library/Application Support/com.0xdeafcafe.pillar-box-postmaster.
+func DefaultConfigDir() (string, error) {
+	dirname, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dirname, stateDirectoryName), nil
+}
+
+// DefaultStatePath returns where the monitor keeps its state by default, StateFileName
+// within the DefaultConfigDir.
+func DefaultStatePath() (string, error) {
+	dirname, err := DefaultConfigDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dirname, StateFileName), nil
+}
+
+// NewStateFile creates a StateFile that persists state to the file at path. The file,
+// and the directory it is in, are created the first time state is saved.
+func NewStateFile(path string) *StateFile {
+	return &StateFile{path: path}
+}
+
+// Load reads the state from the file. If the file doesn't exist yet, the zero State is
+// returned.
+func (f *StateFile) Load() (*State, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	buf, err := os.ReadFile(f.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return &State{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	state := &State{}
+	if err := json.Unmarshal(buf, state); err != nil {
+		return nil, err
+	}
+
+	return state, nil
+}
+
+// Save writes the state to the file. A crash part way through never leaves a truncated
+// state file behind, see writeFileAtomically.
+func (f *StateFile) Save(state *State) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	buf, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomically(f.path, buf)
+}
+
+// writeFileAtomically writes buf to a temporary file next to path, then renames it over
+// path, so readers only ever see the old or new contents. The directory holding path is
+// created if needed.
+func writeFileAtomically(path string, buf []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(buf); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
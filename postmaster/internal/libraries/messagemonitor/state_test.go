@@ -0,0 +1,39 @@
+package messagemonitor
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStateFile(t *testing.T) {
+	dir := t.TempDir()
+	stateFile := NewStateFile(filepath.Join(dir, "nested", "state.json"))
+
+	state, err := stateFile.Load()
+	assert.NoError(t, err)
+	assert.Equal(t, &State{}, state)
+
+	assert.NoError(t, stateFile.Save(&State{ChatDBRowID: 42}))
+
+	state, err = NewStateFile(filepath.Join(dir, "nested", "state.json")).Load()
+	assert.NoError(t, err)
+	assert.Equal(t, &State{ChatDBRowID: 42}, state)
+
+	// No temporary files are left behind.
+	entries, err := os.ReadDir(filepath.Join(dir, "nested"))
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
+
+func TestStateFileCorrupt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	if err := os.WriteFile(path, []byte("{"), 0o600); err != nil {
+		t.Fatalf("writing state: %v", err)
+	}
+
+	_, err := NewStateFile(path).Load()
+	assert.Error(t, err)
+}
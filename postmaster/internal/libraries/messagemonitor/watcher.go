@@ -0,0 +1,147 @@
+package messagemonitor
+
+import (
+	"log"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+const (
+	// DefaultDebounceInterval is how long a watcher waits after a file changes before
+	// waking the monitor, so a burst of writes to the database only wakes it once.
+	DefaultDebounceInterval = 50 * time.Millisecond
+
+	// DefaultSafetyPollInterval is how often the monitor reads from a source that tells
+	// it when there are new messages anyway, in case a change was missed.
+	DefaultSafetyPollInterval = 30 * time.Second
+)
+
+// NotifyingSource is a MessageSource that can say when it may have new messages, so the
+// monitor doesn't have to keep asking.
+type NotifyingSource interface {
+	MessageSource
+
+	// Changes returns a channel that receives a value whenever new messages may be
+	// available. It returns nil if the source can't currently tell, in which case the
+	// monitor falls back to polling.
+	Changes() <-chan struct{}
+}
+
+// fileWatcher watches a set of files, and signals on its changes channel shortly after
+// any of them is written to, created, removed or renamed.
+//
+// The directories holding the files are watched rather than the files themselves, as
+// SQLite creates and removes the -wal and -shm files as it goes.
+type fileWatcher struct {
+	watcher  *fsnotify.Watcher
+	logger   *log.Logger
+	names    map[string]bool
+	debounce time.Duration
+
+	changes chan struct{}
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+func newFileWatcher(logger *log.Logger, debounce time.Duration, paths ...string) (*fileWatcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	w := &fileWatcher{
+		watcher:  watcher,
+		logger:   logger,
+		names:    make(map[string]bool, len(paths)),
+		debounce: debounce,
+		changes:  make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+
+	dirs := make(map[string]bool)
+	for _, path := range paths {
+		path = filepath.Clean(path)
+		w.names[path] = true
+
+		dir := filepath.Dir(path)
+		if dirs[dir] {
+			continue
+		}
+
+		if err := watcher.Add(dir); err != nil {
+			watcher.Close()
+			return nil, err
+		}
+
+		dirs[dir] = true
+	}
+
+	w.wg.Add(1)
+	go w.run()
+
+	return w, nil
+}
+
+// Changes returns the channel that is signalled when the watched files change.
+func (w *fileWatcher) Changes() <-chan struct{} {
+	return w.changes
+}
+
+// Close stops watching and waits for the watcher to finish.
+func (w *fileWatcher) Close() error {
+	close(w.done)
+	err := w.watcher.Close()
+	w.wg.Wait()
+
+	return err
+}
+
+func (w *fileWatcher) run() {
+	defer w.wg.Done()
+
+	// The debounce timer is only running while a change is waiting to be signalled.
+	debounce := time.NewTimer(w.debounce)
+	if !debounce.Stop() {
+		<-debounce.C
+	}
+	pending := false
+
+	for {
+		select {
+		case <-w.done:
+			debounce.Stop()
+			return
+		case event, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+			if !w.names[filepath.Clean(event.Name)] || event.Op == fsnotify.Chmod {
+				continue
+			}
+			if pending {
+				continue
+			}
+
+			pending = true
+			debounce.Reset(w.debounce)
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+
+			w.logger.Printf("file watcher error: %v", err)
+		case <-debounce.C:
+			pending = false
+
+			// The channel holds one signal, so if the monitor hasn't picked up the last
+			// one yet there's no need to queue another.
+			select {
+			case w.changes <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
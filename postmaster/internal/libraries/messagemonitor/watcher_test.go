@@ -0,0 +1,122 @@
+package messagemonitor
+
+import (
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// waitForChange reports whether changes is signalled within timeout.
+func waitForChange(changes <-chan struct{}, timeout time.Duration) bool {
+	select {
+	case <-changes:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func TestFileWatcherDebouncesBursts(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "chat.db")
+
+	watcher, err := newFileWatcher(log.Default(), 100*time.Millisecond, path, path+"-wal")
+	if err != nil {
+		t.Fatalf("creating watcher: %v", err)
+	}
+	defer watcher.Close()
+
+	for i := 0; i < 10; i++ {
+		if err := os.WriteFile(path+"-wal", []byte{byte(i)}, 0o600); err != nil {
+			t.Fatalf("writing file: %v", err)
+		}
+	}
+
+	assert.True(t, waitForChange(watcher.Changes(), time.Second))
+	assert.False(t, waitForChange(watcher.Changes(), 300*time.Millisecond), "burst should only signal once")
+}
+
+func TestFileWatcherIgnoresOtherFiles(t *testing.T) {
+	dir := t.TempDir()
+
+	watcher, err := newFileWatcher(log.Default(), 10*time.Millisecond, filepath.Join(dir, "chat.db"))
+	if err != nil {
+		t.Fatalf("creating watcher: %v", err)
+	}
+	defer watcher.Close()
+
+	if err := os.WriteFile(filepath.Join(dir, "other.db"), []byte("x"), 0o600); err != nil {
+		t.Fatalf("writing file: %v", err)
+	}
+
+	assert.False(t, waitForChange(watcher.Changes(), 200*time.Millisecond))
+}
+
+func TestChatDBSourceWatchesDatabase(t *testing.T) {
+	db, dbPath := newTestChatDB(t)
+	if _, err := db.Exec("PRAGMA journal_mode=WAL;"); err != nil {
+		t.Fatalf("enabling wal: %v", err)
+	}
+
+	source, err := NewChatDBSourceAtPath(dbPath, nil)
+	if err != nil {
+		t.Fatalf("creating source: %v", err)
+	}
+	defer source.Close()
+
+	assert.NoError(t, source.Open())
+	if !assert.NotNil(t, source.Changes()) {
+		return
+	}
+
+	insertTestMessage(t, db, "new", ServiceSMS, "Your code is 1234", 1)
+
+	assert.True(t, waitForChange(source.Changes(), 2*time.Second))
+
+	messages, err := source.Next()
+	if assert.NoError(t, err) && assert.Len(t, messages, 1) {
+		assert.Equal(t, "new", messages[0].ID)
+	}
+}
+
+func TestListenAndHandleWakesOnChange(t *testing.T) {
+	source := NewMemorySource()
+
+	m := New(source)
+	// Long enough that the test can only pass if the monitor is woken by the source.
+	m.SetPollInterval(time.Hour)
+	m.SetSafetyPollInterval(time.Hour)
+
+	codes := make(chan string, 1)
+	m.RegisterDetectionHandler(func(detection *Detection) {
+		codes <- detection.Code
+	})
+
+	done := make(chan struct{})
+	go func() {
+		m.ListenAndHandle(context.Background())
+		close(done)
+	}()
+
+	source.Push(&Message{ID: "1", Service: ServiceSMS, Text: "Your code is 4821"})
+
+	select {
+	case code := <-codes:
+		assert.Equal(t, "4821", code)
+	case <-time.After(2 * time.Second):
+		t.Fatal("code was not dispatched")
+	}
+
+	source.Close()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("monitor did not stop after the source was closed")
+	}
+}
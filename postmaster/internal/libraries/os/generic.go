@@ -1,23 +1,33 @@
 package os
 
 import (
-	"fmt"
-	"runtime"
+	"context"
+	"log"
 
 	"github.com/0xdeafcafe/pillar-box/server/internal/libraries/messagemonitor"
 )
 
 type OS interface {
-	HandleMFACode(mfaCode string)
+	HandleMFACode(detection *messagemonitor.Detection)
 	HandleNoAccess()
 	HandleNewVersionAvailable(name, version, url string)
-	Run()
-}
 
-func New(monitor *messagemonitor.MessageMonitor, debug bool) (OS, error) {
-	if runtime.GOOS == "darwin" {
-		return NewMacOS(monitor, debug), nil
-	}
+	// HandleBroadcasterError tells the user the broadcaster has stopped, so codes won't
+	// reach the browser extension, e.g. because its port is taken by another app.
+	HandleBroadcasterError(err error)
+
+	// HandleSenderRulesError tells the user their sender rules couldn't be loaded, so
+	// every sender is denied until they're fixed.
+	HandleSenderRulesError(err error)
+
+	// Run runs the user interface, which has to be done on the main goroutine, until ctx
+	// is done or the user quits. Either way shutdown is called to stop the rest of the
+	// app before the process exits.
+	Run(ctx context.Context, shutdown func() error) error
+}
 
-	return nil, fmt.Errorf("unsupported OS: %s, only darwin is supported", runtime.GOOS)
+// New creates the OS for the platform the app was built for, see newPlatformOS. Only
+// macOS has a user interface, and everywhere else runs Headless.
+func New(monitor *messagemonitor.MessageMonitor, logger *log.Logger, debug bool) (OS, error) {
+	return newPlatformOS(monitor, logger, debug)
 }
@@ -0,0 +1,47 @@
+package os
+
+import (
+	"context"
+	"log"
+
+	"github.com/0xdeafcafe/pillar-box/server/internal/libraries/messagemonitor"
+)
+
+// Headless is an OS without a user interface, for running Pillar Box in the background
+// or in tests. Codes are still broadcast, there's just nowhere to show them.
+type Headless struct {
+	logger *log.Logger
+}
+
+// NewHeadless creates a new Headless instance, which logs what would otherwise be shown
+// to the user.
+func NewHeadless(logger *log.Logger) *Headless {
+	return &Headless{logger: logger}
+}
+
+func (h *Headless) HandleMFACode(detection *messagemonitor.Detection) {
+	h.logger.Printf("code detected message_id:%s issuer:%q service:%s", detection.MessageID, detection.Issuer, detection.Service)
+}
+
+func (h *Headless) HandleNoAccess() {
+	h.logger.Printf("no access to messages, grant Full Disk Access in System Settings > Security & Privacy > Full Disk Access")
+}
+
+func (h *Headless) HandleNewVersionAvailable(name, version, url string) {
+	h.logger.Printf("new version available name:%q version:%s url:%s", name, version, url)
+}
+
+func (h *Headless) HandleBroadcasterError(err error) {
+	h.logger.Printf("broadcaster stopped, codes won't reach the browser extension: %v", err)
+}
+
+func (h *Headless) HandleSenderRulesError(err error) {
+	h.logger.Printf("sender rules failed to load, no codes will be handled until they're fixed: %v", err)
+}
+
+// Run waits for ctx to be done, then shuts the app down.
+func (h *Headless) Run(ctx context.Context, shutdown func() error) error {
+	<-ctx.Done()
+
+	return shutdown()
+}
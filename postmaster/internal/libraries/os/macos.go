@@ -1,18 +1,29 @@
+//go:build darwin
+
 package os
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
+	goos "os"
 	"os/exec"
 	"time"
 
 	"github.com/caseymrm/menuet"
 	"golang.design/x/clipboard"
 
+	"github.com/0xdeafcafe/pillar-box/server/internal/libraries/broadcaster"
 	"github.com/0xdeafcafe/pillar-box/server/internal/libraries/messagemonitor"
 	"github.com/0xdeafcafe/pillar-box/server/internal/libraries/updater"
 )
 
+// newPlatformOS creates the menu bar app.
+func newPlatformOS(monitor *messagemonitor.MessageMonitor, logger *log.Logger, debug bool) (OS, error) {
+	return NewMacOS(monitor, logger, debug), nil
+}
+
 type UndefinedBool int
 
 const (
@@ -27,6 +38,7 @@ const (
 type MacOS struct {
 	debug   bool
 	monitor *messagemonitor.MessageMonitor
+	logger  *log.Logger
 
 	updater *updater.Updater
 
@@ -41,28 +53,34 @@ type MacOSPreferences struct {
 
 type MacOSLatestCode struct {
 	DetectedAt time.Time
+	ExpiresAt  time.Time
 	MFACode    string
+	Issuer     string
+	Service    string
 }
 
 // New creates a new MacOS instance. The MacOS instance is responsible for managing the
 // macOS menu bar application and rendering the menu items. The MacOS instance is also
 // responsible for handling MFA codes detected by the MessageMonitor, displaying them
 // in the menu, and copying them to the clipboard.
-func NewMacOS(monitor *messagemonitor.MessageMonitor, debug bool) *MacOS {
+func NewMacOS(monitor *messagemonitor.MessageMonitor, logger *log.Logger, debug bool) *MacOS {
 	err := clipboard.Init()
 	if err != nil {
-		log.Printf("failed to initialize clipboard: %v", err)
+		logger.Printf("failed to initialize clipboard: %v", err)
 	}
 
 	macos := &MacOS{
 		debug:   debug,
 		monitor: monitor,
+		logger:  logger,
 
 		updater: updater.New(),
 
 		preferences: &MacOSPreferences{},
 	}
 
+	macos.updater.SetLogger(logger)
+
 	updater := updater.New()
 	updater.RegisterNewVersionAvailableHandler(macos.HandleNewVersionAvailable)
 	updater.RegisterGetPrereleasePreferenceHandler(func() bool {
@@ -72,18 +90,27 @@ func NewMacOS(monitor *messagemonitor.MessageMonitor, debug bool) *MacOS {
 	return macos
 }
 
-func (m *MacOS) HandleMFACode(mfaCode string) {
+func (m *MacOS) HandleMFACode(detection *messagemonitor.Detection) {
+	mfaCode := detection.Code
 	m.latestCode = &MacOSLatestCode{
-		DetectedAt: time.Now(),
+		DetectedAt: detection.DetectedAt,
+		ExpiresAt:  detection.ExpiresAt,
 		MFACode:    mfaCode,
+		Issuer:     detection.Issuer,
+		Service:    detection.Service,
 	}
 
 	if m.preferences.CopyCodeToClipboard {
 		clipboard.Write(clipboard.FmtText, []byte(mfaCode))
 
+		title := "New code detected"
+		if detection.Issuer != "" {
+			title = fmt.Sprintf("New %s code detected", detection.Issuer)
+		}
+
 		menuet.App().Notification(menuet.Notification{
-			Title:                        "New code detected",
-			Subtitle:                     fmt.Sprintf("Code: %s", mfaCode),
+			Title:                        title,
+			Subtitle:                     fmt.Sprintf("Code: %s (%s)", mfaCode, detection.Service),
 			Message:                      "Copied to clipboard",
 			RemoveFromNotificationCenter: true,
 		})
@@ -102,10 +129,10 @@ func (m *MacOS) HandleNoAccess() {
 	if response.Button == 0 {
 		cmd := exec.Command("open", "x-apple.systempreferences:com.apple.preference.security?Privacy_AllFiles")
 
-		log.Printf("opening system preferences: %v", cmd)
+		m.logger.Printf("opening system preferences: %v", cmd)
 
 		if err := cmd.Run(); err != nil {
-			log.Printf("failed to open system preferences: %v", err)
+			m.logger.Printf("failed to open system preferences: %v", err)
 		}
 	}
 }
@@ -119,22 +146,79 @@ func (m *MacOS) HandleNewVersionAvailable(name, version, url string) {
 	if response.Button == 0 {
 		cmd := exec.Command("open", url)
 
-		log.Printf("opening browser: %v", cmd)
+		m.logger.Printf("opening browser: %v", cmd)
 
 		if err := cmd.Run(); err != nil {
-			log.Printf("failed to open browser: %v", err)
+			m.logger.Printf("failed to open browser: %v", err)
 		}
 	}
 }
 
-func (m *MacOS) Run() {
-	m.updater.StartBackgroundChecker()
+func (m *MacOS) HandleBroadcasterError(err error) {
+	informativeText := fmt.Sprintf("Codes won't reach the browser extension until Pillar Box is restarted: %v", err)
+	if errors.Is(err, broadcaster.ErrAddressInUse) {
+		informativeText = "The port codes are sent to the browser extension on is in use by another app, or another copy of Pillar Box. Quit it and restart Pillar Box."
+	}
+
+	menuet.App().Alert(menuet.Alert{
+		MessageText:     "Pillar Box can't send codes to your browser",
+		InformativeText: informativeText,
+		Buttons:         []string{"OK"},
+	})
+}
+
+func (m *MacOS) HandleSenderRulesError(err error) {
+	menuet.App().Alert(menuet.Alert{
+		MessageText:     "Pillar Box couldn't read your sender rules",
+		InformativeText: fmt.Sprintf("No codes will be detected until the sender rules are fixed and Pillar Box is restarted: %v", err),
+		Buttons:         []string{"OK"},
+	})
+}
+
+// Run runs the menu bar app. RunApplication never returns, so once the app has shut down
+// the process is exited here, whether the user quit or ctx is done.
+func (m *MacOS) Run(ctx context.Context, shutdown func() error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	m.updater.StartBackgroundChecker(ctx)
+
+	// When the user quits from the menu, menuet cancels its context and waits on its
+	// wait group before terminating.
+	quitWG, quitCtx := menuet.App().GracefulShutdownHandles()
+	quitWG.Add(1)
+
+	go func() {
+		defer quitWG.Done()
+
+		select {
+		case <-quitCtx.Done():
+			m.logger.Printf("quit from the menu, shutting down")
+		case <-ctx.Done():
+			m.logger.Printf("shutting down")
+		}
+
+		cancel()
+
+		err := shutdown()
+		m.updater.Wait()
+
+		if err != nil {
+			m.logger.Printf("failed to shut down cleanly: %v", err)
+			goos.Exit(1)
+		}
+		if quitCtx.Err() == nil {
+			goos.Exit(0)
+		}
+	}()
 
 	m.renderMenu()
 
 	m.preferences.CopyCodeToClipboard = readAndSanitiseBoolPref(prefCopyCodeToClipboard)
 
 	menuet.App().RunApplication()
+
+	return nil
 }
 
 func (m *MacOS) renderMenu() {
@@ -172,8 +256,19 @@ func (m *MacOS) createLatestDiscoveredMenuItem() menuet.MenuItem {
 		}
 	}
 
+	code := m.latestCode.MFACode
+	if m.latestCode.Issuer != "" {
+		code = fmt.Sprintf("%s from %s", code, m.latestCode.Issuer)
+	}
+
+	if time.Now().After(m.latestCode.ExpiresAt) {
+		return menuet.MenuItem{
+			Text: fmt.Sprintf("Latest discovered code: %s (expired)", code),
+		}
+	}
+
 	return menuet.MenuItem{
-		Text: fmt.Sprintf("Latest discovered code: %s", m.latestCode.MFACode),
+		Text: fmt.Sprintf("Latest discovered code: %s", code),
 	}
 }
 
@@ -221,8 +316,8 @@ func (m *MacOS) cretePrereleaseUpdatesMenuItem() menuet.MenuItem {
 			m.preferences.GetPrereleaseUpdates = newState
 			menuet.Defaults().SetBoolean(prefGetPrereleaseUpdates, newState)
 
-			if err := m.updater.CheckForUpdates(); err != nil {
-				log.Printf("failed to check for updates: %v", err)
+			if err := m.updater.CheckForUpdates(context.Background()); err != nil {
+				m.logger.Printf("failed to check for updates: %v", err)
 			}
 		},
 	}
@@ -0,0 +1,18 @@
+//go:build !darwin
+
+package os
+
+import (
+	"log"
+	"runtime"
+
+	"github.com/0xdeafcafe/pillar-box/server/internal/libraries/messagemonitor"
+)
+
+// newPlatformOS falls back to Headless, as there's no user interface for anything but
+// macOS.
+func newPlatformOS(monitor *messagemonitor.MessageMonitor, logger *log.Logger, debug bool) (OS, error) {
+	logger.Printf("no user interface for %s, running headless", runtime.GOOS)
+
+	return NewHeadless(logger), nil
+}
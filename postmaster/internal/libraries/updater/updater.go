@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"sync"
 	"time"
 
 	semver "github.com/Masterminds/semver/v3"
@@ -25,6 +26,8 @@ type NewVersionAvailableFunc func(name, version, url string)
 
 type Updater struct {
 	githubClient *github.Client
+	logger       *log.Logger
+	wg           sync.WaitGroup
 
 	registeredGetPrereleasePreferenceHandler GetPrereleasePreferenceFunc
 	registeredNewVersionAvailableHandler     NewVersionAvailableFunc
@@ -33,9 +36,15 @@ type Updater struct {
 func New() *Updater {
 	return &Updater{
 		githubClient: github.NewClient(nil),
+		logger:       log.Default(),
 	}
 }
 
+// SetLogger sets the logger the updater logs to. It defaults to the standard logger.
+func (u *Updater) SetLogger(logger *log.Logger) {
+	u.logger = logger
+}
+
 func (u *Updater) RegisterGetPrereleasePreferenceHandler(handler GetPrereleasePreferenceFunc) {
 	u.registeredGetPrereleasePreferenceHandler = handler
 }
@@ -44,7 +53,7 @@ func (u *Updater) RegisterNewVersionAvailableHandler(handler NewVersionAvailable
 	u.registeredNewVersionAvailableHandler = handler
 }
 
-func (u *Updater) CheckForUpdates() error {
+func (u *Updater) CheckForUpdates(ctx context.Context) error {
 	semverVersion, err := semver.NewVersion(Version)
 	if err != nil {
 		return fmt.Errorf("failed to parse version: %w", err)
@@ -55,7 +64,7 @@ func (u *Updater) CheckForUpdates() error {
 		prerelease = u.registeredGetPrereleasePreferenceHandler()
 	}
 
-	release, err := u.getGitHubRelease(prerelease)
+	release, err := u.getGitHubRelease(ctx, prerelease)
 	if err != nil {
 		if errGithub, ok := err.(*github.ErrorResponse); ok && errGithub.Response.StatusCode == 404 {
 			return errors.New("no release found")
@@ -76,7 +85,7 @@ func (u *Updater) CheckForUpdates() error {
 	}
 
 	if semverVersion.LessThan(latestVersion) {
-		log.Printf("new version available: %s", latestVersion.String())
+		u.logger.Printf("new version available: %s", latestVersion.String())
 
 		if u.registeredNewVersionAvailableHandler != nil {
 			u.registeredNewVersionAvailableHandler(
@@ -90,31 +99,50 @@ func (u *Updater) CheckForUpdates() error {
 	return nil
 }
 
-func (u *Updater) StartBackgroundChecker() {
+// StartBackgroundChecker checks for updates in the background, daily, or hourly while
+// checks are failing, until ctx is done. Use Wait to wait for it to stop.
+func (u *Updater) StartBackgroundChecker(ctx context.Context) {
+	u.wg.Add(1)
+
 	go func() {
+		defer u.wg.Done()
 		defer func() {
 			if r := recover(); r != nil {
-				log.Printf("recovered from panic: %v", r)
+				u.logger.Printf("recovered from panic: %v", r)
 			}
 		}()
 
 		for {
-			if err := u.CheckForUpdates(); err != nil {
-				log.Printf("failed or unable to check for updates, sleeping for an hour: %v", err)
-				time.Sleep(time.Hour)
-
-				continue
+			interval := 24 * time.Hour
+			if err := u.CheckForUpdates(ctx); err != nil {
+				u.logger.Printf("failed or unable to check for updates, sleeping for an hour: %v", err)
+				interval = time.Hour
+			} else {
+				u.logger.Println("no update available, sleeping for 24 hours")
 			}
 
-			log.Println("no update available, sleeping for 24 hours")
-			time.Sleep(24 * time.Hour)
+			timer := time.NewTimer(interval)
+
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				u.logger.Println("stopping background update checker")
+
+				return
+			case <-timer.C:
+			}
 		}
 	}()
 }
 
-func (u *Updater) getGitHubRelease(prerelease bool) (*github.RepositoryRelease, error) {
+// Wait waits for the background checker to stop.
+func (u *Updater) Wait() {
+	u.wg.Wait()
+}
+
+func (u *Updater) getGitHubRelease(ctx context.Context, prerelease bool) (*github.RepositoryRelease, error) {
 	if prerelease {
-		releases, _, err := u.githubClient.Repositories.ListReleases(context.Background(), githubOwner, githubRepo, nil)
+		releases, _, err := u.githubClient.Repositories.ListReleases(ctx, githubOwner, githubRepo, nil)
 		if err != nil {
 			return nil, err
 		}
@@ -126,7 +154,7 @@ func (u *Updater) getGitHubRelease(prerelease bool) (*github.RepositoryRelease,
 	}
 
 	// Fetch latest release if not pre-release
-	release, _, err := u.githubClient.Repositories.GetLatestRelease(context.Background(), githubOwner, githubRepo)
+	release, _, err := u.githubClient.Repositories.GetLatestRelease(ctx, githubOwner, githubRepo)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,97 @@
+package updater
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/v68/github"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/goleak"
+)
+
+// newTestUpdater creates an Updater that talks to a fake GitHub API serving handler.
+func newTestUpdater(t *testing.T, handler http.HandlerFunc) *Updater {
+	t.Helper()
+
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	baseURL, err := url.Parse(server.URL + "/")
+	if err != nil {
+		t.Fatalf("parsing server url: %v", err)
+	}
+
+	u := New()
+	u.githubClient = github.NewClient(server.Client())
+	u.githubClient.BaseURL = baseURL
+
+	return u
+}
+
+func TestCheckForUpdates(t *testing.T) {
+	u := newTestUpdater(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/repos/0xdeafcafe/pillar-box/releases/latest", r.URL.Path)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"name":"Pillar Box 1.2.3","tag_name":"v1.2.3","html_url":"https://example.com/1.2.3"}`))
+	})
+
+	var got []string
+	u.RegisterNewVersionAvailableHandler(func(name, version, url string) {
+		got = []string{name, version, url}
+	})
+
+	assert.NoError(t, u.CheckForUpdates(context.Background()))
+	assert.Equal(t, []string{"Pillar Box 1.2.3", "1.2.3", "https://example.com/1.2.3"}, got)
+}
+
+func TestCheckForUpdatesNoRelease(t *testing.T) {
+	u := newTestUpdater(t, func(w http.ResponseWriter, r *http.Request) {
+		http.NotFound(w, r)
+	})
+
+	assert.EqualError(t, u.CheckForUpdates(context.Background()), "no release found")
+}
+
+func TestStartBackgroundCheckerStops(t *testing.T) {
+	// Checked as the last cleanup, once the fake API has been shut down.
+	ignore := goleak.IgnoreCurrent()
+	t.Cleanup(func() { goleak.VerifyNone(t, ignore) })
+
+	checked := make(chan struct{}, 1)
+	u := newTestUpdater(t, func(w http.ResponseWriter, r *http.Request) {
+		http.NotFound(w, r)
+
+		select {
+		case checked <- struct{}{}:
+		default:
+		}
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	u.StartBackgroundChecker(ctx)
+
+	select {
+	case <-checked:
+	case <-time.After(2 * time.Second):
+		t.Fatal("background checker did not check for updates")
+	}
+
+	cancel()
+
+	done := make(chan struct{})
+	go func() {
+		u.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("background checker did not stop after the context was cancelled")
+	}
+}
@@ -5,15 +5,56 @@ import (
 	"regexp"
 	"sort"
 	"strings"
+	"time"
 )
 
 const (
 	backwardsContextWindow = 60
+
+	// forwardsContextWindow is how far after a code we look for context indicators, for
+	// messages that give the code first, e.g. "1234 is your code". It is shorter than
+	// backwardsContextWindow and stops at the end of the sentence, as the text after a
+	// code is more often about something else.
+	forwardsContextWindow = 30
+
+	// indicatorScore is added to a code's score for every context indicator near it.
+	indicatorScore = 5
+
+	// leadInContextWindow is how far back from a letter-only or word-like candidate we
+	// look for a phrase like "code:" that introduces it. It is deliberately much tighter
+	// than backwardsContextWindow, as those codes are otherwise indistinguishable from
+	// ordinary words.
+	leadInContextWindow = 30
 )
 
 var (
 	codeRegexPattern = regexp.MustCompile(`(?i)(G-\d{6}|\d{3,4}-\d{3,4}|\b\d{4,7}\b)`)
 
+	// alphanumericCodeRegexPattern matches codes made up of letters and/or digits, either
+	// as one block ("F7K2Q") or as two dash separated groups ("ABC-DEF", "K9X-44P").
+	// Candidates are filtered further by isPlausibleAlphanumericCode.
+	alphanumericCodeRegexPattern = regexp.MustCompile(`\b([A-Za-z0-9]{3,4}-[A-Za-z0-9]{3,4}|[A-Za-z0-9]{4,8})\b`)
+
+	// codeLeadInPattern must match the text directly in front of a letter-only or
+	// word-like candidate for it to be considered a code, e.g. "Your code: ABCDEF".
+	codeLeadInPattern = regexp.MustCompile(`(?i)(code|passcode|password|pin)( is)?\s*[:\-]?\s*$`)
+
+	// wordThenNumberPattern matches mixed tokens made up of a word followed by a number,
+	// which are more often names ("iPhone15", "Windows11", "COVID19") than codes.
+	wordThenNumberPattern = regexp.MustCompile(`^[A-Za-z]+\d+$`)
+
+	// unitSuffixPattern matches digits followed by a unit or ordinal suffix, which are
+	// mixed alphanumeric tokens that are never codes ("10min", "20th", "5pm", "2FA").
+	unitSuffixPattern = regexp.MustCompile(`(?i)^\d+(st|nd|rd|th|am|pm|h|hr|hrs|m|min|mins|s|sec|secs|kb|mb|gb|fa)$`)
+
+	// uppercaseStopWords are uppercase words that commonly appear in SMS messages and
+	// should never be treated as letter-only codes, even after a lead-in phrase.
+	uppercaseStopWords = map[string]bool{
+		"CODE": true, "NEVER": true, "SHARE": true, "STOP": true, "HELP": true, "INFO": true,
+		"FREE": true, "TEXT": true, "REPLY": true, "ONLY": true, "YOUR": true, "THIS": true,
+		"WITH": true, "FROM": true, "NOTE": true, "URGENT": true, "ALERT": true,
+	}
+
 	// contextIndicators is a set of phrases that, if found near the code, increase the
 	// "likelihood" score for that code.
 	contextIndicators = []string{
@@ -38,6 +79,8 @@ var (
 		"google verification code",
 		"twitter login code",
 		"tesco authentication code",
+		"steam guard code",
+		"security code",
 	}
 
 	ErrNoCodesFound = errors.New("no codes found")
@@ -51,22 +94,99 @@ type codeHit struct {
 	// index is the position in the text where the code was found in the text
 	index int
 
+	// end is the position in the text directly after the raw matched code
+	end int
+
 	// score is a computed "likelihood" score for this code
 	score int
+
+	// indicators are the context indicators that added to the score
+	indicators []string
+
+	// penalties are the names of the penalties that took away from the score
+	penalties []string
+
+	// origin is set when this is the code from an origin-bound line
+	origin *OriginBoundCode
+}
+
+// Candidate is a code discovered in a message, along with everything the scorer knew
+// about it when ranking it.
+type Candidate struct {
+	// Code is the normalized code, with prefixes like "G-" and any dashes removed.
+	Code string
+
+	// Raw is the text that was matched in the message, e.g. "G-089350".
+	Raw string
+
+	// Start and End are the byte offsets of Raw within the message.
+	Start int
+	End   int
+
+	// Score is the "likelihood" score the candidate was ranked by.
+	Score int
+
+	// Confidence is the score mapped on to a value between 0 and 1.
+	Confidence float64
+
+	// Indicators are the context indicators found near the code that raised its score.
+	Indicators []string
+
+	// Penalties are the names of the penalties that lowered its score, e.g. "amount".
+	Penalties []string
+
+	// Issuer is the name of the service that sent the message, if it could be found. It
+	// is the same for every candidate from a message, see ExtractIssuer.
+	Issuer string
+
+	// Expiry is how long the message says the code is valid for, or zero if it doesn't
+	// say. It is the same for every candidate from a message, see ExtractExpiry.
+	Expiry time.Duration
+
+	// Origin is set when the code was bound to a website by the message, and holds the
+	// domains it should be restricted to. Origin-bound codes always rank first.
+	Origin *OriginBoundCode
 }
 
 // ExtractCodes attempts to find all 2FA codes in the provided text,
 // ranks them by "likelihood", removes duplicates, and returns them
-// in descending order of likelihood.
+// in descending order of likelihood. The locale packs used for ranking are detected from
+// the text, see DetectLocales. Numbers that look like amounts, dates, phone numbers or
+// card suffixes are penalised, and if nothing is left that reaches the minimum score
+// ErrNoCodesFound is returned rather than a guess.
 func ExtractCodes(text string) ([]string, error) {
-	text = strings.TrimSpace(text)
-	matchIndexes := codeRegexPattern.FindAllStringIndex(text, -1)
-	if len(matchIndexes) == 0 {
-		return nil, errors.New("no codes found")
+	return ExtractCodesForLocales(text, DetectLocales(text)...)
+}
+
+// ExtractCodesForLocales is like ExtractCodes, but ranks codes using the context
+// indicators of the given locale packs instead of detecting them.
+func ExtractCodesForLocales(text string, locales ...Locale) ([]string, error) {
+	candidates, err := ExtractCandidatesForLocales(text, locales...)
+	if err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, 0, len(candidates))
+	for _, c := range candidates {
+		codes = append(codes, c.Code)
 	}
 
+	return codes, nil
+}
+
+// ExtractCandidates works like ExtractCodes, but returns the ranked candidates with
+// their scores and the reasons behind them rather than just the codes.
+func ExtractCandidates(text string) ([]Candidate, error) {
+	return ExtractCandidatesForLocales(text, DetectLocales(text)...)
+}
+
+// ExtractCandidatesForLocales is like ExtractCandidates, but ranks codes using the
+// context indicators of the given locale packs instead of detecting them.
+func ExtractCandidatesForLocales(text string, locales ...Locale) ([]Candidate, error) {
+	indicators := indicatorsForLocales(locales)
+
 	var codeHits []codeHit
-	for _, m := range matchIndexes {
+	for _, m := range codeRegexPattern.FindAllStringIndex(text, -1) {
 		raw := text[m[0]:m[1]]
 
 		code := sanitizeCode(raw)
@@ -78,20 +198,79 @@ func ExtractCodes(text string) ([]string, error) {
 		ch := codeHit{
 			code:  code,
 			index: m[0],
+			end:   m[1],
 			score: 0, // will compute next
 		}
 
 		codeHits = append(codeHits, ch)
 	}
 
+	for _, m := range alphanumericCodeRegexPattern.FindAllStringIndex(text, -1) {
+		if overlapsCodeHit(codeHits, m) {
+			continue
+		}
+
+		code := sanitizeAlphanumericCode(text[m[0]:m[1]])
+		if !isPlausibleAlphanumericCode(text, m, code) {
+			continue
+		}
+
+		codeHits = append(codeHits, codeHit{
+			code:  code,
+			index: m[0],
+			end:   m[1],
+			score: 0, // will compute next
+		})
+	}
+
+	// Anything inside an Android SMS Retriever app hash is part of the hash, not a code.
+	if hash, hashStart, ok := findAndroidAppHash(text); ok {
+		codeHits = removeOverlappingCodeHits(codeHits, []int{hashStart, hashStart + len(hash)})
+	}
+
+	// An origin-bound code is the sender telling us exactly which code to use, so it
+	// replaces whatever the patterns found in the same place.
+	if bound, ok := ParseOriginBoundCode(text); ok {
+		codeHits = removeOverlappingCodeHits(codeHits, []int{bound.Start, bound.End})
+		codeHits = append(codeHits, codeHit{
+			code:   bound.Code,
+			index:  bound.Start,
+			end:    bound.End,
+			score:  0, // will compute next
+			origin: bound,
+		})
+	}
+
 	if len(codeHits) == 0 {
 		return nil, ErrNoCodesFound
 	}
 
 	// Score each codeHit based on textual context around it.
-	// We'll look ~60 characters before the code’s position for any context indicators.
-	for i := range codeHits {
-		codeHits[i].score = computeContextScore(text, codeHits[i].index, contextIndicators)
+	// We'll look ~60 characters before the code’s position, and a little way after it in
+	// the same sentence, for any context indicators, and at the text directly around it
+	// for anything that suggests it isn't a code.
+	scoredHits := make([]codeHit, 0, len(codeHits))
+	for _, ch := range codeHits {
+		contextScore, matchedIndicators := computeContextScore(text, ch.index, ch.end, indicators)
+		penaltyScore, matchedPenalties := computePenaltyScore(text, ch.index, ch.end)
+
+		ch.score = contextScore + penaltyScore
+		ch.indicators = matchedIndicators
+		ch.penalties = matchedPenalties
+		if ch.origin != nil {
+			ch.score += originBoundScore
+			ch.indicators = append(ch.indicators, originBoundIndicator)
+		}
+		if ch.score < minimumCodeScore {
+			continue
+		}
+
+		scoredHits = append(scoredHits, ch)
+	}
+
+	codeHits = scoredHits
+	if len(codeHits) == 0 {
+		return nil, ErrNoCodesFound
 	}
 
 	// Sort by score DESC, then by index ASC (if you want earlier-located codes to break ties).
@@ -102,22 +281,54 @@ func ExtractCodes(text string) ([]string, error) {
 		return codeHits[i].score > codeHits[j].score
 	})
 
+	issuer, _ := ExtractIssuer(text)
+	expiry, _ := ExtractExpiry(text)
+
 	// Remove duplicates while preserving order
-	uniqueOrdered := make([]string, 0, len(codeHits))
+	candidates := make([]Candidate, 0, len(codeHits))
 	seen := make(map[string]bool)
 	for _, ch := range codeHits {
 		if !seen[ch.code] {
 			seen[ch.code] = true
-			uniqueOrdered = append(uniqueOrdered, ch.code)
+			candidates = append(candidates, Candidate{
+				Code:       ch.code,
+				Raw:        text[ch.index:ch.end],
+				Start:      ch.index,
+				End:        ch.end,
+				Score:      ch.score,
+				Confidence: confidenceForScore(ch.score),
+				Indicators: ch.indicators,
+				Penalties:  ch.penalties,
+				Issuer:     issuer,
+				Expiry:     expiry,
+				Origin:     ch.origin,
+			})
 		}
 	}
 
 	// If after deduping, none remain, error
-	if len(uniqueOrdered) == 0 {
+	if len(candidates) == 0 {
 		return nil, ErrNoCodesFound
 	}
 
-	return uniqueOrdered, nil
+	return candidates, nil
+}
+
+// confidenceForScore maps a score on to a confidence between 0 and 1. A code with no
+// context at all lands just under 0.3, a single context indicator takes it to about 0.6,
+// and each further indicator gets it closer to 1 without ever reaching it.
+func confidenceForScore(score int) float64 {
+	const (
+		baseline = 2.0
+		scale    = 5.0
+	)
+
+	weighted := float64(score) + baseline
+	if weighted <= 0 {
+		return 0
+	}
+
+	return weighted / (weighted + scale)
 }
 
 // extractCodeByPattern extracts the raw code (digits only) from the match depending on
@@ -158,25 +369,149 @@ func extractCodeByPattern(text string, matchIdx []int, pattern string) (string,
 	return "", 0
 }
 
-// computeContextScore checks for known "trigger phrases" near the code’s location
-// and assigns points if found. You can tweak the distance or logic as needed.
-func computeContextScore(text string, codePos int, indicators []string) int {
+// computeContextScore checks for known "trigger phrases" near the code spanning
+// text[codeStart:codeEnd] and assigns points if found, returning the phrases that matched
+// alongside the score. Each phrase counts once, whether it comes before the code, or
+// after it in the same sentence.
+func computeContextScore(text string, codeStart, codeEnd int, indicators []string) (int, []string) {
 	score := 0
+	matched := make([]string, 0)
 
 	// figure out the start index for context scanning
-	start := codePos - backwardsContextWindow
+	start := codeStart - backwardsContextWindow
 	if start < 0 {
 		start = 0
 	}
 
-	vicinity := strings.ToLower(text[start:codePos])
+	end := codeEnd + forwardsContextWindow
+	if end > len(text) {
+		end = len(text)
+	}
+
+	after := text[codeEnd:end]
+	if i := strings.IndexAny(after, ".!?\n。"); i >= 0 {
+		after = after[:i]
+	}
+
+	before := strings.ToLower(text[start:codeStart])
+	after = strings.ToLower(after)
 
 	for _, ind := range indicators {
-		if strings.Contains(vicinity, strings.ToLower(ind)) {
-			score += 5
+		ind = strings.ToLower(ind)
+		if strings.Contains(before, ind) || strings.Contains(after, ind) {
+			score += indicatorScore
+			matched = append(matched, ind)
+		}
+	}
+	return score, matched
+}
+
+// overlapsCodeHit reports whether the match overlaps any code already discovered, so the
+// same characters aren't reported twice by different patterns.
+func overlapsCodeHit(codeHits []codeHit, matchIdx []int) bool {
+	for _, ch := range codeHits {
+		if matchIdx[0] < ch.end && ch.index < matchIdx[1] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// removeOverlappingCodeHits returns the code hits that don't overlap the match.
+func removeOverlappingCodeHits(codeHits []codeHit, matchIdx []int) []codeHit {
+	kept := make([]codeHit, 0, len(codeHits))
+	for _, ch := range codeHits {
+		if overlapsCodeHit([]codeHit{ch}, matchIdx) {
+			continue
+		}
+
+		kept = append(kept, ch)
+	}
+
+	return kept
+}
+
+// isPlausibleAlphanumericCode applies the guards that stop ordinary words, acronyms,
+// units and URL fragments being picked up as alphanumeric codes. Purely numeric codes are
+// left to codeRegexPattern.
+func isPlausibleAlphanumericCode(text string, matchIdx []int, code string) bool {
+	if code == "" || isAllDigits(code) {
+		return false
+	}
+
+	// Tokens glued to URL, email or hashtag punctuation are part of something bigger.
+	if matchIdx[0] > 0 && strings.ContainsRune("/@#=&?_.", rune(text[matchIdx[0]-1])) {
+		return false
+	}
+	if matchIdx[1] < len(text) {
+		next := text[matchIdx[1]]
+		if strings.ContainsRune("/@=&?_", rune(next)) {
+			return false
+		}
+		if next == '.' && matchIdx[1]+1 < len(text) && isAlphanumeric(text[matchIdx[1]+1]) {
+			return false
+		}
+	}
+
+	letters, digits := 0, 0
+	for i := 0; i < len(code); i++ {
+		if code[i] >= '0' && code[i] <= '9' {
+			digits++
+		} else {
+			letters++
+		}
+	}
+
+	// Mixed codes, e.g. "F7K2Q". Requiring two of each rules out things like "2FA", "4G",
+	// "MP3" and "B2B". One that reads as a word followed by a number, without a dash, must
+	// be introduced by a phrase like "code:", so "iPhone15" isn't taken for a code.
+	if digits > 0 {
+		if letters < 2 || digits < 2 || unitSuffixPattern.MatchString(code) {
+			return false
 		}
+
+		return !wordThenNumberPattern.MatchString(text[matchIdx[0]:matchIdx[1]]) || hasCodeLeadIn(text, matchIdx[0])
+	}
+
+	// Letter-only codes, e.g. "ABC-DEF". These have to be written in capitals, can't be a
+	// common word, and must be introduced by a phrase like "code:".
+	if strings.ToUpper(code) != code || uppercaseStopWords[code] {
+		return false
 	}
-	return score
+
+	return hasCodeLeadIn(text, matchIdx[0])
+}
+
+// hasCodeLeadIn reports whether the text directly in front of a candidate starting at
+// codeStart introduces it as a code.
+func hasCodeLeadIn(text string, codeStart int) bool {
+	start := codeStart - leadInContextWindow
+	if start < 0 {
+		start = 0
+	}
+
+	return codeLeadInPattern.MatchString(text[start:codeStart])
+}
+
+// sanitizeAlphanumericCode removes dashes from an alphanumeric code, keeping the original
+// casing of the letters.
+func sanitizeAlphanumericCode(raw string) string {
+	return strings.ReplaceAll(raw, "-", "")
+}
+
+func isAllDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+
+	return len(s) > 0
+}
+
+func isAlphanumeric(b byte) bool {
+	return (b >= '0' && b <= '9') || (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z')
 }
 
 // sanitizeCode removes "G-" prefix if present, and also removes any dashes, leaving only
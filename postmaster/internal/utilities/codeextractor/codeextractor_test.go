@@ -1,171 +1,271 @@
 package codeextractor
 
 import (
+	"math"
+	"slices"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 )
 
-func TestExtractCodesEachMessage(t *testing.T) {
-	testMessages := []struct {
-		name    string
-		message string
-		want    []string
-		wantErr bool
-	}{
-		{
-			name:    "Msg1 - Basic numeric code",
-			message: "Uw sms-code is: 205095. Deze vervalt over 20 minuten.",
-			want:    []string{"205095"},
-		},
-		{
-			name:    "Msg2 - One-Time Code (Amex)",
-			message: `NEVER share this One-Time Code: 650630. Amex will never call to ask for it. ...`,
-			want:    []string{"650630"},
-		},
-		{
-			name:    "Msg3 - Another numeric code",
-			message: "Uw sms-code is: 592411. Deze vervalt over 20 minuten.",
-			want:    []string{"592411"},
-		},
-		{
-			name:    "Msg4 - Code with dash (524-504)",
-			message: "Your DigiD SMS code to log into Mijn OHRA Zorgverzekering is: 524-504",
-			want:    []string{"524504"},
-		},
-		{
-			name:    "Msg5 - 6-digit code (013034)",
-			message: "Your Suspicious Antwerp verification code is: 013034",
-			want:    []string{"013034"},
-		},
-		{
-			name:    "Msg6 - Deliveroo code 979700",
-			message: "<#>Your Deliveroo verification code is: 979700\n/tPjtJT5f8o",
-			want:    []string{"979700"},
-		},
-		{
-			name:    "Msg7 - Uber code 1808",
-			message: "Your Uber code is 1808. Never share this code.",
-			want:    []string{"1808"},
-		},
-		{
-			name:    "Msg8 - Amex again (650630 repeated)",
-			message: `NEVER share this One-Time Code: 650630. ...`,
-			want:    []string{"650630"},
-		},
-		{
-			name:    "Msg9 - Jumbo code 972905",
-			message: "972905 is je sms-code om verder te gaan bij Jumbo.",
-			want:    []string{"972905"},
-		},
-		{
-			name:    "Msg10 - Another Uber code 7866",
-			message: "Your Uber code is 7866. Never share this code.",
-			want:    []string{"7866"},
-		},
-		{
-			name:    "Msg11 - Shop verification code 350703",
-			message: "350703 is your Shop verification code",
-			want:    []string{"350703"},
-		},
-		{
-			name:    "Msg12 - Amex SafeKey KLM 346020",
-			message: "Amex SafeKey verificatiecode is 346020 voor €2.916,24 bij KLM ...",
-			want:    []string{"346020"},
-		},
-		{
-			name:    "Msg13 - Amex SafeKey Apple 932857",
-			message: "Amex SafeKey verificatiecode is 932857 voor €568,00 bij Apple ...",
-			want:    []string{"932857"},
-		},
-		{
-			name:    "Msg14 - Uw SMS code 380000",
-			message: "Uw SMS code is 380000",
-			want:    []string{"380000"},
-		},
-		{
-			name:    "Msg15 - OpenTable code 226044",
-			message: "Uw OpenTable-verificatiecode is: 226044.. Deze code verloopt over 10 minuten...",
-			want:    []string{"226044"},
-		},
-		{
-			name:    "Msg16 - Amex SafeKey 621740",
-			message: "Amex SafeKey code is 621740 for €411.34 transaction attempt at KLM ...",
-			want:    []string{"621740"},
-		},
-		{
-			name:    "Msg17 - Apple Pay code 402685",
-			message: "Your one-time verification code to add your Amex Card to Apple Pay is 402685...",
-			want:    []string{"402685"},
-		},
-		{
-			name:    "Msg18 - Tikkie code 8890",
-			message: "Tikkie code: 8890\nDeze code is 5 minuten geldig.",
-			want:    []string{"8890"},
-		},
-		{
-			name:    "Msg19 - SafeKey One Time Code 437951",
-			message: "437951 is your all numeric SafeKey One Time Code...",
-			want:    []string{"437951"},
-		},
-		{
-			name:    "Msg20 - DICE verification code 5845",
-			message: "Your DICE verification code is: 5845",
-			want:    []string{"5845"},
-		},
-		{
-			name:    "Msg21 - Gett code 204065",
-			message: "Gett account confirmation code: 204065",
-			want:    []string{"204065"},
-		},
-		{
-			name:    "Msg22 - Coinbase code 1203227",
-			message: "Your Coinbase verification code is: 1203227. Don't share...",
-			want:    []string{"1203227"},
-		},
-		{
-			name:    "Msg23 - Mixpanel code 2394644",
-			message: "Your Mixpanel code is 2394644",
-			want:    []string{"2394644"},
-		},
-		{
-			name:    "Msg24 - Mailchimp code 964933",
-			message: "Your Mailchimp Two Factor Auth verification code is: 964933",
-			want:    []string{"964933"},
-		},
-		{
-			name:    "Msg25 - Tesco code 838123",
-			message: "838123 is your Tesco authentication code.\n@tesco.com #838123",
-			want:    []string{"838123"},
-		},
-		{
-			name:    "Msg26 - Stripe code 214-576",
-			message: "Your Stripe verification code is: 214-576. Don't share this code...",
-			want:    []string{"214576"},
-		},
-		{
-			name:    "Msg27 - Google code G-089350",
-			message: "G-089350 is your Google verification code.",
-			want:    []string{"089350"},
-		},
-		{
-			name:    "Msg28 - Stripe code 473-293",
-			message: "Your Stripe verification code is: 473-293...",
-			want:    []string{"473293"},
-		},
-		{
-			name:    "Msg29 - Another Stripe code 913-170",
-			message: "Your verification code for Stripe is 913-170...",
-			want:    []string{"913170"},
-		},
-		{
-			name:    "Msg30 - Twitter login code 940326",
-			message: "940326 is your Twitter login code. Don't reply...",
-			want:    []string{"940326"},
-		},
-		// You can add more test entries if needed...
-	}
+// testMessages are real and synthetic messages along with the codes that should, and
+// shouldn't, be found in them. They are also what minimumCodeScore is tuned against.
+var testMessages = []struct {
+	name    string
+	message string
+	want    []string
+	notWant []string
+	wantErr bool
+}{
+	{
+		name:    "Msg1 - Basic numeric code",
+		message: "Uw sms-code is: 205095. Deze vervalt over 20 minuten.",
+		want:    []string{"205095"},
+	},
+	{
+		name:    "Msg2 - One-Time Code (Amex)",
+		message: `NEVER share this One-Time Code: 650630. Amex will never call to ask for it. ...`,
+		want:    []string{"650630"},
+	},
+	{
+		name:    "Msg3 - Another numeric code",
+		message: "Uw sms-code is: 592411. Deze vervalt over 20 minuten.",
+		want:    []string{"592411"},
+	},
+	{
+		name:    "Msg4 - Code with dash (524-504)",
+		message: "Your DigiD SMS code to log into Mijn OHRA Zorgverzekering is: 524-504",
+		want:    []string{"524504"},
+	},
+	{
+		name:    "Msg5 - 6-digit code (013034)",
+		message: "Your Suspicious Antwerp verification code is: 013034",
+		want:    []string{"013034"},
+	},
+	{
+		name:    "Msg6 - Deliveroo code 979700",
+		message: "<#>Your Deliveroo verification code is: 979700\n/tPjtJT5f8o",
+		want:    []string{"979700"},
+	},
+	{
+		name:    "Msg7 - Uber code 1808",
+		message: "Your Uber code is 1808. Never share this code.",
+		want:    []string{"1808"},
+	},
+	{
+		name:    "Msg8 - Amex again (650630 repeated)",
+		message: `NEVER share this One-Time Code: 650630. ...`,
+		want:    []string{"650630"},
+	},
+	{
+		name:    "Msg9 - Jumbo code 972905",
+		message: "972905 is je sms-code om verder te gaan bij Jumbo.",
+		want:    []string{"972905"},
+	},
+	{
+		name:    "Msg10 - Another Uber code 7866",
+		message: "Your Uber code is 7866. Never share this code.",
+		want:    []string{"7866"},
+	},
+	{
+		name:    "Msg11 - Shop verification code 350703",
+		message: "350703 is your Shop verification code",
+		want:    []string{"350703"},
+	},
+	{
+		name:    "Msg12 - Amex SafeKey KLM 346020",
+		message: "Amex SafeKey verificatiecode is 346020 voor €2.916,24 bij KLM ...",
+		want:    []string{"346020"},
+		notWant: []string{"2916", "291624", "916"},
+	},
+	{
+		name:    "Msg13 - Amex SafeKey Apple 932857",
+		message: "Amex SafeKey verificatiecode is 932857 voor €568,00 bij Apple ...",
+		want:    []string{"932857"},
+		notWant: []string{"568", "56800"},
+	},
+	{
+		name:    "Msg14 - Uw SMS code 380000",
+		message: "Uw SMS code is 380000",
+		want:    []string{"380000"},
+	},
+	{
+		name:    "Msg15 - OpenTable code 226044",
+		message: "Uw OpenTable-verificatiecode is: 226044.. Deze code verloopt over 10 minuten...",
+		want:    []string{"226044"},
+	},
+	{
+		name:    "Msg16 - Amex SafeKey 621740",
+		message: "Amex SafeKey code is 621740 for €411.34 transaction attempt at KLM ...",
+		want:    []string{"621740"},
+		notWant: []string{"411", "41134"},
+	},
+	{
+		name:    "Msg17 - Apple Pay code 402685",
+		message: "Your one-time verification code to add your Amex Card to Apple Pay is 402685...",
+		want:    []string{"402685"},
+	},
+	{
+		name:    "Msg18 - Tikkie code 8890",
+		message: "Tikkie code: 8890\nDeze code is 5 minuten geldig.",
+		want:    []string{"8890"},
+	},
+	{
+		name:    "Msg19 - SafeKey One Time Code 437951",
+		message: "437951 is your all numeric SafeKey One Time Code...",
+		want:    []string{"437951"},
+	},
+	{
+		name:    "Msg20 - DICE verification code 5845",
+		message: "Your DICE verification code is: 5845",
+		want:    []string{"5845"},
+	},
+	{
+		name:    "Msg21 - Gett code 204065",
+		message: "Gett account confirmation code: 204065",
+		want:    []string{"204065"},
+	},
+	{
+		name:    "Msg22 - Coinbase code 1203227",
+		message: "Your Coinbase verification code is: 1203227. Don't share...",
+		want:    []string{"1203227"},
+	},
+	{
+		name:    "Msg23 - Mixpanel code 2394644",
+		message: "Your Mixpanel code is 2394644",
+		want:    []string{"2394644"},
+	},
+	{
+		name:    "Msg24 - Mailchimp code 964933",
+		message: "Your Mailchimp Two Factor Auth verification code is: 964933",
+		want:    []string{"964933"},
+	},
+	{
+		name:    "Msg25 - Tesco code 838123",
+		message: "838123 is your Tesco authentication code.\n@tesco.com #838123",
+		want:    []string{"838123"},
+	},
+	{
+		name:    "Msg26 - Stripe code 214-576",
+		message: "Your Stripe verification code is: 214-576. Don't share this code...",
+		want:    []string{"214576"},
+	},
+	{
+		name:    "Msg27 - Google code G-089350",
+		message: "G-089350 is your Google verification code.",
+		want:    []string{"089350"},
+	},
+	{
+		name:    "Msg28 - Stripe code 473-293",
+		message: "Your Stripe verification code is: 473-293...",
+		want:    []string{"473293"},
+	},
+	{
+		name:    "Msg29 - Another Stripe code 913-170",
+		message: "Your verification code for Stripe is 913-170...",
+		want:    []string{"913170"},
+	},
+	{
+		name:    "Msg30 - Twitter login code 940326",
+		message: "940326 is your Twitter login code. Don't reply...",
+		want:    []string{"940326"},
+	},
+	{
+		name:    "Msg31 - Steam Guard code F7K2Q",
+		message: "Your Steam Guard code is F7K2Q. Don't share it with anyone.",
+		want:    []string{"F7K2Q"},
+	},
+	{
+		name:    "Msg32 - Microsoft letter-only code ABC-DEF",
+		message: "Use security code: ABC-DEF to sign in to your Microsoft account.",
+		want:    []string{"ABCDEF"},
+		notWant: []string{"Microsoft"},
+	},
+	{
+		name:    "Msg33 - Dashed alphanumeric code K9X-44P",
+		message: "Your code: K9X-44P",
+		want:    []string{"K9X44P"},
+	},
+	{
+		name:    "Msg34 - Mixed-case code keeps its casing",
+		message: "Your Figma login code is a8Bc9X",
+		want:    []string{"a8Bc9X"},
+		notWant: []string{"A8BC9X"},
+	},
+	{
+		name:    "Msg35 - Numeric code next to a short link",
+		message: "Your Bol verification code is 482913. Manage your account at bit.ly/3xYz9Ab",
+		want:    []string{"482913"},
+		notWant: []string{"3xYz9Ab"},
+	},
+	{
+		name:    "Msg36 - Uppercase words and acronyms are not codes",
+		message: "REMINDER: your NHS APPOINTMENT at the CLINIC is CONFIRMED",
+		wantErr: true,
+	},
+	{
+		name:    "Msg37 - Units, ordinals and acronyms are not codes",
+		message: "Enable 2FA before the 20th, our 4G MP3 offer ends at 5pm",
+		wantErr: true,
+	},
+	{
+		name:    "Msg38 - Amex SafeKey with amount and card suffix",
+		message: "Amex SafeKey verificatiecode is 346020 voor €2916,24 bij KLM met kaart eindigend op 41004",
+		want:    []string{"346020"},
+		notWant: []string{"2916", "41004"},
+	},
+	{
+		name:    "Msg39 - Amex SafeKey with decimal amount and card suffix",
+		message: "Amex SafeKey code is 621740 for €1411.34 transaction attempt at KLM on card ending in 4821",
+		want:    []string{"621740"},
+		notWant: []string{"1411", "4821"},
+	},
+	{
+		name:    "Msg40 - Amex SafeKey with year-like amount and date",
+		message: "Amex SafeKey code is 932857 for $2024 at Apple on 12/03/2024",
+		want:    []string{"932857"},
+		notWant: []string{"2024"},
+	},
+	{
+		name:    "Msg41 - Card suffix, amount, date and phone number only",
+		message: "Your card ending in 4821 was charged €1250 on 12 March 2024. Questions? Call +31 20 504 8000",
+		wantErr: true,
+	},
+	{
+		name:    "Msg42 - Time, ISO date and reference number only",
+		message: "Your appointment is at 1430 hrs on 2024-03-12, ref 7730021",
+		wantErr: true,
+	},
+	{
+		name:    "Msg43 - Year-like code outweighed by context",
+		message: "Your verification code is 2019",
+		want:    []string{"2019"},
+	},
+	{
+		name:    "Msg44 - Year-like code before its context",
+		message: "1984 is your Uber code.",
+		want:    []string{"1984"},
+	},
+	{
+		name:    "Msg45 - Year-like login code before its context",
+		message: "2019 is your Twitter login code.",
+		want:    []string{"2019"},
+	},
+	{
+		name:    "Msg46 - Product name next to a code",
+		message: "Your iPhone15 repair PIN 482913",
+		want:    []string{"482913"},
+		notWant: []string{"iPhone15"},
+	},
+	{
+		name:    "Msg47 - Word-like code introduced as a code",
+		message: "Your code: ABC123",
+		want:    []string{"ABC123"},
+	},
+	// You can add more test entries if needed...
+}
 
+func TestExtractCodesEachMessage(t *testing.T) {
 	for _, tm := range testMessages {
 		t.Run(tm.name, func(t *testing.T) {
 			got, err := ExtractCodes(tm.message)
@@ -183,6 +283,89 @@ func TestExtractCodesEachMessage(t *testing.T) {
 			for _, w := range tm.want {
 				assert.Contains(t, got, w, "Expected code %q not found in result: %v", w, got)
 			}
+
+			for _, nw := range tm.notWant {
+				assert.NotContains(t, got, nw, "Unexpected code %q found in result: %v", nw, got)
+			}
 		})
 	}
 }
+
+func TestMinimumCodeScore(t *testing.T) {
+	// Score every number in the test messages, whether or not it makes the cut, to check
+	// minimumCodeScore sits between the numbers that are codes and those that aren't.
+	lowestCode, highestNonCode := math.MaxInt, math.MinInt
+	for _, tm := range testMessages {
+		indicators := indicatorsForLocales(DetectLocales(tm.message))
+
+		for _, m := range codeRegexPattern.FindAllStringIndex(tm.message, -1) {
+			code := sanitizeCode(tm.message[m[0]:m[1]])
+
+			contextScore, _ := computeContextScore(tm.message, m[0], m[1], indicators)
+			penaltyScore, _ := computePenaltyScore(tm.message, m[0], m[1])
+			score := contextScore + penaltyScore
+
+			switch {
+			case slices.Contains(tm.want, code):
+				lowestCode = min(lowestCode, score)
+			case tm.wantErr || slices.Contains(tm.notWant, code):
+				highestNonCode = max(highestNonCode, score)
+			}
+		}
+	}
+
+	assert.LessOrEqual(t, minimumCodeScore, lowestCode)
+	assert.Greater(t, minimumCodeScore, highestNonCode)
+
+	// A single indicator outweighs the weak penalty, so a code that looks like a year is
+	// never dropped for that alone.
+	assert.GreaterOrEqual(t, indicatorScore+weakPenaltyWeight, minimumCodeScore)
+}
+
+func TestExtractCandidates(t *testing.T) {
+	message := "Amex SafeKey code is 621740 for €1411.34 transaction attempt at KLM"
+
+	got, err := ExtractCandidates(message)
+	assert.NoError(t, err)
+	if !assert.Len(t, got, 1) {
+		return
+	}
+
+	assert.Equal(t, "621740", got[0].Code)
+	assert.Equal(t, "621740", got[0].Raw)
+	assert.Equal(t, "621740", message[got[0].Start:got[0].End])
+	assert.Equal(t, 10, got[0].Score)
+	assert.InDelta(t, 0.71, got[0].Confidence, 0.01)
+	assert.ElementsMatch(t, []string{"code is", "safekey code"}, got[0].Indicators)
+	assert.Empty(t, got[0].Penalties)
+}
+
+func TestExtractCandidatesKeepsRawMatch(t *testing.T) {
+	message := "  G-089350 is your Google verification code."
+
+	got, err := ExtractCandidates(message)
+	assert.NoError(t, err)
+	if !assert.NotEmpty(t, got) {
+		return
+	}
+
+	assert.Equal(t, "089350", got[0].Code)
+	assert.Equal(t, "G-089350", got[0].Raw)
+	assert.Equal(t, 2, got[0].Start)
+	assert.Equal(t, 10, got[0].End)
+}
+
+func TestExtractCandidatesReportsPenalties(t *testing.T) {
+	message := "Your verification code is 2019"
+
+	got, err := ExtractCandidates(message)
+	assert.NoError(t, err)
+	if !assert.NotEmpty(t, got) {
+		return
+	}
+
+	assert.Equal(t, "2019", got[0].Code)
+	assert.Equal(t, 7, got[0].Score)
+	assert.ElementsMatch(t, []string{"verification code", "code is"}, got[0].Indicators)
+	assert.Equal(t, []string{"year"}, got[0].Penalties)
+}
@@ -0,0 +1,197 @@
+package codeextractor
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// expiryKeywordWindow is how far either side of a duration we look for a word like
+	// "expires" or "geldig" that says the duration is the validity of the code.
+	expiryKeywordWindow = 30
+
+	// maximumExpiry caps the durations we'll accept, so phrases like "valid for 48 hours"
+	// about something other than the code don't turn into a multi-day TTL.
+	maximumExpiry = 24 * time.Hour
+)
+
+var (
+	// expiryUnits maps each unit of time, in any of the supported languages, to its
+	// duration.
+	expiryUnits = map[string]time.Duration{
+		"minutes": time.Minute, "minute": time.Minute, "mins": time.Minute, "min": time.Minute,
+		"minuten": time.Minute, "minuut": time.Minute, "minuto": time.Minute,
+		"minutos": time.Minute, "minuti": time.Minute, "minut": time.Minute,
+		"minuter": time.Minute, "minutter": time.Minute, "minuuttia": time.Minute,
+		"dakika": time.Minute, "分钟": time.Minute, "分鐘": time.Minute, "分": time.Minute,
+		"분": time.Minute,
+
+		"seconds": time.Second, "second": time.Second, "secs": time.Second, "sec": time.Second,
+		"seconden": time.Second, "sekunden": time.Second, "secondes": time.Second,
+		"segundos": time.Second, "secondi": time.Second, "秒": time.Second, "초": time.Second,
+
+		"hours": time.Hour, "hour": time.Hour, "hrs": time.Hour, "hr": time.Hour,
+		"uur": time.Hour, "stunden": time.Hour, "stunde": time.Hour, "heures": time.Hour,
+		"heure": time.Hour, "horas": time.Hour, "hora": time.Hour, "ore": time.Hour,
+		"ora": time.Hour, "godzin": time.Hour, "godziny": time.Hour, "timmar": time.Hour,
+		"timer": time.Hour, "tuntia": time.Hour, "saat": time.Hour, "小时": time.Hour,
+		"小時": time.Hour, "시간": time.Hour,
+	}
+
+	// expiryKeywords are the words, in each supported language, that say a nearby duration
+	// is how long the code is valid for.
+	expiryKeywords = []string{
+		// English. A bare "within" is as likely to be about something else, as in
+		// "contact us within 24 hours", so it only counts when it's about using the code.
+		"expire", "valid", "use it within", "use within", "use this code within",
+		"enter it within", "enter within",
+		// Dutch
+		"vervalt", "verloopt", "geldig",
+		// German
+		"gültig", "läuft", "verfällt",
+		// French, which shares "expire" with English
+		"valable",
+		// Spanish and Portuguese
+		"válido", "valido", "caduca", "expira", "vence",
+		// Italian
+		"scade",
+		// Polish
+		"ważny", "wygasa",
+		// Scandinavian
+		"giltig", "gyldig", "utløper", "udløber",
+		// Finnish and Turkish
+		"voimassa", "geçerli",
+		// Chinese, Japanese and Korean
+		"有效", "以内", "内", "유효",
+	}
+)
+
+var (
+	// durationPattern matches a number followed by any unit in expiryUnits.
+	durationPattern = regexp.MustCompile(`(?i)\b(\d{1,3})\s?(` + expiryUnitsPattern() + `)`)
+
+	// durationPartPattern matches a further part of a compound duration directly after a
+	// duration, e.g. the " 30 minutes" of "1 hour 30 minutes" or the " and 30 seconds" of
+	// "2 minutes and 30 seconds".
+	durationPartPattern = regexp.MustCompile(`(?i)^,?\s*(?:(?:and|en|und|et|y|e)\s+)?(\d{1,3})\s?(` + expiryUnitsPattern() + `)`)
+)
+
+// expiryUnitsPattern returns a regular expression alternation of the units in
+// expiryUnits.
+func expiryUnitsPattern() string {
+	units := make([]string, 0, len(expiryUnits))
+	for unit := range expiryUnits {
+		units = append(units, regexp.QuoteMeta(unit))
+	}
+
+	// Longest first, so "minuten" isn't matched as "minute" followed by an "n".
+	sort.Slice(units, func(i, j int) bool {
+		if len(units[i]) == len(units[j]) {
+			return units[i] < units[j]
+		}
+		return len(units[i]) > len(units[j])
+	})
+
+	return strings.Join(units, "|")
+}
+
+// ExtractExpiry looks for a phrase saying how long the code in a message is valid for,
+// e.g. "expires in 10 minutes" or "Deze vervalt over 20 minuten", and returns the
+// duration. Compound durations, like "1 hour 30 minutes", are added up. The second
+// return value is false if no expiry was stated.
+func ExtractExpiry(text string) (time.Duration, bool) {
+	lower := strings.ToLower(text)
+
+	for _, m := range durationPattern.FindAllStringSubmatchIndex(lower, -1) {
+		expiry, unit, ok := parseDuration(lower, m)
+		if !ok || expiry == 0 {
+			continue
+		}
+
+		// Add up any further parts in smaller units, so "1 hour 30 minutes" is 90 minutes.
+		end := m[1]
+		for {
+			part := durationPartPattern.FindStringSubmatchIndex(lower[end:])
+			if part == nil {
+				break
+			}
+			for i := range part {
+				part[i] += end
+			}
+
+			partExpiry, partUnit, ok := parseDuration(lower, part)
+			if !ok || partUnit >= unit {
+				break
+			}
+
+			expiry += partExpiry
+			unit = partUnit
+			end = part[1]
+		}
+
+		if !hasExpiryKeyword(lower, m[0], end) {
+			continue
+		}
+
+		if expiry > maximumExpiry {
+			continue
+		}
+
+		return expiry, true
+	}
+
+	return 0, false
+}
+
+// parseDuration returns the duration matched by durationPattern or durationPartPattern,
+// whose submatch indices into lower are m, along with its unit. The third return value is
+// false if the match isn't a duration after all.
+func parseDuration(lower string, m []int) (time.Duration, time.Duration, bool) {
+	amount, err := strconv.Atoi(lower[m[2]:m[3]])
+	if err != nil {
+		return 0, 0, false
+	}
+
+	// Make sure we matched a whole unit and not the start of a longer word, e.g. the
+	// "min" of "minimum".
+	if m[1] < len(lower) && isASCIILetter(lower[m[1]]) {
+		return 0, 0, false
+	}
+
+	unit, ok := expiryUnits[lower[m[4]:m[5]]]
+	if !ok {
+		return 0, 0, false
+	}
+
+	return time.Duration(amount) * unit, unit, true
+}
+
+// hasExpiryKeyword reports whether an expiry keyword appears close to the duration that
+// spans lower[start:end].
+func hasExpiryKeyword(lower string, start, end int) bool {
+	windowStart := start - expiryKeywordWindow
+	if windowStart < 0 {
+		windowStart = 0
+	}
+
+	windowEnd := end + expiryKeywordWindow
+	if windowEnd > len(lower) {
+		windowEnd = len(lower)
+	}
+
+	vicinity := lower[windowStart:windowEnd]
+	for _, keyword := range expiryKeywords {
+		if strings.Contains(vicinity, keyword) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func isASCIILetter(b byte) bool {
+	return (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z')
+}
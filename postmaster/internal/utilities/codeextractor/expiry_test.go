@@ -0,0 +1,140 @@
+package codeextractor
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExtractExpiry(t *testing.T) {
+	testMessages := []struct {
+		name    string
+		message string
+		want    time.Duration
+		wantOK  bool
+	}{
+		{
+			name:    "Dutch 'vervalt over'",
+			message: "Uw sms-code is: 205095. Deze vervalt over 20 minuten.",
+			want:    20 * time.Minute,
+			wantOK:  true,
+		},
+		{
+			name:    "Dutch 'geldig' after the duration",
+			message: "Tikkie code: 8890\nDeze code is 5 minuten geldig.",
+			want:    5 * time.Minute,
+			wantOK:  true,
+		},
+		{
+			name:    "Dutch 'verloopt over'",
+			message: "Uw OpenTable-verificatiecode is: 226044.. Deze code verloopt over 10 minuten...",
+			want:    10 * time.Minute,
+			wantOK:  true,
+		},
+		{
+			name:    "English 'expires in'",
+			message: "Your code is 482913. It expires in 10 minutes.",
+			want:    10 * time.Minute,
+			wantOK:  true,
+		},
+		{
+			name:    "English 'valid for' abbreviated",
+			message: "482913 is your login code, valid for 5 min.",
+			want:    5 * time.Minute,
+			wantOK:  true,
+		},
+		{
+			name:    "English hours",
+			message: "Your booking code 482913 is valid for 1 hour.",
+			want:    time.Hour,
+			wantOK:  true,
+		},
+		{
+			name:    "German",
+			message: "Ihr Bestätigungscode lautet 482913. Er ist 15 Minuten gültig.",
+			want:    15 * time.Minute,
+			wantOK:  true,
+		},
+		{
+			name:    "French",
+			message: "Votre code de vérification est 482913. Il est valable 10 minutes.",
+			want:    10 * time.Minute,
+			wantOK:  true,
+		},
+		{
+			name:    "Spanish seconds",
+			message: "Tu código de verificación es 482913. Caduca en 90 segundos.",
+			want:    90 * time.Second,
+			wantOK:  true,
+		},
+		{
+			name:    "Chinese",
+			message: "【淘宝】您的验证码是482913，5分钟内有效。",
+			want:    5 * time.Minute,
+			wantOK:  true,
+		},
+		{
+			name:    "English 'use it within'",
+			message: "Your code is 482913. Use it within 15 minutes.",
+			want:    15 * time.Minute,
+			wantOK:  true,
+		},
+		{
+			name:    "Compound duration",
+			message: "Your code is 482913. It expires in 1 hour 30 minutes.",
+			want:    90 * time.Minute,
+			wantOK:  true,
+		},
+		{
+			name:    "Compound duration with 'and'",
+			message: "Your code is 482913, valid for 2 minutes and 30 seconds.",
+			want:    150 * time.Second,
+			wantOK:  true,
+		},
+		{
+			name:    "Duration that isn't an expiry",
+			message: "Your driver is 5 minutes away. Your Uber code is 1808.",
+			wantOK:  false,
+		},
+		{
+			name:    "'within' about contacting support",
+			message: "Your code is 482913. If this wasn't you, contact us within 24 hours.",
+			wantOK:  false,
+		},
+		{
+			name:    "'within' about a delivery",
+			message: "Your parcel will arrive within 2 hours. Your pickup code is 482913.",
+			wantOK:  false,
+		},
+		{
+			name:    "Unit prefix of a longer word",
+			message: "Your code is 482913, valid for a 5 minimum order.",
+			wantOK:  false,
+		},
+		{
+			name:    "No expiry",
+			message: "Your Uber code is 1808. Never share this code.",
+			wantOK:  false,
+		},
+	}
+
+	for _, tm := range testMessages {
+		t.Run(tm.name, func(t *testing.T) {
+			got, ok := ExtractExpiry(tm.message)
+
+			assert.Equal(t, tm.wantOK, ok)
+			assert.Equal(t, tm.want, got)
+		})
+	}
+}
+
+func TestExtractCandidatesIncludesExpiry(t *testing.T) {
+	got, err := ExtractCandidates("Uw sms-code is: 205095. Deze vervalt over 20 minuten.")
+
+	assert.NoError(t, err)
+	if assert.NotEmpty(t, got) {
+		assert.Equal(t, "205095", got[0].Code)
+		assert.Equal(t, 20*time.Minute, got[0].Expiry)
+	}
+}
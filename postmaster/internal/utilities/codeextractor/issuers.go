@@ -0,0 +1,166 @@
+package codeextractor
+
+import (
+	"regexp"
+	"strings"
+)
+
+// knownIssuer is a service we can name reliably from a keyword in the message.
+type knownIssuer struct {
+	// name is how the service is displayed, e.g. "American Express"
+	name string
+
+	// pattern matches any of the keywords the service is known by
+	pattern *regexp.Regexp
+}
+
+var (
+	// knownIssuers is the dictionary of services that send codes we've seen before. Where a
+	// message mentions more than one (e.g. "Amex SafeKey … bij KLM"), the one mentioned
+	// first wins, as the merchant tends to come after the issuer.
+	knownIssuers = []knownIssuer{
+		newKnownIssuer("American Express", "amex", "american express"),
+		newKnownIssuer("Apple", "apple", "apple id"),
+		newKnownIssuer("Amazon", "amazon"),
+		newKnownIssuer("Airbnb", "airbnb"),
+		newKnownIssuer("Booking.com", "booking.com"),
+		newKnownIssuer("Bol", "bol.com"),
+		newKnownIssuer("Bunq", "bunq"),
+		newKnownIssuer("Coinbase", "coinbase"),
+		newKnownIssuer("Deliveroo", "deliveroo"),
+		newKnownIssuer("DICE", "dice"),
+		newKnownIssuer("DigiD", "digid"),
+		newKnownIssuer("Discord", "discord"),
+		newKnownIssuer("Dropbox", "dropbox"),
+		newKnownIssuer("Facebook", "facebook"),
+		newKnownIssuer("Figma", "figma"),
+		newKnownIssuer("Gett", "gett"),
+		newKnownIssuer("GitHub", "github"),
+		newKnownIssuer("Google", "google"),
+		newKnownIssuer("Instagram", "instagram"),
+		newKnownIssuer("ING", "ing"),
+		newKnownIssuer("Jumbo", "jumbo"),
+		newKnownIssuer("Klarna", "klarna"),
+		newKnownIssuer("LinkedIn", "linkedin"),
+		newKnownIssuer("Mailchimp", "mailchimp"),
+		newKnownIssuer("Microsoft", "microsoft"),
+		newKnownIssuer("Mixpanel", "mixpanel"),
+		newKnownIssuer("Monzo", "monzo"),
+		newKnownIssuer("OpenTable", "opentable"),
+		newKnownIssuer("PayPal", "paypal"),
+		newKnownIssuer("Rabobank", "rabobank"),
+		newKnownIssuer("Revolut", "revolut"),
+		newKnownIssuer("Slack", "slack"),
+		newKnownIssuer("Steam", "steam"),
+		newKnownIssuer("Stripe", "stripe"),
+		newKnownIssuer("Telegram", "telegram"),
+		newKnownIssuer("Tesco", "tesco"),
+		newKnownIssuer("Tikkie", "tikkie"),
+		newKnownIssuer("Twitter", "twitter"),
+		newKnownIssuer("Uber", "uber"),
+		newKnownIssuer("WhatsApp", "whatsapp"),
+	}
+
+	// issuerWord matches one capitalised word of a service name, e.g. "Uber" or "OHRA". It
+	// can contain a full stop, as in "Booking.com", but not end in one, so a name doesn't
+	// run on into the next sentence.
+	issuerWord = `[A-Z](?:[\w&'.-]*[\w&'-])?`
+
+	// issuerName matches a service name of up to four capitalised words.
+	issuerName = issuerWord + `(?: ` + issuerWord + `){0,3}`
+
+	// codeNoun matches the various ways a code is described after the service name.
+	codeNoun = `(?i:(?:verification|login|log-in|sign-in|security|authentication|confirmation|account|one-time|2fa|two factor auth) )*(?i:code)`
+
+	// genericIssuerPatterns are tried in order when no known issuer is mentioned. The first
+	// capture group of each is the issuer.
+	genericIssuerPatterns = []*regexp.Regexp{
+		// "Your Uber code is 1808"
+		regexp.MustCompile(`\b[Yy]our (` + issuerName + `) ` + codeNoun + `\b`),
+		// "350703 is your Shop verification code"
+		regexp.MustCompile(`\bis your (` + issuerName + `) ` + codeNoun + `\b`),
+		// "Your verification code for Stripe is 913-170"
+		regexp.MustCompile(`\b` + codeNoun + ` for (` + issuerName + `)\b`),
+		// "[Shop] Your code is 350703" or "【淘宝】您的验证码是482913"
+		regexp.MustCompile(`^\s*[\[【]([^\]】#]{2,30})[\]】]`),
+		// "Tikkie code: 8890"
+		regexp.MustCompile(`\b(` + issuerName + `) code\b`),
+	}
+
+	// issuerStopWords are capitalised words that the generic patterns pick up but which
+	// are never part of the name of a service. They are trimmed from either end of a name,
+	// along with possessives and articles in the other languages we support, e.g. "Uw",
+	// "Votre" and "Ihr".
+	issuerStopWords = map[string]bool{
+		"your": true, "the": true, "this": true, "my": true, "a": true, "an": true,
+		"sms": true, "otp": true, "pin": true, "one-time": true, "one": true, "never": true,
+		"verification": true, "security": true, "login": true, "authentication": true,
+		"confirmation": true, "account": true, "access": true, "new": true, "temporary": true,
+		"uw": true, "je": true, "jouw": true, "de": true, "het": true, "een": true,
+		"ihr": true, "ihre": true, "dein": true, "deine": true, "der": true, "die": true, "das": true,
+		"votre": true, "vos": true, "ton": true, "ta": true, "le": true, "la": true, "les": true,
+		"tu": true, "su": true, "el": true, "seu": true, "sua": true, "o": true, "il": true,
+	}
+)
+
+func newKnownIssuer(name string, keywords ...string) knownIssuer {
+	quoted := make([]string, 0, len(keywords))
+	for _, keyword := range keywords {
+		quoted = append(quoted, regexp.QuoteMeta(keyword))
+	}
+
+	return knownIssuer{
+		name:    name,
+		pattern: regexp.MustCompile(`(?i)\b(` + strings.Join(quoted, "|") + `)\b`),
+	}
+}
+
+// ExtractIssuer attempts to name the service that sent a message, e.g. "Uber" for "Your
+// Uber code is 1808". Known services are looked up first, then generic phrases like
+// "Your X code" are tried. The second return value is false if no issuer was found.
+func ExtractIssuer(text string) (string, bool) {
+	bestIndex := -1
+	bestName := ""
+	for _, issuer := range knownIssuers {
+		loc := issuer.pattern.FindStringIndex(text)
+		if loc == nil {
+			continue
+		}
+
+		if bestIndex == -1 || loc[0] < bestIndex {
+			bestIndex = loc[0]
+			bestName = issuer.name
+		}
+	}
+
+	if bestIndex != -1 {
+		return bestName, true
+	}
+
+	for _, pattern := range genericIssuerPatterns {
+		for _, sub := range pattern.FindAllStringSubmatch(text, -1) {
+			name := trimIssuerStopWords(strings.TrimRight(sub[1], ".-'"))
+			if name == "" {
+				continue
+			}
+
+			return name, true
+		}
+	}
+
+	return "", false
+}
+
+// trimIssuerStopWords removes issuerStopWords from the start and end of name, so "Uw SMS"
+// becomes "" and "Acme SMS" becomes "Acme".
+func trimIssuerStopWords(name string) string {
+	words := strings.Fields(name)
+	for len(words) > 0 && issuerStopWords[strings.ToLower(words[0])] {
+		words = words[1:]
+	}
+	for len(words) > 0 && issuerStopWords[strings.ToLower(words[len(words)-1])] {
+		words = words[:len(words)-1]
+	}
+
+	return strings.Join(words, " ")
+}
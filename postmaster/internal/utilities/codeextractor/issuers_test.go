@@ -0,0 +1,121 @@
+package codeextractor
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExtractIssuer(t *testing.T) {
+	testMessages := []struct {
+		name    string
+		message string
+		want    string
+		wantOK  bool
+	}{
+		{
+			name:    "Known issuer",
+			message: "Your Uber code is 1808. Never share this code.",
+			want:    "Uber",
+			wantOK:  true,
+		},
+		{
+			name:    "Known issuer after the code",
+			message: "838123 is your Tesco authentication code.\n@tesco.com #838123",
+			want:    "Tesco",
+			wantOK:  true,
+		},
+		{
+			name:    "Known issuer by alias, merchant mentioned later",
+			message: "Amex SafeKey verificatiecode is 346020 voor €2.916,24 bij KLM ...",
+			want:    "American Express",
+			wantOK:  true,
+		},
+		{
+			name:    "Known issuer with unusual casing",
+			message: "Your DICE verification code is: 5845",
+			want:    "DICE",
+			wantOK:  true,
+		},
+		{
+			name:    "Generic 'Your X code'",
+			message: "Your Suspicious Antwerp verification code is: 013034",
+			want:    "Suspicious Antwerp",
+			wantOK:  true,
+		},
+		{
+			name:    "Generic 'is your X code'",
+			message: "350703 is your Shop verification code",
+			want:    "Shop",
+			wantOK:  true,
+		},
+		{
+			name:    "Generic 'code for X'",
+			message: "Your verification code for Acme Cloud is 913-170",
+			want:    "Acme Cloud",
+			wantOK:  true,
+		},
+		{
+			name:    "Bracketed sender prefix",
+			message: "【淘宝】您的验证码是482913，5分钟内有效。",
+			want:    "淘宝",
+			wantOK:  true,
+		},
+		{
+			name:    "Generic words aren't issuers",
+			message: "NEVER share this One-Time Code: 650630.",
+			wantOK:  false,
+		},
+		{
+			name:    "Dutch possessive and SMS aren't issuers",
+			message: "Uw SMS code is 380000",
+			wantOK:  false,
+		},
+		{
+			name:    "French possessive isn't an issuer",
+			message: "Votre code de vérification est 482913",
+			wantOK:  false,
+		},
+		{
+			name:    "Generic words are trimmed from the end",
+			message: "Your Acme SMS code is 482913",
+			want:    "Acme",
+			wantOK:  true,
+		},
+		{
+			name:    "Issuer doesn't run into the next sentence",
+			message: "Your table is booked at Singing Birds. Your code: 482913",
+			wantOK:  false,
+		},
+		{
+			name:    "Issuer with a full stop in its name",
+			message: "Your Example.org verification code is 482913",
+			want:    "Example.org",
+			wantOK:  true,
+		},
+		{
+			name:    "No issuer",
+			message: "Uw sms-code is: 205095. Deze vervalt over 20 minuten.",
+			wantOK:  false,
+		},
+	}
+
+	for _, tm := range testMessages {
+		t.Run(tm.name, func(t *testing.T) {
+			got, ok := ExtractIssuer(tm.message)
+
+			assert.Equal(t, tm.wantOK, ok)
+			assert.Equal(t, tm.want, got)
+		})
+	}
+}
+
+func TestExtractCandidatesIncludesIssuer(t *testing.T) {
+	got, err := ExtractCandidates("Your Uber code is 1808. Never share this code.")
+
+	assert.NoError(t, err)
+	if assert.NotEmpty(t, got) {
+		assert.Equal(t, "1808", got[0].Code)
+		assert.Equal(t, "Uber", got[0].Issuer)
+	}
+}
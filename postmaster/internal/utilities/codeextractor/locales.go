@@ -0,0 +1,263 @@
+package codeextractor
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Locale identifies a language pack of context indicators, using ISO 639-1 codes.
+type Locale string
+
+const (
+	LocaleEnglish    Locale = "en"
+	LocaleDutch      Locale = "nl"
+	LocaleGerman     Locale = "de"
+	LocaleFrench     Locale = "fr"
+	LocaleSpanish    Locale = "es"
+	LocaleItalian    Locale = "it"
+	LocalePortuguese Locale = "pt"
+	LocalePolish     Locale = "pl"
+	LocaleSwedish    Locale = "sv"
+	LocaleDanish     Locale = "da"
+	LocaleNorwegian  Locale = "no"
+	LocaleFinnish    Locale = "fi"
+	LocaleTurkish    Locale = "tr"
+	LocaleChinese    Locale = "zh"
+	LocaleJapanese   Locale = "ja"
+	LocaleKorean     Locale = "ko"
+)
+
+const (
+	// minLocaleDetectionHits is the number of distinct common words from a language that
+	// must appear in a message before that language's pack is used. One hit isn't enough,
+	// as short words like "de" or "en" are shared by several languages.
+	minLocaleDetectionHits = 2
+)
+
+var (
+	// localeContextIndicators holds the context indicator pack for each locale. The
+	// English pack also carries the brand specific phrases, as those tend to be sent in
+	// English regardless of the language of the rest of the message.
+	localeContextIndicators = map[Locale][]string{
+		LocaleEnglish: contextIndicators,
+		LocaleDutch: {
+			"verificatiecode",
+			"bevestigingscode",
+			"beveiligingscode",
+			"inlogcode",
+			"eenmalige code",
+			"sms-code",
+			"code is",
+			"uw code",
+			"je code",
+		},
+		LocaleGerman: {
+			"bestätigungscode",
+			"verifizierungscode",
+			"sicherheitscode",
+			"einmalcode",
+			"einmalpasswort",
+			"anmeldecode",
+			"ihre tan",
+			"tan lautet",
+			"code lautet",
+			"ihr code",
+			"dein code",
+		},
+		LocaleFrench: {
+			"code de vérification",
+			"code de confirmation",
+			"code de sécurité",
+			"code à usage unique",
+			"code d'accès",
+			"votre code",
+			"ton code",
+			"code est",
+		},
+		LocaleSpanish: {
+			"código de verificación",
+			"código de confirmación",
+			"código de seguridad",
+			"código de acceso",
+			"código de un solo uso",
+			"tu código",
+			"su código",
+			"código es",
+		},
+		LocaleItalian: {
+			"codice di verifica",
+			"codice di conferma",
+			"codice di sicurezza",
+			"codice monouso",
+			"codice otp",
+			"il tuo codice",
+			"codice è",
+		},
+		LocalePortuguese: {
+			"código de verificação",
+			"código de confirmação",
+			"código de segurança",
+			"código de acesso",
+			"seu código",
+			"o teu código",
+			"código é",
+		},
+		LocalePolish: {
+			"kod weryfikacyjny",
+			"kod potwierdzający",
+			"kod bezpieczeństwa",
+			"kod jednorazowy",
+			"twój kod",
+			"kod sms",
+			"kod to",
+		},
+		LocaleSwedish: {
+			"verifieringskod",
+			"bekräftelsekod",
+			"säkerhetskod",
+			"engångskod",
+			"din kod",
+			"koden är",
+		},
+		LocaleDanish: {
+			"bekræftelseskode",
+			"verifikationskode",
+			"sikkerhedskode",
+			"engangskode",
+			"din kode",
+			"koden er",
+		},
+		LocaleNorwegian: {
+			"bekreftelseskode",
+			"verifiseringskode",
+			"sikkerhetskode",
+			"engangskode",
+			"din kode",
+			"koden er",
+		},
+		LocaleFinnish: {
+			"vahvistuskoodi",
+			"varmennuskoodi",
+			"turvakoodi",
+			"kertakäyttökoodi",
+			"koodisi on",
+		},
+		LocaleTurkish: {
+			"doğrulama kodu",
+			"onay kodu",
+			"güvenlik kodu",
+			"tek kullanımlık şifre",
+			"kodunuz",
+		},
+		LocaleChinese: {
+			"验证码",
+			"驗證碼",
+			"校验码",
+			"动态码",
+			"动态密码",
+		},
+		LocaleJapanese: {
+			"認証コード",
+			"確認コード",
+			"認証番号",
+			"ワンタイムパスワード",
+		},
+		LocaleKorean: {
+			"인증번호",
+			"인증 번호",
+			"인증코드",
+			"확인 코드",
+		},
+	}
+
+	// localeDetectionWords are common words used to guess which languages a message is
+	// written in. CJK locales are detected by script instead, see DetectLocales.
+	localeDetectionWords = map[Locale][]string{
+		LocaleDutch:      {"uw", "je", "deze", "het", "een", "niet", "voor", "bij", "vervalt", "minuten", "geldig"},
+		LocaleGerman:     {"ihr", "dein", "der", "die", "das", "ist", "nicht", "für", "und", "lautet", "gültig"},
+		LocaleFrench:     {"votre", "vous", "ton", "est", "le", "la", "les", "de", "du", "des", "pour", "ne", "pas", "valable", "à"},
+		LocaleSpanish:    {"tu", "su", "es", "el", "los", "para", "no", "con", "válido", "minutos"},
+		LocaleItalian:    {"il", "tuo", "è", "per", "non", "con", "valido", "minuti", "di"},
+		LocalePortuguese: {"seu", "teu", "é", "o", "para", "não", "com", "válido", "minutos"},
+		LocalePolish:     {"twój", "jest", "nie", "dla", "to", "ważny", "minut", "kod"},
+		LocaleSwedish:    {"din", "är", "inte", "för", "och", "giltig", "minuter"},
+		LocaleDanish:     {"din", "er", "ikke", "for", "og", "gyldig", "minutter"},
+		LocaleNorwegian:  {"din", "er", "ikke", "for", "og", "gyldig", "minutter"},
+		LocaleFinnish:    {"on", "koodisi", "ei", "voimassa", "minuuttia"},
+		LocaleTurkish:    {"kodunuz", "için", "ve", "değil", "geçerli", "dakika"},
+	}
+)
+
+// DetectLocales guesses which locale packs apply to a message. English is always
+// included, as brand phrases and loanwords like "sms-code" show up in every language.
+func DetectLocales(text string) []Locale {
+	locales := []Locale{LocaleEnglish}
+
+	words := make(map[string]bool)
+	for _, word := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r)
+	}) {
+		words[word] = true
+	}
+
+	for _, locale := range []Locale{
+		LocaleDutch, LocaleGerman, LocaleFrench, LocaleSpanish, LocaleItalian,
+		LocalePortuguese, LocalePolish, LocaleSwedish, LocaleDanish, LocaleNorwegian,
+		LocaleFinnish, LocaleTurkish,
+	} {
+		hits := 0
+		for _, word := range localeDetectionWords[locale] {
+			if words[word] {
+				hits++
+			}
+		}
+
+		if hits >= minLocaleDetectionHits {
+			locales = append(locales, locale)
+		}
+	}
+
+	var hasHan, hasKana, hasHangul bool
+	for _, r := range text {
+		switch {
+		case unicode.Is(unicode.Han, r):
+			hasHan = true
+		case unicode.In(r, unicode.Hiragana, unicode.Katakana):
+			hasKana = true
+		case unicode.Is(unicode.Hangul, r):
+			hasHangul = true
+		}
+	}
+
+	if hasHan && !hasKana {
+		locales = append(locales, LocaleChinese)
+	}
+	if hasKana {
+		locales = append(locales, LocaleJapanese)
+	}
+	if hasHangul {
+		locales = append(locales, LocaleKorean)
+	}
+
+	return locales
+}
+
+// indicatorsForLocales merges the context indicator packs of the given locales into a
+// single list, without duplicates. Unknown locales are ignored.
+func indicatorsForLocales(locales []Locale) []string {
+	seen := make(map[string]bool)
+	indicators := make([]string, 0)
+
+	for _, locale := range locales {
+		for _, ind := range localeContextIndicators[locale] {
+			if seen[ind] {
+				continue
+			}
+
+			seen[ind] = true
+			indicators = append(indicators, ind)
+		}
+	}
+
+	return indicators
+}
@@ -0,0 +1,124 @@
+package codeextractor
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDetectLocales(t *testing.T) {
+	testMessages := []struct {
+		name    string
+		message string
+		want    []Locale
+	}{
+		{
+			name:    "English only",
+			message: "Your Uber code is 1808. Never share this code.",
+			want:    []Locale{LocaleEnglish},
+		},
+		{
+			name:    "Dutch",
+			message: "Uw sms-code is: 205095. Deze vervalt over 20 minuten.",
+			want:    []Locale{LocaleEnglish, LocaleDutch},
+		},
+		{
+			name:    "German",
+			message: "Ihr Bestätigungscode lautet 482913. Der Code ist 10 Minuten gültig.",
+			want:    []Locale{LocaleEnglish, LocaleGerman},
+		},
+		{
+			name:    "Chinese",
+			message: "【淘宝】您的验证码是482913，5分钟内有效。",
+			want:    []Locale{LocaleEnglish, LocaleChinese},
+		},
+		{
+			name:    "Japanese",
+			message: "認証コードは482913です。",
+			want:    []Locale{LocaleEnglish, LocaleJapanese},
+		},
+	}
+
+	for _, tm := range testMessages {
+		t.Run(tm.name, func(t *testing.T) {
+			assert.Equal(t, tm.want, DetectLocales(tm.message))
+		})
+	}
+}
+
+func TestExtractCodesRanksLocalisedCodesFirst(t *testing.T) {
+	testMessages := []struct {
+		name    string
+		message string
+		want    string
+	}{
+		{
+			name:    "Dutch code after an amount",
+			message: "Betaling van 1250 EUR bij Bol. Uw bevestigingscode: 482913",
+			want:    "482913",
+		},
+		{
+			name:    "German code after an amount",
+			message: "Zahlung über 1250 EUR bei Amazon. Ihr Bestätigungscode lautet: 482913",
+			want:    "482913",
+		},
+		{
+			name:    "French code after a reference number",
+			message: "Commande 7730021 confirmée. Votre code de vérification : 482913",
+			want:    "482913",
+		},
+		{
+			name:    "Spanish code after an amount",
+			message: "Compra de 1250 EUR en Zara. Tu código de verificación es 482913",
+			want:    "482913",
+		},
+		{
+			name:    "Italian code after a reference number",
+			message: "Ordine 7730021 per il tuo acquisto. Il codice di verifica è 482913",
+			want:    "482913",
+		},
+		{
+			name:    "Portuguese code after an amount",
+			message: "Compra de 1250 EUR com cartão. O seu código de verificação é 482913",
+			want:    "482913",
+		},
+		{
+			name:    "Polish code after an amount",
+			message: "Płatność 1250 PLN dla Allegro. Twój kod weryfikacyjny to 482913",
+			want:    "482913",
+		},
+		{
+			name:    "Swedish code after a reference number",
+			message: "Order 7730021 är mottagen. Din verifieringskod är 482913 och giltig i 5 minuter",
+			want:    "482913",
+		},
+		{
+			name:    "Chinese code after an amount",
+			message: "您消费1250元，验证码482913，请勿泄露。",
+			want:    "482913",
+		},
+	}
+
+	for _, tm := range testMessages {
+		t.Run(tm.name, func(t *testing.T) {
+			got, err := ExtractCodes(tm.message)
+
+			assert.NoError(t, err)
+			if assert.NotEmpty(t, got) {
+				assert.Equal(t, tm.want, got[0])
+			}
+		})
+	}
+}
+
+func TestExtractCodesForLocales(t *testing.T) {
+	message := "Kundennummer 7730021. Ihr Bestätigungscode lautet: 482913"
+
+	got, err := ExtractCodesForLocales(message, LocaleEnglish)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"7730021", "482913"}, got)
+
+	got, err = ExtractCodesForLocales(message, LocaleEnglish, LocaleGerman)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"482913", "7730021"}, got)
+}
@@ -0,0 +1,103 @@
+package codeextractor
+
+import (
+	"regexp"
+	"strings"
+)
+
+const (
+	// originBoundScore is added to a code that was bound to an origin, so it always
+	// outranks anything found by the heuristics.
+	originBoundScore = 1000
+
+	// originBoundIndicator is reported in Candidate.Indicators for origin-bound codes.
+	originBoundIndicator = "origin-bound"
+)
+
+var (
+	// originBoundLinePattern matches the last line of an origin-bound one-time code
+	// message, e.g. "@example.com #123456" or "@example.com #123456 @embedded.example".
+	originBoundLinePattern = regexp.MustCompile(`^@([A-Za-z0-9.-]+\.[A-Za-z0-9-]+) #([A-Za-z0-9]+)(?: @([A-Za-z0-9.-]+\.[A-Za-z0-9-]+))?$`)
+
+	// androidAppHashPattern matches the 11 character app hash that ends an Android SMS
+	// Retriever message.
+	androidAppHashPattern = regexp.MustCompile(`^[A-Za-z0-9+/]{11}$`)
+)
+
+// OriginBoundCode is a code bound to a website using the origin-bound one-time code
+// format (https://wicg.github.io/sms-one-time-codes/), as used by Safari.
+type OriginBoundCode struct {
+	// Code is the one-time code from the origin-bound line.
+	Code string
+
+	// TopLevelDomain is the domain of the site the code is for.
+	TopLevelDomain string
+
+	// EmbeddedDomain is set when the code is meant for a site embedded within
+	// TopLevelDomain in an iframe, and is the domain of that embedded site.
+	EmbeddedDomain string
+
+	// Start and End are the byte offsets of Code within the message.
+	Start int
+	End   int
+}
+
+// ParseOriginBoundCode parses the origin-bound line that ends a message like
+// "Your code is 123456.\n\n@example.com #123456". The second return value is false if
+// the message doesn't end with one.
+func ParseOriginBoundCode(text string) (*OriginBoundCode, bool) {
+	trimmed := strings.TrimRight(text, " \t\r\n")
+
+	lineStart := strings.LastIndex(trimmed, "\n") + 1
+	line := trimmed[lineStart:]
+
+	// The spec requires the origin-bound line to follow at least one other line, but we
+	// allow it on its own as some senders drop the human readable part.
+	leading := len(line) - len(strings.TrimLeft(line, " \t"))
+	line = line[leading:]
+	lineStart += leading
+
+	m := originBoundLinePattern.FindStringSubmatchIndex(line)
+	if m == nil {
+		return nil, false
+	}
+
+	bound := &OriginBoundCode{
+		Code:           line[m[4]:m[5]],
+		TopLevelDomain: strings.ToLower(line[m[2]:m[3]]),
+		Start:          lineStart + m[4],
+		End:            lineStart + m[5],
+	}
+	if m[6] != -1 {
+		bound.EmbeddedDomain = strings.ToLower(line[m[6]:m[7]])
+	}
+
+	return bound, true
+}
+
+// ParseAndroidAppHash parses the app hash from an Android SMS Retriever message, which
+// starts with "<#>" and ends with an 11 character hash identifying the app the message is
+// for. The second return value is false if the message isn't in that format.
+func ParseAndroidAppHash(text string) (string, bool) {
+	hash, _, ok := findAndroidAppHash(text)
+
+	return hash, ok
+}
+
+// findAndroidAppHash is ParseAndroidAppHash, but also returns the offset of the hash so
+// it can be excluded from code extraction.
+func findAndroidAppHash(text string) (string, int, bool) {
+	if !strings.HasPrefix(strings.TrimSpace(text), "<#>") {
+		return "", 0, false
+	}
+
+	trimmed := strings.TrimRight(text, " \t\r\n")
+	hashStart := strings.LastIndexAny(trimmed, " \t\r\n") + 1
+	hash := trimmed[hashStart:]
+
+	if !androidAppHashPattern.MatchString(hash) {
+		return "", 0, false
+	}
+
+	return hash, hashStart, true
+}
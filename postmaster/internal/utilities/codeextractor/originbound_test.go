@@ -0,0 +1,123 @@
+package codeextractor
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseOriginBoundCode(t *testing.T) {
+	testMessages := []struct {
+		name    string
+		message string
+		want    *OriginBoundCode
+	}{
+		{
+			name:    "Top-level domain only",
+			message: "838123 is your Tesco authentication code.\n@tesco.com #838123",
+			want: &OriginBoundCode{
+				Code:           "838123",
+				TopLevelDomain: "tesco.com",
+				Start:          54,
+				End:            60,
+			},
+		},
+		{
+			name:    "Embedded domain",
+			message: "Your Example code is 747723.\n\n@Top-Level.example #747723 @embedded.example\n",
+			want: &OriginBoundCode{
+				Code:           "747723",
+				TopLevelDomain: "top-level.example",
+				EmbeddedDomain: "embedded.example",
+				Start:          50,
+				End:            56,
+			},
+		},
+		{
+			name:    "Alphanumeric code",
+			message: "Your code is K9X44P\n@example.com #K9X44P",
+			want: &OriginBoundCode{
+				Code:           "K9X44P",
+				TopLevelDomain: "example.com",
+				Start:          34,
+				End:            40,
+			},
+		},
+		{
+			name:    "Not on the last line",
+			message: "@example.com #123456\nThanks for shopping with us",
+		},
+		{
+			name:    "Missing domain",
+			message: "Your code is 123456\n@ #123456",
+		},
+		{
+			name:    "No origin-bound line",
+			message: "Your Uber code is 1808. Never share this code.",
+		},
+	}
+
+	for _, tm := range testMessages {
+		t.Run(tm.name, func(t *testing.T) {
+			got, ok := ParseOriginBoundCode(tm.message)
+
+			assert.Equal(t, tm.want != nil, ok)
+			assert.Equal(t, tm.want, got)
+			if got != nil {
+				assert.Equal(t, got.Code, tm.message[got.Start:got.End])
+			}
+		})
+	}
+}
+
+func TestParseAndroidAppHash(t *testing.T) {
+	got, ok := ParseAndroidAppHash("<#>Your Deliveroo verification code is: 979700\n/tPjtJT5f8o")
+	assert.True(t, ok)
+	assert.Equal(t, "/tPjtJT5f8o", got)
+
+	got, ok = ParseAndroidAppHash("<#> Your ExampleApp code is: 123ABC78\nFA+9qCX9VSu")
+	assert.True(t, ok)
+	assert.Equal(t, "FA+9qCX9VSu", got)
+
+	_, ok = ParseAndroidAppHash("Your Deliveroo verification code is: 979700\n/tPjtJT5f8o")
+	assert.False(t, ok, "messages without the <#> prefix aren't SMS Retriever messages")
+
+	_, ok = ParseAndroidAppHash("<#>Your Deliveroo verification code is: 979700")
+	assert.False(t, ok, "messages without a trailing hash aren't SMS Retriever messages")
+}
+
+func TestExtractCandidatesPrefersOriginBoundCode(t *testing.T) {
+	message := "Your Shop code is 111111, or use 222222 if that fails.\n\n@shop.example #222222 @pay.example"
+
+	got, err := ExtractCandidates(message)
+	assert.NoError(t, err)
+	if !assert.Len(t, got, 2) {
+		return
+	}
+
+	assert.Equal(t, "222222", got[0].Code)
+	assert.Contains(t, got[0].Indicators, "origin-bound")
+	if assert.NotNil(t, got[0].Origin) {
+		assert.Equal(t, "shop.example", got[0].Origin.TopLevelDomain)
+		assert.Equal(t, "pay.example", got[0].Origin.EmbeddedDomain)
+	}
+
+	assert.Equal(t, "111111", got[1].Code)
+	assert.Nil(t, got[1].Origin)
+}
+
+func TestExtractCandidatesIgnoresAndroidAppHash(t *testing.T) {
+	got, err := ExtractCandidates("<#> Your ExampleApp code is: 482913\nFA+9qCX9VSu")
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"482913"}, codesOf(got))
+}
+
+func codesOf(candidates []Candidate) []string {
+	codes := make([]string, 0, len(candidates))
+	for _, c := range candidates {
+		codes = append(codes, c.Code)
+	}
+
+	return codes
+}
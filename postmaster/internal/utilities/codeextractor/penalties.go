@@ -0,0 +1,182 @@
+package codeextractor
+
+import (
+	"regexp"
+	"strconv"
+)
+
+const (
+	// penaltyContextWindow is how far either side of a code we look for the patterns that
+	// make up a penalty. Penalties describe what the number *is*, so they only look at the
+	// text directly touching it.
+	penaltyContextWindow = 30
+
+	// minimumCodeScore is the score a code must reach to be returned. It is tuned against
+	// the test messages, see TestMinimumCodeScore: real codes without any context score 0
+	// and have to be kept, while every non-code carries a strong penalty. So the floor sits
+	// at the lowest real code, which also drops year-like numbers with no context either
+	// side to outweigh their weak penalty.
+	minimumCodeScore = 0
+
+	// strongPenaltyWeight is used for patterns that are almost never a code. It outweighs
+	// any number of context indicators, as those look far enough back that they often
+	// also cover amounts and card numbers that follow the real code.
+	strongPenaltyWeight = -100
+
+	// weakPenaltyWeight is used for patterns that are suspicious but can be outweighed by a
+	// single context indicator, before or after the code, e.g. a code that happens to look
+	// like a year.
+	weakPenaltyWeight = -3
+)
+
+// penalty describes a pattern near a candidate code that suggests it isn't a code at all,
+// for example a currency symbol in front of it.
+type penalty struct {
+	// name is a short identifier for the penalty, used when explaining a score
+	name string
+
+	// weight is the (negative) amount added to the score when the penalty fires
+	weight int
+
+	// matches reports whether the penalty applies to the code spanning text[start:end]
+	matches func(text string, start, end int) bool
+}
+
+var (
+	currencyBeforePattern = regexp.MustCompile(`(?i)([€$£¥₹]|\b(eur|usd|gbp|chf|pln|sek|nok|dkk|jpy|cny|kr|zł))\s?$`)
+	currencyAfterPattern  = regexp.MustCompile(`(?i)^\s?([€$£¥₹元]|zł|(eur|euro|euros|usd|dollar|dollars|gbp|pounds|chf|pln|sek|nok|dkk|jpy|cny|kr)\b)`)
+	decimalAfterPattern   = regexp.MustCompile(`^[.,]\d{1,2}\b`)
+	thousandsPattern      = regexp.MustCompile(`(^[.,]\d{3}\b)|(\d[.,]$)`)
+
+	dateBeforePattern = regexp.MustCompile(`\d{1,2}[./-]$`)
+	dateAfterPattern  = regexp.MustCompile(`^[./-]\d{1,2}\b`)
+	monthNamePattern  = regexp.MustCompile(`(?i)\b(jan|feb|mar|apr|may|jun|jul|aug|sep|oct|nov|dec|mrt|mei|okt|mär|dez|janv|févr|avr|mai|juin|juil|août|déc|ene|abr|ago|dic)[a-zé]*\.?\s*(\d{1,2}(st|nd|rd|th)?,?\s*)?$`)
+
+	timeAfterPattern = regexp.MustCompile(`(?i)^\s?(uur|uhr|h|hrs|hours|am|pm|heures)\b`)
+
+	phoneBeforePattern      = regexp.MustCompile(`(?i)(\+\d[\d\s\-().]*|\b(call|tel|phone|bel|ring|anrufen|appelez|llame)\b[\s:.]*[\d\s\-()]*)$`)
+	phoneDigitGroupsPattern = regexp.MustCompile(`^[\s-]\d{2,}[\s-]\d{2,}`)
+
+	accountSuffixBeforePattern = regexp.MustCompile(`(?i)(ending( in| with)?|ends in|last (4|four) digits|eindigend op|eindigt op|endet auf|endend auf|se terminant par|terminada en|terminando em|\b(card|kaart|karte|carte|tarjeta|account|rekening|konto|compte|cuenta)|[*x•·]{2,})\s*[:#]?\s*$`)
+
+	referenceBeforePattern = regexp.MustCompile(`(?i)\b(order|ref|reference|referentie|referenz|bestelling|bestelnummer|bestellung|booking|invoice|factuur|rechnung|ticket|tracking)\s*(number|no\.?|nr\.?|nummer)?\s*[:#]?\s*$`)
+
+	// penalties is the set of penalties checked against every candidate code.
+	penalties = []penalty{
+		{
+			name:   "amount",
+			weight: strongPenaltyWeight,
+			matches: func(text string, start, end int) bool {
+				before, after := penaltyContext(text, start, end)
+
+				return currencyBeforePattern.MatchString(before) ||
+					currencyAfterPattern.MatchString(after) ||
+					decimalAfterPattern.MatchString(after) ||
+					thousandsPattern.MatchString(before) ||
+					thousandsPattern.MatchString(after)
+			},
+		},
+		{
+			name:   "date",
+			weight: strongPenaltyWeight,
+			matches: func(text string, start, end int) bool {
+				before, after := penaltyContext(text, start, end)
+
+				return dateBeforePattern.MatchString(before) ||
+					dateAfterPattern.MatchString(after) ||
+					(isYear(text[start:end]) && monthNamePattern.MatchString(before))
+			},
+		},
+		{
+			name:   "year",
+			weight: weakPenaltyWeight,
+			matches: func(text string, start, end int) bool {
+				return isYear(text[start:end])
+			},
+		},
+		{
+			name:   "time",
+			weight: strongPenaltyWeight,
+			matches: func(text string, start, end int) bool {
+				_, after := penaltyContext(text, start, end)
+
+				return end-start == 4 && timeAfterPattern.MatchString(after)
+			},
+		},
+		{
+			name:   "phone_number",
+			weight: strongPenaltyWeight,
+			matches: func(text string, start, end int) bool {
+				before, after := penaltyContext(text, start, end)
+
+				return phoneBeforePattern.MatchString(before) ||
+					phoneDigitGroupsPattern.MatchString(after)
+			},
+		},
+		{
+			name:   "account_suffix",
+			weight: strongPenaltyWeight,
+			matches: func(text string, start, end int) bool {
+				before, _ := penaltyContext(text, start, end)
+
+				return accountSuffixBeforePattern.MatchString(before)
+			},
+		},
+		{
+			name:   "reference_number",
+			weight: strongPenaltyWeight,
+			matches: func(text string, start, end int) bool {
+				before, _ := penaltyContext(text, start, end)
+
+				return referenceBeforePattern.MatchString(before)
+			},
+		},
+	}
+)
+
+// computePenaltyScore sums the weights of every penalty that applies to the code spanning
+// text[start:end], returning the names of the penalties alongside the score. The score is
+// zero or negative.
+func computePenaltyScore(text string, start, end int) (int, []string) {
+	score := 0
+	matched := make([]string, 0)
+
+	for _, p := range penalties {
+		if p.matches(text, start, end) {
+			score += p.weight
+			matched = append(matched, p.name)
+		}
+	}
+
+	return score, matched
+}
+
+// penaltyContext returns the text directly before and after a code, limited to
+// penaltyContextWindow bytes either side.
+func penaltyContext(text string, start, end int) (string, string) {
+	beforeStart := start - penaltyContextWindow
+	if beforeStart < 0 {
+		beforeStart = 0
+	}
+
+	afterEnd := end + penaltyContextWindow
+	if afterEnd > len(text) {
+		afterEnd = len(text)
+	}
+
+	return text[beforeStart:start], text[end:afterEnd]
+}
+
+// isYear reports whether the raw code looks like a year between 1900 and 2099.
+func isYear(raw string) bool {
+	if len(raw) != 4 {
+		return false
+	}
+
+	year, err := strconv.Atoi(raw)
+	if err != nil {
+		return false
+	}
+
+	return year >= 1900 && year <= 2099
+}
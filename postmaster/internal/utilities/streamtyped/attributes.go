@@ -0,0 +1,117 @@
+package streamtyped
+
+import "strings"
+
+// Attribute names Messages uses in the attributedBody of a message.
+const (
+	// MessagePartAttributeName is set on every run, and is the index of the part of the
+	// message the run belongs to.
+	MessagePartAttributeName = "__kIMMessagePartAttributeName"
+
+	// OneTimeCodeAttributeName is set on the run holding a verification code that Messages
+	// recognised itself. Its value is a dictionary with the code under "code".
+	OneTimeCodeAttributeName = "__kIMOneTimeCodeAttributeName"
+
+	// LinkAttributeName is set on a run that Messages turned into a link, and is the URL
+	// it links to.
+	LinkAttributeName = "__kIMLinkAttributeName"
+
+	// DataDetectedAttributeName is set on a run that data detectors recognised as
+	// something, like a date, address or link. Its value is an opaque archive of the
+	// detector's result.
+	DataDetectedAttributeName = "__kIMDataDetectedAttributeName"
+)
+
+// OneTimeCode is a verification code that Messages recognised in a message.
+type OneTimeCode struct {
+	// Code is the code as Messages reported it.
+	Code string
+
+	// Start and End are the byte offsets of the run holding the code within the text.
+	Start int
+	End   int
+}
+
+// Link is a link that Messages recognised in a message.
+type Link struct {
+	// URL is the URL the link points to, which may differ from the text it covers, e.g.
+	// "https://apple.com/account" for "apple.com/account".
+	URL string
+
+	// Start and End are the byte offsets of the run holding the link within the text.
+	Start int
+	End   int
+}
+
+// OneTimeCodes returns the verification codes Messages recognised in the string, in the
+// order they appear. It returns nil if Messages didn't recognise any.
+func (s *AttributedString) OneTimeCodes() []OneTimeCode {
+	var codes []OneTimeCode
+
+	for _, run := range s.Runs {
+		value, ok := run.Attributes[OneTimeCodeAttributeName]
+		if !ok {
+			continue
+		}
+
+		code := oneTimeCodeFromAttribute(value)
+		if code == "" {
+			// Fall back to the text the attribute covers if the value isn't in a shape
+			// we know.
+			code = strings.TrimSpace(s.Text[run.Start:run.End])
+		}
+		if code == "" {
+			continue
+		}
+
+		// Adjacent runs can share the attribute when another attribute changes part way
+		// through the code, so merge them back together.
+		if n := len(codes); n > 0 && codes[n-1].End == run.Start && codes[n-1].Code == code {
+			codes[n-1].End = run.End
+			continue
+		}
+
+		codes = append(codes, OneTimeCode{Code: code, Start: run.Start, End: run.End})
+	}
+
+	return codes
+}
+
+// Links returns the links Messages recognised in the string, in the order they appear.
+// It returns nil if there are none.
+func (s *AttributedString) Links() []Link {
+	var links []Link
+
+	for _, run := range s.Runs {
+		url, ok := run.Attributes[LinkAttributeName].(string)
+		if !ok || url == "" {
+			continue
+		}
+
+		if n := len(links); n > 0 && links[n-1].End == run.Start && links[n-1].URL == url {
+			links[n-1].End = run.End
+			continue
+		}
+
+		links = append(links, Link{URL: url, Start: run.Start, End: run.End})
+	}
+
+	return links
+}
+
+// oneTimeCodeFromAttribute reads the code from the value of a OneTimeCodeAttributeName
+// attribute. It returns an empty string if the value isn't in a shape we know.
+func oneTimeCodeFromAttribute(value any) string {
+	switch v := value.(type) {
+	case string:
+		return strings.TrimSpace(v)
+	case map[string]any:
+		for _, key := range []string{"code", "displayCode"} {
+			if code, ok := v[key].(string); ok && strings.TrimSpace(code) != "" {
+				return strings.TrimSpace(code)
+			}
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,73 @@
+package streamtyped
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOneTimeCodes(t *testing.T) {
+	tests := []struct {
+		name    string
+		fixture string
+		want    []OneTimeCode
+	}{
+		{
+			name:    "No attributes",
+			fixture: "text_only.bin",
+			want:    nil,
+		},
+		{
+			name:    "Code and link",
+			fixture: "one_time_code.bin",
+			want:    []OneTimeCode{{Code: "482913", Start: 23, End: 29}},
+		},
+		{
+			name:    "Code alongside a data detector",
+			fixture: "multiple_runs.bin",
+			want:    []OneTimeCode{{Code: "482913", Start: 13, End: 19}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			attributedString, err := DecodeAttributedString(readFixture(t, tt.fixture))
+
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, attributedString.OneTimeCodes())
+		})
+	}
+}
+
+func TestOneTimeCodesMergesAdjacentRuns(t *testing.T) {
+	attributes := map[string]any{OneTimeCodeAttributeName: map[string]any{"code": "4829"}}
+	attributedString := &AttributedString{
+		Text: "Code 4829",
+		Runs: []AttributeRun{
+			{Start: 0, End: 5},
+			{Start: 5, End: 7, Attributes: attributes},
+			{Start: 7, End: 9, Attributes: attributes},
+		},
+	}
+
+	assert.Equal(t, []OneTimeCode{{Code: "4829", Start: 5, End: 9}}, attributedString.OneTimeCodes())
+}
+
+func TestOneTimeCodesFallsBackToText(t *testing.T) {
+	attributedString := &AttributedString{
+		Text: "Code 4829",
+		Runs: []AttributeRun{
+			{Start: 0, End: 5},
+			{Start: 5, End: 9, Attributes: map[string]any{OneTimeCodeAttributeName: int64(1)}},
+		},
+	}
+
+	assert.Equal(t, []OneTimeCode{{Code: "4829", Start: 5, End: 9}}, attributedString.OneTimeCodes())
+}
+
+func TestLinks(t *testing.T) {
+	attributedString, err := DecodeAttributedString(readFixture(t, "one_time_code.bin"))
+
+	assert.NoError(t, err)
+	assert.Equal(t, []Link{{URL: "https://apple.com/account", Start: 47, End: 64}}, attributedString.Links())
+}
@@ -0,0 +1,607 @@
+package streamtyped
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// Tags are single bytes that take the place of an integer, and say what follows. Any
+// other value in a tag position is the start of a reference to something decoded earlier.
+const (
+	// tagInt16 says the integer is in the next two bytes.
+	tagInt16 = 0x81
+
+	// tagInt32 says the integer is in the next four bytes.
+	tagInt32 = 0x82
+
+	// tagFloat says a float or double is in the next four or eight bytes.
+	tagFloat = 0x83
+
+	// tagNew says a new object, class or shared string follows.
+	tagNew = 0x84
+
+	// tagNil is a nil object, class or shared string.
+	tagNil = 0x85
+
+	// tagEndOfObject marks the end of the contents of an object.
+	tagEndOfObject = 0x86
+
+	// firstReferenceNumber is the value of the reference to the first entry in a table.
+	firstReferenceNumber = -110
+)
+
+var (
+	ErrStreamTypedUnsupportedVersion = errors.New("streamtyped version is unsupported")
+	ErrStreamTypedInvalidReference   = errors.New("streamtyped reference is invalid")
+	ErrStreamTypedUnsupportedType    = errors.New("streamtyped type encoding is unsupported")
+	ErrStreamTypedUnexpectedTag      = errors.New("streamtyped tag is unexpected")
+	ErrStreamTypedInvalidLength      = errors.New("streamtyped length is invalid")
+)
+
+// DecodeError is returned when a typedstream can't be decoded, and records where in the
+// buffer decoding failed.
+type DecodeError struct {
+	// Offset is the position in the buffer where decoding failed.
+	Offset int
+
+	// Err is the reason decoding failed.
+	Err error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("%v at offset %d", e.Err, e.Offset)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// Class is an Objective-C class as recorded in a typedstream.
+type Class struct {
+	Name       string
+	Version    int64
+	Superclass *Class
+}
+
+// Is reports whether the class is, or inherits from, the named class.
+func (c *Class) Is(name string) bool {
+	for class := c; class != nil; class = class.Superclass {
+		if class.Name == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Object is an Objective-C object as recorded in a typedstream. Its contents are the
+// groups of values its class wrote when it was archived.
+type Object struct {
+	Class  *Class
+	Groups []Group
+}
+
+// Group is a set of values that were written together under one type encoding, e.g. the
+// "iI" group holds an int and an unsigned int.
+//
+// Values are int64 for integers, float64 for floats and doubles, string for C strings,
+// selectors and atoms, []byte for byte buffers and char arrays, *Object for objects,
+// *Class for classes and []any for structs and other arrays.
+type Group struct {
+	Type   string
+	Values []any
+}
+
+// decoder walks a typedstream buffer, keeping track of the shared strings and objects
+// seen so far so later references to them can be resolved.
+type decoder struct {
+	buffer []byte
+	offset int
+	order  binary.ByteOrder
+
+	sharedStrings []string
+
+	// objects holds both objects and classes, as they share a reference table.
+	objects []any
+}
+
+// Decode decodes a typedstream buffer, as written by NSArchiver, into the groups of
+// values at its top level.
+func Decode(buffer []byte) ([]Group, error) {
+	d := &decoder{buffer: buffer}
+
+	if err := d.readHeader(); err != nil {
+		return nil, d.wrapError(err)
+	}
+
+	groups := make([]Group, 0)
+	for d.offset < len(d.buffer) {
+		group, err := d.readGroup()
+		if err != nil {
+			return nil, d.wrapError(err)
+		}
+
+		groups = append(groups, group)
+	}
+
+	return groups, nil
+}
+
+func (d *decoder) wrapError(err error) error {
+	return errors.Join(ErrInvalidStreamTypedBuffer, &DecodeError{Offset: d.offset, Err: err})
+}
+
+// readHeader reads the streamer version, the signature and the system version that start
+// every typedstream. The signature also says which byte order the stream was written in.
+func (d *decoder) readHeader() error {
+	// The header is always little endian, so we can read it before we know the order.
+	d.order = binary.LittleEndian
+
+	version, err := d.readInteger()
+	if err != nil {
+		return err
+	}
+	if version != streamTypedVersion {
+		return ErrStreamTypedUnsupportedVersion
+	}
+
+	signature, err := d.readUnsharedBytes()
+	if err != nil {
+		return err
+	}
+
+	switch string(signature) {
+	case streamTypedSignatureLittleEndian:
+		d.order = binary.LittleEndian
+	case streamTypedSignatureBigEndian:
+		d.order = binary.BigEndian
+	default:
+		return ErrStreamTypedMagicMismatch
+	}
+
+	// The system version isn't needed for decoding, but has to be read past.
+	if _, err := d.readInteger(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (d *decoder) readByte() (byte, error) {
+	if d.offset >= len(d.buffer) {
+		return 0, ErrStreamTypedBufferTooShort
+	}
+
+	b := d.buffer[d.offset]
+	d.offset++
+
+	return b, nil
+}
+
+func (d *decoder) peekByte() (byte, error) {
+	if d.offset >= len(d.buffer) {
+		return 0, ErrStreamTypedBufferTooShort
+	}
+
+	return d.buffer[d.offset], nil
+}
+
+func (d *decoder) readBytes(n int) ([]byte, error) {
+	if n < 0 {
+		return nil, ErrStreamTypedInvalidLength
+	}
+	if n > len(d.buffer)-d.offset {
+		return nil, ErrStreamTypedBufferTooShort
+	}
+
+	b := d.buffer[d.offset : d.offset+n]
+	d.offset += n
+
+	return b, nil
+}
+
+// readInteger reads an integer, which is either a single signed byte, or a tag followed
+// by a 16 or 32 bit value.
+func (d *decoder) readInteger() (int64, error) {
+	head, err := d.readByte()
+	if err != nil {
+		return 0, err
+	}
+
+	return d.readIntegerWithHead(head)
+}
+
+func (d *decoder) readIntegerWithHead(head byte) (int64, error) {
+	switch head {
+	case tagInt16:
+		b, err := d.readBytes(2)
+		if err != nil {
+			return 0, err
+		}
+
+		return int64(int16(d.order.Uint16(b))), nil
+	case tagInt32:
+		b, err := d.readBytes(4)
+		if err != nil {
+			return 0, err
+		}
+
+		return int64(int32(d.order.Uint32(b))), nil
+	case tagFloat, tagNew, tagNil, tagEndOfObject:
+		return 0, ErrStreamTypedUnexpectedTag
+	default:
+		return int64(int8(head)), nil
+	}
+}
+
+// readFloat reads a float or double, which is either a tag followed by the raw value, or
+// an integer for values that are whole numbers.
+func (d *decoder) readFloat(size int) (float64, error) {
+	head, err := d.readByte()
+	if err != nil {
+		return 0, err
+	}
+
+	if head != tagFloat {
+		i, err := d.readIntegerWithHead(head)
+		return float64(i), err
+	}
+
+	b, err := d.readBytes(size)
+	if err != nil {
+		return 0, err
+	}
+
+	if size == 4 {
+		return float64(math.Float32frombits(d.order.Uint32(b))), nil
+	}
+
+	return math.Float64frombits(d.order.Uint64(b)), nil
+}
+
+// readTag reads the byte in a tag position. If it isn't tagNew or tagNil, it is the start
+// of a reference, and the index it refers to is returned.
+func (d *decoder) readTag() (byte, int, error) {
+	head, err := d.readByte()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	switch head {
+	case tagNew, tagNil:
+		return head, 0, nil
+	case tagEndOfObject, tagFloat:
+		return 0, 0, ErrStreamTypedUnexpectedTag
+	}
+
+	ref, err := d.readIntegerWithHead(head)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return 0, int(ref - firstReferenceNumber), nil
+}
+
+// readUnsharedBytes reads a length prefixed buffer.
+func (d *decoder) readUnsharedBytes() ([]byte, error) {
+	length, err := d.readInteger()
+	if err != nil {
+		return nil, err
+	}
+	if length < 0 {
+		return nil, ErrStreamTypedInvalidLength
+	}
+	if length > int64(len(d.buffer)-d.offset) {
+		return nil, ErrStreamTypedBufferTooShort
+	}
+
+	return d.readBytes(int(length))
+}
+
+// readSharedString reads a string that is either new, nil, or a reference to a string
+// read earlier. The second return value is false for nil.
+func (d *decoder) readSharedString() (string, bool, error) {
+	tag, ref, err := d.readTag()
+	if err != nil {
+		return "", false, err
+	}
+
+	switch tag {
+	case tagNil:
+		return "", false, nil
+	case tagNew:
+		b, err := d.readUnsharedBytes()
+		if err != nil {
+			return "", false, err
+		}
+
+		d.sharedStrings = append(d.sharedStrings, string(b))
+		return string(b), true, nil
+	}
+
+	if ref < 0 || ref >= len(d.sharedStrings) {
+		return "", false, ErrStreamTypedInvalidReference
+	}
+
+	return d.sharedStrings[ref], true, nil
+}
+
+// readClass reads a class and its superclasses. Nil marks the end of the chain.
+func (d *decoder) readClass() (*Class, error) {
+	tag, ref, err := d.readTag()
+	if err != nil {
+		return nil, err
+	}
+
+	switch tag {
+	case tagNil:
+		return nil, nil
+	case tagNew:
+		name, ok, err := d.readSharedString()
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, ErrStreamTypedInvalidReference
+		}
+
+		version, err := d.readInteger()
+		if err != nil {
+			return nil, err
+		}
+
+		class := &Class{Name: name, Version: version}
+		d.objects = append(d.objects, class)
+
+		class.Superclass, err = d.readClass()
+		if err != nil {
+			return nil, err
+		}
+
+		// The superclass can be a reference back to this class, which would make the
+		// hierarchy endless.
+		for superclass := class.Superclass; superclass != nil; superclass = superclass.Superclass {
+			if superclass == class {
+				return nil, ErrStreamTypedInvalidReference
+			}
+		}
+
+		return class, nil
+	}
+
+	if ref < 0 || ref >= len(d.objects) {
+		return nil, ErrStreamTypedInvalidReference
+	}
+
+	class, ok := d.objects[ref].(*Class)
+	if !ok {
+		return nil, ErrStreamTypedInvalidReference
+	}
+
+	return class, nil
+}
+
+// readObject reads an object, its class, and the groups of values it was archived with
+// up to the end of object tag.
+func (d *decoder) readObject() (*Object, error) {
+	tag, ref, err := d.readTag()
+	if err != nil {
+		return nil, err
+	}
+
+	switch tag {
+	case tagNil:
+		return nil, nil
+	case tagNew:
+		// The object is registered before its class, as that's the order references
+		// were handed out in when it was archived.
+		object := &Object{Groups: make([]Group, 0)}
+		d.objects = append(d.objects, object)
+
+		object.Class, err = d.readClass()
+		if err != nil {
+			return nil, err
+		}
+
+		for {
+			next, err := d.peekByte()
+			if err != nil {
+				return nil, err
+			}
+
+			if next == tagEndOfObject {
+				d.offset++
+				return object, nil
+			}
+
+			group, err := d.readGroup()
+			if err != nil {
+				return nil, err
+			}
+
+			object.Groups = append(object.Groups, group)
+		}
+	}
+
+	if ref < 0 || ref >= len(d.objects) {
+		return nil, ErrStreamTypedInvalidReference
+	}
+
+	object, ok := d.objects[ref].(*Object)
+	if !ok {
+		return nil, ErrStreamTypedInvalidReference
+	}
+
+	return object, nil
+}
+
+// readGroup reads a type encoding, and then a value for each type in it.
+func (d *decoder) readGroup() (Group, error) {
+	encoding, ok, err := d.readSharedString()
+	if err != nil {
+		return Group{}, err
+	}
+	if !ok {
+		return Group{}, ErrStreamTypedUnsupportedType
+	}
+
+	types, err := splitTypeEncoding(encoding)
+	if err != nil {
+		return Group{}, err
+	}
+
+	group := Group{Type: encoding, Values: make([]any, 0, len(types))}
+	for _, t := range types {
+		value, err := d.readValue(t)
+		if err != nil {
+			return Group{}, err
+		}
+
+		group.Values = append(group.Values, value)
+	}
+
+	return group, nil
+}
+
+// readValue reads a single value of the given type encoding.
+func (d *decoder) readValue(encoding string) (any, error) {
+	if encoding == "" {
+		return nil, ErrStreamTypedUnsupportedType
+	}
+
+	switch encoding[0] {
+	case 'c', 'C', 's', 'S', 'i', 'I', 'l', 'L', 'q', 'Q', 'B':
+		return d.readInteger()
+	case 'f':
+		return d.readFloat(4)
+	case 'd':
+		return d.readFloat(8)
+	case '@':
+		return d.readObject()
+	case '#':
+		return d.readClass()
+	case '*', ':', '%':
+		s, _, err := d.readSharedString()
+		return s, err
+	case '+':
+		return d.readUnsharedBytes()
+	case '[':
+		return d.readArray(encoding)
+	case '{':
+		return d.readStruct(encoding)
+	}
+
+	return nil, ErrStreamTypedUnsupportedType
+}
+
+// readArray reads a fixed length array, e.g. "[16c]". Arrays of chars are stored as raw
+// bytes, anything else as a value per element.
+func (d *decoder) readArray(encoding string) (any, error) {
+	i := 1
+	for i < len(encoding) && encoding[i] >= '0' && encoding[i] <= '9' {
+		i++
+	}
+
+	count, err := strconv.Atoi(encoding[1:i])
+	if err != nil || encoding[len(encoding)-1] != ']' {
+		return nil, ErrStreamTypedUnsupportedType
+	}
+
+	element := encoding[i : len(encoding)-1]
+	if element == "" {
+		return nil, ErrStreamTypedUnsupportedType
+	}
+	if element == "c" || element == "C" {
+		return d.readBytes(count)
+	}
+
+	values := make([]any, 0)
+	for n := 0; n < count; n++ {
+		value, err := d.readValue(element)
+		if err != nil {
+			return nil, err
+		}
+
+		values = append(values, value)
+	}
+
+	return values, nil
+}
+
+// readStruct reads a struct, e.g. "{_NSRange=QQ}", as a value per field.
+func (d *decoder) readStruct(encoding string) (any, error) {
+	start := 1
+	for start < len(encoding) && encoding[start] != '=' {
+		start++
+	}
+	if start >= len(encoding)-1 || encoding[len(encoding)-1] != '}' {
+		return nil, ErrStreamTypedUnsupportedType
+	}
+
+	fields, err := splitTypeEncoding(encoding[start+1 : len(encoding)-1])
+	if err != nil {
+		return nil, err
+	}
+
+	values := make([]any, 0, len(fields))
+	for _, field := range fields {
+		value, err := d.readValue(field)
+		if err != nil {
+			return nil, err
+		}
+
+		values = append(values, value)
+	}
+
+	return values, nil
+}
+
+// splitTypeEncoding splits a type encoding like "iI" or "{_NSRange=QQ}@" into the
+// encoding of each value in it.
+func splitTypeEncoding(encoding string) ([]string, error) {
+	types := make([]string, 0)
+
+	for i := 0; i < len(encoding); {
+		end, err := typeEncodingEnd(encoding, i)
+		if err != nil {
+			return nil, err
+		}
+
+		types = append(types, encoding[i:end])
+		i = end
+	}
+
+	return types, nil
+}
+
+// typeEncodingEnd returns the position directly after the single type encoding starting
+// at encoding[start].
+func typeEncodingEnd(encoding string, start int) (int, error) {
+	var open, close byte
+	switch encoding[start] {
+	case '[':
+		open, close = '[', ']'
+	case '{':
+		open, close = '{', '}'
+	default:
+		return start + 1, nil
+	}
+
+	depth := 0
+	for i := start; i < len(encoding); i++ {
+		switch encoding[i] {
+		case open:
+			depth++
+		case close:
+			depth--
+			if depth == 0 {
+				return i + 1, nil
+			}
+		}
+	}
+
+	return 0, ErrStreamTypedUnsupportedType
+}
@@ -1,84 +1,283 @@
 package streamtyped
 
 import (
-	"bytes"
 	"errors"
+	"strings"
 	"unicode/utf8"
 
 	"github.com/0xdeafcafe/pillar-box/server/internal/utilities/ptr"
 )
 
 var (
-	// encodedMessageHeader is the binary trailer indicator for a message. Instead of
-	// spending a day reversing this deprecated and undocumented format, this works fine.
-	encodedMessageTrailer = []byte{0x86, 0x84, 0x02, 0x69, 0x49, 0x01}
+	ErrInvalidStreamTypedBuffer  = errors.New("invalid streamtyped buffer")
+	ErrStreamTypedBufferTooShort = errors.New("streamtyped buffer too short")
+	ErrStreamTypedMagicMismatch  = errors.New("streamtyped magic mismatch")
+	ErrStreamTypedMessageInvalid = errors.New("streamtyped message is invalid")
+)
 
-	// streamTypedMagic is the magic bytes that identify a streamtyped buffer.
-	streamTypedMagic = []byte{0x04, 0x0b}
+const (
+	// streamTypedVersion is the only version of the typedstream format we support, and the
+	// only one macOS has written for decades.
+	streamTypedVersion = 4
 
-	// streamTypedIdentifier is the identifier for a streamtyped buffer.
-	streamTypedIdentifier = []byte("streamtyped")
+	// streamTypedSignatureLittleEndian is the signature of a typedstream written in little
+	// endian byte order, which is what every Mac since the Intel switch writes.
+	streamTypedSignatureLittleEndian = "streamtyped"
 
-	ErrInvalidStreamTypedBuffer    = errors.New("invalid streamtyped buffer")
-	ErrStreamTypedBufferTooShort   = errors.New("streamtyped buffer too short")
-	ErrStreamTypedMagicMismatch    = errors.New("streamtyped magic mismatch")
-	ErrStreamTypedNoMessageTrailer = errors.New("streamtyped message has no trailer")
-	ErrStreamTypedMessageInvalid   = errors.New("streamtyped message is invalid")
+	// streamTypedSignatureBigEndian is the signature of a typedstream written in big endian
+	// byte order.
+	streamTypedSignatureBigEndian = "typedstream"
 )
 
-const (
-	// encodedMessageOffset is the offset of the encoded buffer that the actual message
-	// data (in utf-8 encoding) is located.
-	encodedMessageOffset = 0x7a
+// AttributedString is a decoded NSAttributedString.
+type AttributedString struct {
+	// Text is the plain text of the string.
+	Text string
+
+	// Runs are the ranges of Text that share a set of attributes, in order.
+	Runs []AttributeRun
+}
 
-	// streamTypedIdentifierOffset is the offset of the streamtyped identifier in the buffer.
-	streamTypedIdentifierOffset = 0x02
+// AttributeRun is a range of an AttributedString that shares a set of attributes.
+type AttributeRun struct {
+	// Start and End are the byte offsets of the run within AttributedString.Text. These
+	// are converted from the UTF-16 offsets Foundation uses.
+	Start int
+	End   int
 
-	// streamTypedIdentifierLength is the length of the streamtyped identifier.
-	streamTypedIdentifierLength = 0x0a
-)
+	// Attributes are the attributes of the run, keyed by attribute name. Values are
+	// converted to Go types where we know how, see objectValue.
+	Attributes map[string]any
+}
 
 // ExtractMessageFromStreamTypedBuffer extracts the message from a buffer encoded in the
 // streamtyped format.
 func ExtractMessageFromStreamTypedBuffer(buffer []byte) (*string, error) {
-	if len(buffer) < encodedMessageOffset {
-		return nil, errors.Join(ErrInvalidStreamTypedBuffer, ErrStreamTypedBufferTooShort)
+	attributedString, err := DecodeAttributedString(buffer)
+	if err != nil {
+		return nil, err
+	}
+
+	return ptr.Ptr(attributedString.Text), nil
+}
+
+// DecodeAttributedString decodes an NSAttributedString, like the attributedBody column of
+// the Messages database, from a buffer encoded in the streamtyped format.
+func DecodeAttributedString(buffer []byte) (*AttributedString, error) {
+	groups, err := Decode(buffer)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(groups) == 0 || len(groups[0].Values) != 1 {
+		return nil, errors.Join(ErrInvalidStreamTypedBuffer, ErrStreamTypedMessageInvalid)
 	}
 
-	if !bytes.HasPrefix(buffer, streamTypedMagic) {
-		return nil, errors.Join(ErrInvalidStreamTypedBuffer, ErrStreamTypedMagicMismatch)
+	root, ok := groups[0].Values[0].(*Object)
+	if !ok || root == nil || !root.Class.Is("NSAttributedString") {
+		return nil, errors.Join(ErrInvalidStreamTypedBuffer, ErrStreamTypedMessageInvalid)
 	}
 
-	bufferIdentifier := buffer[streamTypedIdentifierOffset : streamTypedIdentifierOffset+streamTypedIdentifierLength]
-	if bytes.Compare(bufferIdentifier, streamTypedIdentifier) == 0 {
-		return nil, errors.Join(ErrInvalidStreamTypedBuffer, ErrStreamTypedMagicMismatch)
+	return attributedStringFromObject(root)
+}
+
+// attributedStringFromObject reads an NSAttributedString (or one of its subclasses). It is
+// archived as its string, followed by a run for each range of attributes. Each run is an
+// "iI" group of the 1-based index of its attributes and its length in UTF-16 code units.
+// The first time a set of attributes is used it follows the run as an NSDictionary.
+func attributedStringFromObject(object *Object) (*AttributedString, error) {
+	if len(object.Groups) == 0 {
+		return nil, errors.Join(ErrInvalidStreamTypedBuffer, ErrStreamTypedMessageInvalid)
 	}
 
-	removeMessagePrefix := buffer[encodedMessageOffset:]
-	messageEnd := bytes.Index(removeMessagePrefix, encodedMessageTrailer)
-	if messageEnd == -1 {
-		return nil, errors.Join(ErrInvalidStreamTypedBuffer, ErrStreamTypedNoMessageTrailer)
+	text, ok := stringFromGroup(object.Groups[0])
+	if !ok {
+		return nil, errors.Join(ErrInvalidStreamTypedBuffer, ErrStreamTypedMessageInvalid)
 	}
 
-	messageWithPossibleNoise := removeMessagePrefix[:messageEnd]
-	message := lazyRemoveNonUTF8(messageWithPossibleNoise)
+	offsets := utf16Offsets(text)
+	attributedString := &AttributedString{Text: text, Runs: make([]AttributeRun, 0)}
+	attributes := make([]map[string]any, 0)
+	location := 0
+
+	for i := 1; i < len(object.Groups); i++ {
+		group := object.Groups[i]
+		if group.Type != "iI" || len(group.Values) != 2 {
+			return nil, errors.Join(ErrInvalidStreamTypedBuffer, ErrStreamTypedMessageInvalid)
+		}
+
+		index, _ := group.Values[0].(int64)
+		length, _ := group.Values[1].(int64)
+		if length < 0 || location+int(length) > len(offsets)-1 {
+			return nil, errors.Join(ErrInvalidStreamTypedBuffer, ErrStreamTypedMessageInvalid)
+		}
+
+		if i+1 < len(object.Groups) && object.Groups[i+1].Type == "@" {
+			i++
+
+			dictionary, _ := objectValue(object.Groups[i].Values[0]).(map[string]any)
+			attributes = append(attributes, dictionary)
+		}
+
+		run := AttributeRun{
+			Start: offsets[location],
+			End:   offsets[location+int(length)],
+		}
+		if index >= 1 && int(index) <= len(attributes) {
+			run.Attributes = attributes[index-1]
+		}
+
+		attributedString.Runs = append(attributedString.Runs, run)
+		location += int(length)
+	}
 
-	return ptr.Ptr(string(message)), nil
+	return attributedString, nil
 }
 
-// lazyRemoveNonUTF8 removes non-utf8 characters from a buffer. I can't be fucked to figure
-// out how this NSArchived data structure works on all macOS versions, so this will do.
-func lazyRemoveNonUTF8(buffer []byte) []byte {
+// stringFromGroup reads the text of an NSString (or NSMutableString) from a group holding
+// one.
+func stringFromGroup(group Group) (string, bool) {
+	if len(group.Values) != 1 {
+		return "", false
+	}
+
+	object, ok := group.Values[0].(*Object)
+	if !ok || object == nil || object.Class == nil || !object.Class.Is("NSString") {
+		return "", false
+	}
+
+	s, ok := objectValue(object).(string)
+	return s, ok
+}
+
+// objectValue converts the Foundation objects commonly found in message attributes into
+// their Go equivalents. NSString and NSURL become string, NSNumber becomes int64 or
+// float64, NSData becomes []byte, NSArray becomes []any and NSDictionary becomes
+// map[string]any. Anything else is returned as the *Object itself, as is an object
+// that contains itself, which a malformed buffer can do.
+func objectValue(value any) any {
+	return convertObject(value, make(map[*Object]bool))
+}
+
+// convertObject is objectValue, keeping track of the objects being converted so one
+// that contains itself isn't converted forever.
+func convertObject(value any, converting map[*Object]bool) any {
+	object, ok := value.(*Object)
+	if !ok || object == nil || object.Class == nil || converting[object] {
+		return value
+	}
+
+	converting[object] = true
+	defer delete(converting, object)
+
+	switch {
+	case object.Class.Is("NSString"):
+		// Archived as the UTF-8 bytes of the string.
+		for _, group := range object.Groups {
+			if group.Type == "+" && len(group.Values) == 1 {
+				if b, ok := group.Values[0].([]byte); ok {
+					return decodeUTF8(b)
+				}
+			}
+		}
+	case object.Class.Is("NSValue"):
+		// Archived as the type encoding of the value, then the value itself.
+		if len(object.Groups) == 2 && len(object.Groups[1].Values) == 1 {
+			return object.Groups[1].Values[0]
+		}
+	case object.Class.Is("NSData"):
+		// Archived as the length, then the bytes as a char array.
+		if len(object.Groups) == 2 && len(object.Groups[1].Values) == 1 {
+			return object.Groups[1].Values[0]
+		}
+	case object.Class.Is("NSURL"):
+		// Archived as whether it has a base URL, the base URL if it does, then its string.
+		if len(object.Groups) > 0 {
+			last := object.Groups[len(object.Groups)-1]
+			if len(last.Values) == 1 {
+				if s, ok := convertObject(last.Values[0], converting).(string); ok {
+					return s
+				}
+			}
+		}
+	case object.Class.Is("NSArray"):
+		// Archived as the count, then each element.
+		elements := make([]any, 0)
+		for _, group := range object.Groups[min(1, len(object.Groups)):] {
+			for _, v := range group.Values {
+				elements = append(elements, convertObject(v, converting))
+			}
+		}
+
+		return elements
+	case object.Class.Is("NSDictionary"):
+		// Archived as the count, then alternating keys and values.
+		dictionary := make(map[string]any)
+		values := make([]any, 0)
+		for _, group := range object.Groups[min(1, len(object.Groups)):] {
+			values = append(values, group.Values...)
+		}
+
+		for i := 0; i+1 < len(values); i += 2 {
+			key, ok := convertObject(values[i], converting).(string)
+			if !ok {
+				continue
+			}
+
+			dictionary[key] = convertObject(values[i+1], converting)
+		}
+
+		return dictionary
+	}
+
+	return object
+}
+
+// utf16Offsets maps each UTF-16 offset into text, as used by Foundation, to a byte
+// offset. The returned slice has an entry for the end of the text too.
+func utf16Offsets(text string) []int {
+	offsets := make([]int, 0, len(text)+1)
+	for i, r := range text {
+		offsets = append(offsets, i)
+		// Runes outside the Basic Multilingual Plane are a surrogate pair in UTF-16.
+		if r > 0xFFFF {
+			offsets = append(offsets, i)
+		}
+	}
+
+	return append(offsets, len(text))
+}
+
+// decodeUTF8 turns the bytes of an archived NSString into a string. Archived strings
+// should always be valid UTF-8, but corrupt rows do turn up, so rather than dropping the
+// whole message each invalid byte is replaced with utf8.RuneError. A multi-byte sequence
+// cut short by the end of the buffer is replaced with a single utf8.RuneError, as it was
+// one character before it was truncated.
+func decodeUTF8(buffer []byte) string {
 	if utf8.Valid(buffer) {
-		return buffer
+		return string(buffer)
 	}
 
-	var utf8Buffer []byte
-	for _, r := range string(buffer) {
-		if r < utf8.RuneSelf {
-			utf8Buffer = append(utf8Buffer, byte(r))
+	var sb strings.Builder
+	sb.Grow(len(buffer))
+
+	for len(buffer) > 0 {
+		r, size := utf8.DecodeRune(buffer)
+		if r != utf8.RuneError || size > 1 {
+			sb.Write(buffer[:size])
+			buffer = buffer[size:]
+			continue
 		}
+
+		sb.WriteRune(utf8.RuneError)
+
+		// The rest of the buffer is the start of a character that was truncated.
+		if !utf8.FullRune(buffer) {
+			break
+		}
+
+		buffer = buffer[1:]
 	}
 
-	return utf8Buffer
+	return sb.String()
 }
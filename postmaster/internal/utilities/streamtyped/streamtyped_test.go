@@ -0,0 +1,331 @@
+package streamtyped
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// The synthetic fixtures in testdata are written by testdata/gen, and real messages are
+// captured into testdata/captured by testdata/capture.
+//go:generate go run ./testdata/gen
+
+func readFixture(t *testing.T, name string) []byte {
+	t.Helper()
+
+	buffer, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatalf("reading fixture %s: %v", name, err)
+	}
+
+	return buffer
+}
+
+func TestDecodeAttributedString(t *testing.T) {
+	tests := []struct {
+		name    string
+		fixture string
+		want    *AttributedString
+	}{
+		{
+			name:    "Text only",
+			fixture: "text_only.bin",
+			want: &AttributedString{
+				Text: "Your Uber code is 1808. Never share this code. Reply STOP ending in 5910 to unsubscribe.",
+				Runs: []AttributeRun{
+					{Start: 0, End: 88, Attributes: map[string]any{MessagePartAttributeName: int64(0)}},
+				},
+			},
+		},
+		{
+			name:    "Multiple runs",
+			fixture: "multiple_runs.bin",
+			want: &AttributedString{
+				Text: "Your code is 482913. Don't share it.",
+				Runs: []AttributeRun{
+					{Start: 0, End: 13, Attributes: map[string]any{MessagePartAttributeName: int64(0)}},
+					{Start: 13, End: 19, Attributes: map[string]any{
+						MessagePartAttributeName:  int64(0),
+						OneTimeCodeAttributeName:  map[string]any{"code": "482913"},
+						DataDetectedAttributeName: []byte{0x01, 0x02, 0x03},
+					}},
+					{Start: 19, End: 36, Attributes: map[string]any{MessagePartAttributeName: int64(0)}},
+				},
+			},
+		},
+		{
+			name:    "Long text",
+			fixture: "long_text.bin",
+			want: &AttributedString{
+				Text: "Je verificatiecode voor je account is 771204. Deze code is 10 minuten geldig. Deel deze code nooit met iemand, ook niet met medewerkers van de klantenservice.",
+				Runs: []AttributeRun{
+					{Start: 0, End: 158, Attributes: map[string]any{MessagePartAttributeName: int64(0)}},
+				},
+			},
+		},
+		{
+			name:    "Mutable subclasses",
+			fixture: "mutable.bin",
+			want: &AttributedString{
+				Text: "G-123456 is your Google verification code.",
+				Runs: []AttributeRun{
+					{Start: 0, End: 42, Attributes: map[string]any{MessagePartAttributeName: int64(0)}},
+				},
+			},
+		},
+		{
+			name:    "Unicode",
+			fixture: "unicode.bin",
+			want: &AttributedString{
+				Text: "您的验证码是 482913 🔐",
+				Runs: []AttributeRun{
+					{Start: 0, End: 19, Attributes: map[string]any{MessagePartAttributeName: int64(0)}},
+					{Start: 19, End: 30, Attributes: map[string]any{MessagePartAttributeName: int64(0)}},
+				},
+			},
+		},
+		{
+			name:    "Big endian",
+			fixture: "big_endian.bin",
+			want: &AttributedString{
+				Text: "Your code is 5512",
+				Runs: []AttributeRun{
+					{Start: 0, End: 17, Attributes: map[string]any{MessagePartAttributeName: int64(300)}},
+				},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := DecodeAttributedString(readFixture(t, tt.fixture))
+
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestExtractMessageFromStreamTypedBuffer(t *testing.T) {
+	got, err := ExtractMessageFromStreamTypedBuffer(readFixture(t, "text_only.bin"))
+
+	assert.NoError(t, err)
+	if assert.NotNil(t, got) {
+		assert.Equal(t, "Your Uber code is 1808. Never share this code. Reply STOP ending in 5910 to unsubscribe.", *got)
+	}
+}
+
+func TestDecodeCapturedAttributedBodies(t *testing.T) {
+	paths, err := filepath.Glob(filepath.Join("testdata", "captured", "*.json"))
+	if err != nil {
+		t.Fatalf("finding captures: %v", err)
+	}
+	if len(paths) == 0 {
+		t.Skip("no messages captured from chat.db, see testdata/capture")
+	}
+
+	for _, path := range paths {
+		buf, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("reading capture: %v", err)
+		}
+
+		var captured struct {
+			MacOSVersion string `json:"macos_version"`
+			Text         string `json:"text"`
+		}
+		if err := json.Unmarshal(buf, &captured); err != nil {
+			t.Fatalf("decoding capture %s: %v", path, err)
+		}
+
+		name := strings.TrimSuffix(filepath.Base(path), ".json")
+		t.Run(fmt.Sprintf("%s macOS %s", name, captured.MacOSVersion), func(t *testing.T) {
+			got, err := DecodeAttributedString(readFixture(t, filepath.Join("captured", name+".bin")))
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			// Messages writes the text column separately, so the decoded text must match it.
+			assert.Equal(t, captured.Text, got.Text)
+			assert.NotEmpty(t, got.Runs)
+		})
+	}
+}
+
+func TestDecodeAttributedStringErrors(t *testing.T) {
+	valid := readFixture(t, "text_only.bin")
+
+	withByte := func(offset int, b byte) []byte {
+		buffer := append([]byte{}, valid...)
+		buffer[offset] = b
+		return buffer
+	}
+
+	tests := []struct {
+		name    string
+		buffer  []byte
+		wantErr error
+	}{
+		{
+			name:    "Empty",
+			buffer:  []byte{},
+			wantErr: ErrStreamTypedBufferTooShort,
+		},
+		{
+			name:    "Truncated",
+			buffer:  valid[:len(valid)/2],
+			wantErr: ErrStreamTypedBufferTooShort,
+		},
+		{
+			name:    "Missing end of object",
+			buffer:  valid[:len(valid)-1],
+			wantErr: ErrStreamTypedBufferTooShort,
+		},
+		{
+			name:    "Unsupported version",
+			buffer:  withByte(0, 3),
+			wantErr: ErrStreamTypedUnsupportedVersion,
+		},
+		{
+			name:    "Bad signature",
+			buffer:  withByte(2, 'x'),
+			wantErr: ErrStreamTypedMagicMismatch,
+		},
+		{
+			// The "@" type encoding of the root group is replaced by a reference to a
+			// shared string that hasn't been read yet.
+			name:    "Bad reference",
+			buffer:  withByte(16, 0x92),
+			wantErr: ErrStreamTypedInvalidReference,
+		},
+		{
+			name:    "Not an attributed string",
+			buffer:  []byte{0x04, 0x0b, 's', 't', 'r', 'e', 'a', 'm', 't', 'y', 'p', 'e', 'd', 0x81, 0xe8, 0x03, 0x84, 0x01, 'i', 0x05},
+			wantErr: ErrStreamTypedMessageInvalid,
+		},
+		{
+			name:    "Class is its own superclass",
+			buffer:  []byte{0x04, 0x0b, 's', 't', 'r', 'e', 'a', 'm', 't', 'y', 'p', 'e', 'd', 0x81, 0xe8, 0x03, 0x84, 0x01, '@', 0x84, 0x84, 0x08, 'N', 'S', 'S', 't', 'r', 'i', 'n', 'g', 0x01, 0x92},
+			wantErr: ErrStreamTypedInvalidReference,
+		},
+		{
+			name:    "Array without an element type",
+			buffer:  []byte{0x04, 0x0b, 's', 't', 'r', 'e', 'a', 'm', 't', 'y', 'p', 'e', 'd', 0x81, 0xe8, 0x03, 0x84, 0x03, '[', '5', ']', 0x86},
+			wantErr: ErrStreamTypedUnsupportedType,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := DecodeAttributedString(tt.buffer)
+
+			assert.Nil(t, got)
+			assert.ErrorIs(t, err, ErrInvalidStreamTypedBuffer)
+			assert.ErrorIs(t, err, tt.wantErr)
+		})
+	}
+}
+
+func TestObjectValueSelfReference(t *testing.T) {
+	array := &Object{Class: &Class{Name: "NSArray"}}
+	array.Groups = []Group{{Type: "i", Values: []any{int64(2)}}, {Type: "@", Values: []any{array}}, {Type: "@", Values: []any{"a"}}}
+
+	dictionary := &Object{Class: &Class{Name: "NSDictionary"}}
+	dictionary.Groups = []Group{{Type: "i", Values: []any{int64(1)}}, {Type: "@", Values: []any{"self"}}, {Type: "@", Values: []any{dictionary}}}
+
+	assert.Equal(t, []any{array, "a"}, objectValue(array))
+	assert.Equal(t, map[string]any{"self": dictionary}, objectValue(dictionary))
+}
+
+func FuzzDecode(f *testing.F) {
+	fixtures, err := filepath.Glob(filepath.Join("testdata", "*.bin"))
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, fixture := range fixtures {
+		buffer, err := os.ReadFile(fixture)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(buffer)
+	}
+	f.Add([]byte{0x04, 0x0b, 's', 't', 'r', 'e', 'a', 'm', 't', 'y', 'p', 'e', 'd', 0x81, 0xe8, 0x03, 0x84, 0x03, '[', '5', ']', 0x86})
+
+	f.Fuzz(func(t *testing.T, buffer []byte) {
+		// Anything goes as long as nothing panics.
+		_, _ = Decode(buffer)
+		_, _ = DecodeAttributedString(buffer)
+	})
+}
+
+func TestDecodeErrorOffset(t *testing.T) {
+	valid := readFixture(t, "text_only.bin")
+
+	_, err := Decode(valid[:40])
+
+	// The buffer ends part way through the name of the NSAttributedString class, which
+	// starts at offset 23.
+	var decodeErr *DecodeError
+	if assert.True(t, errors.As(err, &decodeErr)) {
+		assert.Equal(t, 23, decodeErr.Offset)
+	}
+}
+
+func TestDecodeAttributedStringScripts(t *testing.T) {
+	tests := []struct {
+		name    string
+		fixture string
+		want    string
+	}{
+		{name: "German", fixture: "script_german.bin", want: "Ihr Bestätigungscode lautet 482913. Er ist 10 Minuten gültig."},
+		{name: "Chinese", fixture: "script_chinese.bin", want: "【淘宝】您的验证码是482913，5分钟内有效。"},
+		{name: "Japanese", fixture: "script_japanese.bin", want: "認証コード：482913 このコードは10分間有効です。"},
+		{name: "Korean", fixture: "script_korean.bin", want: "[Web발신] 인증번호 [482913]를 입력해주세요."},
+		{name: "Russian", fixture: "script_russian.bin", want: "Ваш код подтверждения: 482913. Никому не сообщайте его."},
+		{name: "Arabic", fixture: "script_arabic.bin", want: "رمز التحقق الخاص بك هو 482913"},
+		{name: "Emoji", fixture: "script_emoji.bin", want: "🔑 Your code is 482913 ✅"},
+		{name: "Corrupt byte", fixture: "corrupt_utf8.bin", want: "Ihr Best�tigungscode lautet 482913"},
+		{name: "Truncated character", fixture: "truncated_utf8.bin", want: "Your code is 482913 �"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := DecodeAttributedString(readFixture(t, tt.fixture))
+
+			assert.NoError(t, err)
+			if assert.NotNil(t, got) && assert.Len(t, got.Runs, 1) {
+				assert.Equal(t, tt.want, got.Text)
+				assert.Equal(t, len(tt.want), got.Runs[0].End)
+			}
+		})
+	}
+}
+
+func TestDecodeUTF8(t *testing.T) {
+	tests := []struct {
+		name   string
+		buffer []byte
+		want   string
+	}{
+		{name: "ASCII", buffer: []byte("code 1234"), want: "code 1234"},
+		{name: "Multi-byte", buffer: []byte("验证码 1234"), want: "验证码 1234"},
+		{name: "Replacement character is kept", buffer: []byte("a�b"), want: "a�b"},
+		{name: "Invalid byte", buffer: []byte("a\xffb"), want: "a�b"},
+		{name: "Invalid continuation", buffer: []byte("a\xe9\x41b"), want: "a�Ab"},
+		{name: "Truncated at the end", buffer: []byte("a\xe9\xaa"), want: "a�"},
+		{name: "Truncated four byte sequence", buffer: []byte("a\xf0\x9f\x94"), want: "a�"},
+		{name: "Empty", buffer: []byte{}, want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, decodeUTF8(tt.buffer))
+		})
+	}
+}
@@ -0,0 +1,92 @@
+// Command capture copies the attributedBody of a message in chat.db into
+// testdata/captured, so the decoder is tested against what Messages really writes and
+// not just the synthetic fixtures from testdata/gen. Alongside it goes the text column
+// of the message, which Messages writes separately and the decoded text must match, and
+// the version of macOS that wrote it.
+//
+// Run it from the streamtyped package on a Mac, with Full Disk Access for the terminal:
+//
+//	go run ./testdata/capture -guid <message guid> -name <fixture name>
+//
+// The message is committed as is, so only capture messages that are safe to publish,
+// like codes that have long expired.
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// capture is the JSON sidecar written next to a captured attributedBody.
+type capture struct {
+	MacOSVersion string `json:"macos_version"`
+	MacOSBuild   string `json:"macos_build"`
+	Service      string `json:"service"`
+	Text         string `json:"text"`
+}
+
+func main() {
+	home, _ := os.UserHomeDir()
+
+	dbPath := flag.String("db", filepath.Join(home, "Library", "Messages", "chat.db"), "path to chat.db")
+	guid := flag.String("guid", "", "guid of the message to capture")
+	name := flag.String("name", "", "name of the fixture, without an extension")
+	dir := flag.String("out", filepath.Join("testdata", "captured"), "directory to write the fixture to")
+	flag.Parse()
+
+	if *guid == "" || *name == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	db, err := sql.Open("sqlite3", "file:"+*dbPath+"?mode=ro")
+	if err != nil {
+		log.Fatalf("opening chat.db: %v", err)
+	}
+	defer db.Close()
+
+	var attributedBody []byte
+	var text, service sql.NullString
+	row := db.QueryRow(`SELECT attributedBody, text, service FROM message WHERE guid = ?`, *guid)
+	if err := row.Scan(&attributedBody, &text, &service); err != nil {
+		log.Fatalf("reading message: %v guid:%s", err, *guid)
+	}
+	if len(attributedBody) == 0 {
+		log.Fatalf("message has no attributedBody guid:%s", *guid)
+	}
+
+	buf, err := json.MarshalIndent(&capture{
+		MacOSVersion: swVers("-productVersion"),
+		MacOSBuild:   swVers("-buildVersion"),
+		Service:      service.String,
+		Text:         text.String,
+	}, "", "\t")
+	if err != nil {
+		log.Fatalf("encoding capture: %v", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(*dir, *name+".bin"), attributedBody, 0o644); err != nil {
+		log.Fatalf("writing attributedBody: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(*dir, *name+".json"), append(buf, '\n'), 0o644); err != nil {
+		log.Fatalf("writing capture: %v", err)
+	}
+}
+
+// swVers returns a field of the running macOS version, e.g. "14.4.1" for -productVersion.
+func swVers(flag string) string {
+	out, err := exec.Command("sw_vers", flag).Output()
+	if err != nil {
+		log.Fatalf("reading macOS version: %v", err)
+	}
+
+	return strings.TrimSpace(string(out))
+}
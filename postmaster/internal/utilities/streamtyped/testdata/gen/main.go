@@ -0,0 +1,342 @@
+// Command gen writes the synthetic typedstream fixtures in testdata, by archiving
+// attributed strings shaped like the ones Messages writes to the attributedBody column
+// of chat.db. Run it from the streamtyped package with go generate.
+//
+// These fixtures cover the corners of the format, like big endian streams and long
+// strings, that real messages rarely hit. Real messages captured from chat.db are kept
+// in testdata/captured instead, see testdata/capture.
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"unicode/utf16"
+)
+
+const messagePartAttributeName = "__kIMMessagePartAttributeName"
+
+// classVersion is a class in an object's class chain, along with its version.
+type classVersion struct {
+	name    string
+	version int
+}
+
+// object is an Objective-C object to archive. Its chain starts at its own class and ends
+// at the root class, and its groups are the values it encodes, as typedstream groups.
+type object struct {
+	chain  []classVersion
+	groups []group
+}
+
+// group is a run of values encoded under one type string, e.g. "iI" for two integers.
+type group struct {
+	types  string
+	values []any
+}
+
+// raw is written as is, for the bytes of strings and C arrays.
+type raw []byte
+
+func nsString(text []byte, class string) *object {
+	chain := []classVersion{{class, 1}}
+	if class != "NSString" {
+		chain = append(chain, classVersion{"NSString", 1})
+	}
+
+	return &object{
+		chain:  append(chain, classVersion{"NSObject", 0}),
+		groups: []group{{"+", []any{raw(text)}}},
+	}
+}
+
+func nsNumber(value int) *object {
+	return &object{
+		chain:  []classVersion{{"NSNumber", 0}, {"NSValue", 0}, {"NSObject", 0}},
+		groups: []group{{"*", []any{"q"}}, {"q", []any{value}}},
+	}
+}
+
+// nsDictionary archives the keys and values in pairs, key first.
+func nsDictionary(pairs ...*object) *object {
+	groups := []group{{"i", []any{len(pairs) / 2}}}
+	for _, value := range pairs {
+		groups = append(groups, group{"@", []any{value}})
+	}
+
+	return &object{chain: []classVersion{{"NSDictionary", 0}, {"NSObject", 0}}, groups: groups}
+}
+
+func nsData(data []byte) *object {
+	return &object{
+		chain:  []classVersion{{"NSData", 0}, {"NSObject", 0}},
+		groups: []group{{"i", []any{len(data)}}, {fmt.Sprintf("[%dc]", len(data)), []any{raw(data)}}},
+	}
+}
+
+// nsURL archives whether the URL has a base URL, which it never does here, and then its
+// string.
+func nsURL(url string) *object {
+	return &object{
+		chain:  []classVersion{{"NSURL", 0}, {"NSObject", 0}},
+		groups: []group{{"c", []any{0}}, {"@", []any{nsString([]byte(url), "NSString")}}},
+	}
+}
+
+// run is a range of an attributed string. Index is 1 for a new attribute dictionary,
+// or the index of one already used, in which case attributes is nil.
+type run struct {
+	index      int
+	length     int
+	attributes *object
+}
+
+func nsAttributedString(text *object, runs []run, class string) *object {
+	chain := []classVersion{{class, 0}}
+	if class != "NSAttributedString" {
+		chain = append(chain, classVersion{"NSAttributedString", 0})
+	}
+
+	groups := []group{{"@", []any{text}}}
+	for _, r := range runs {
+		groups = append(groups, group{"iI", []any{r.index, r.length}})
+		if r.attributes != nil {
+			groups = append(groups, group{"@", []any{r.attributes}})
+		}
+	}
+
+	return &object{chain: append(chain, classVersion{"NSObject", 0}), groups: groups}
+}
+
+// encoder writes a typedstream, keeping track of the shared strings, classes and objects
+// already written so later uses refer back to them.
+type encoder struct {
+	order   binary.ByteOrder
+	buf     bytes.Buffer
+	strings map[string]int
+	classes map[string]int
+	objects map[*object]int
+	next    int
+}
+
+func archive(root *object, order binary.ByteOrder, signature string) []byte {
+	e := &encoder{
+		order:   order,
+		strings: make(map[string]int),
+		classes: make(map[string]int),
+		objects: make(map[*object]int),
+	}
+
+	e.int(4)
+	e.int(len(signature))
+	e.buf.WriteString(signature)
+	e.int(1000)
+	e.group(group{"@", []any{root}})
+
+	return e.buf.Bytes()
+}
+
+func (e *encoder) int(v int) {
+	switch {
+	case v >= -110 && v <= 127:
+		e.buf.WriteByte(byte(int8(v)))
+	case v >= -32768 && v <= 32767:
+		e.buf.WriteByte(0x81)
+		binary.Write(&e.buf, e.order, int16(v))
+	default:
+		e.buf.WriteByte(0x82)
+		binary.Write(&e.buf, e.order, int32(v))
+	}
+}
+
+func (e *encoder) ref(index int) {
+	e.int(index - 110)
+}
+
+func (e *encoder) shared(s string) {
+	if index, ok := e.strings[s]; ok {
+		e.ref(index)
+		return
+	}
+
+	e.buf.WriteByte(0x84)
+	e.int(len(s))
+	e.buf.WriteString(s)
+	e.strings[s] = len(e.strings)
+}
+
+func (e *encoder) class(chain []classVersion) {
+	if len(chain) == 0 {
+		e.buf.WriteByte(0x85)
+		return
+	}
+
+	if index, ok := e.classes[chain[0].name]; ok {
+		e.ref(index)
+		return
+	}
+
+	e.buf.WriteByte(0x84)
+	e.shared(chain[0].name)
+	e.int(chain[0].version)
+	e.classes[chain[0].name] = e.next
+	e.next++
+	e.class(chain[1:])
+}
+
+func (e *encoder) object(o *object) {
+	if o == nil {
+		e.buf.WriteByte(0x85)
+		return
+	}
+
+	if index, ok := e.objects[o]; ok {
+		e.ref(index)
+		return
+	}
+
+	e.buf.WriteByte(0x84)
+	e.objects[o] = e.next
+	e.next++
+	e.class(o.chain)
+	for _, g := range o.groups {
+		e.group(g)
+	}
+	e.buf.WriteByte(0x86)
+}
+
+func (e *encoder) group(g group) {
+	e.shared(g.types)
+
+	if g.types[0] == '[' {
+		e.buf.Write(g.values[0].(raw))
+		return
+	}
+
+	for i, t := range g.types {
+		e.value(t, g.values[i])
+	}
+}
+
+func (e *encoder) value(t rune, v any) {
+	switch t {
+	case 'c', 'C', 's', 'S', 'i', 'I', 'l', 'L', 'q', 'Q', 'B':
+		e.int(v.(int))
+	case '@':
+		e.object(v.(*object))
+	case '*', ':', '%':
+		e.shared(v.(string))
+	case '+':
+		e.int(len(v.(raw)))
+		e.buf.Write(v.(raw))
+	default:
+		log.Fatalf("unsupported type %q", t)
+	}
+}
+
+// utf16Length is the length of text in UTF-16 code units, which run lengths are given in.
+func utf16Length(text string) int {
+	return len(utf16.Encode([]rune(text)))
+}
+
+// plainMessage archives text as a single run, as written for most incoming SMS.
+func plainMessage(text []byte, length int) []byte {
+	attributes := nsDictionary(nsString([]byte(messagePartAttributeName), "NSString"), nsNumber(0))
+
+	return archive(nsAttributedString(nsString(text, "NSString"), []run{{1, length, attributes}}, "NSAttributedString"), binary.LittleEndian, "streamtyped")
+}
+
+func main() {
+	dir := "testdata"
+	if len(os.Args) > 1 {
+		dir = os.Args[1]
+	}
+
+	write := func(name string, buf []byte) {
+		if err := os.WriteFile(filepath.Join(dir, name), buf, 0o644); err != nil {
+			log.Fatalf("writing %s: %v", name, err)
+		}
+	}
+
+	str := func(s string) *object {
+		return nsString([]byte(s), "NSString")
+	}
+
+	// A plain message, as written for most incoming SMS.
+	text := "Your Uber code is 1808. Never share this code. Reply STOP ending in 5910 to unsubscribe."
+	write("text_only.bin", plainMessage([]byte(text), len(text)))
+
+	// Several runs: a data detector on the code, reusing the first attribute dictionary
+	// after it.
+	text = "Your code is 482913. Don't share it."
+	part := str(messagePartAttributeName)
+	write("multiple_runs.bin", archive(nsAttributedString(str(text), []run{
+		{1, 13, nsDictionary(part, nsNumber(0))},
+		{2, 6, nsDictionary(
+			part, nsNumber(0),
+			str("__kIMOneTimeCodeAttributeName"), nsDictionary(str("code"), str("482913")),
+			str("__kIMDataDetectedAttributeName"), nsData([]byte{1, 2, 3}),
+		)},
+		{1, len(text) - 19, nil},
+	}, "NSAttributedString"), binary.LittleEndian, "streamtyped"))
+
+	// A message longer than 127 bytes, so its length is a 16 bit integer.
+	text = "Je verificatiecode voor je account is 771204. Deze code is 10 minuten geldig. Deel deze code nooit met iemand, ook niet met medewerkers van de klantenservice."
+	write("long_text.bin", plainMessage([]byte(text), len(text)))
+
+	// Mutable subclasses, which some macOS versions write instead.
+	text = "G-123456 is your Google verification code."
+	write("mutable.bin", archive(nsAttributedString(nsString([]byte(text), "NSMutableString"), []run{
+		{1, len(text), nsDictionary(str(messagePartAttributeName), nsNumber(0))},
+	}, "NSMutableAttributedString"), binary.LittleEndian, "streamtyped"))
+
+	// Non-ASCII text, where run lengths in UTF-16 code units differ from byte lengths.
+	text = "您的验证码是 482913 🔐"
+	write("unicode.bin", archive(nsAttributedString(str(text), []run{
+		{1, 7, nsDictionary(str(messagePartAttributeName), nsNumber(0))},
+		{1, utf16Length(text) - 7, nil},
+	}, "NSAttributedString"), binary.LittleEndian, "streamtyped"))
+
+	// A big endian stream.
+	text = "Your code is 5512"
+	write("big_endian.bin", archive(nsAttributedString(str(text), []run{
+		{1, len(text), nsDictionary(str(messagePartAttributeName), nsNumber(300))},
+	}, "NSAttributedString"), binary.BigEndian, "typedstream"))
+
+	// A message where Messages identified the code, and a link, itself.
+	text = "Your Apple ID code is: 482913. Don't share it. apple.com/account"
+	part = str(messagePartAttributeName)
+	write("one_time_code.bin", archive(nsAttributedString(str(text), []run{
+		{1, 23, nsDictionary(part, nsNumber(0))},
+		{2, 6, nsDictionary(
+			part, nsNumber(0),
+			str("__kIMOneTimeCodeAttributeName"), nsDictionary(str("code"), str("482913"), str("displayCode"), str("482913")),
+		)},
+		{1, 18, nil},
+		{3, len(text) - 47, nsDictionary(part, nsNumber(0), str("__kIMLinkAttributeName"), nsURL("https://apple.com/account"))},
+	}, "NSAttributedString"), binary.LittleEndian, "streamtyped"))
+
+	// Messages in several scripts, to make sure multi-byte text survives decoding.
+	scripts := map[string]string{
+		"script_german.bin":   "Ihr Bestätigungscode lautet 482913. Er ist 10 Minuten gültig.",
+		"script_chinese.bin":  "【淘宝】您的验证码是482913，5分钟内有效。",
+		"script_japanese.bin": "認証コード：482913 このコードは10分間有効です。",
+		"script_korean.bin":   "[Web발신] 인증번호 [482913]를 입력해주세요.",
+		"script_russian.bin":  "Ваш код подтверждения: 482913. Никому не сообщайте его.",
+		"script_arabic.bin":   "رمز التحقق الخاص بك هو 482913",
+		"script_emoji.bin":    "🔑 Your code is 482913 ✅",
+	}
+	for name, text := range scripts {
+		write(name, plainMessage([]byte(text), utf16Length(text)))
+	}
+
+	// A string with a corrupt byte in place of the "ä".
+	write("corrupt_utf8.bin", plainMessage(bytes.ReplaceAll([]byte("Ihr Bestätigungscode lautet 482913"), []byte("ä"), []byte{0xff}), 34))
+
+	// A string cut off part way through its last character.
+	truncated := []byte("Your code is 482913 ✅")
+	write("truncated_utf8.bin", plainMessage(truncated[:len(truncated)-1], 21))
+}